@@ -0,0 +1,98 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Access control on the moviePaths keys (libraries). A library can
+// be granted to a user or to a group of users, and the special
+// library name allLibraries grants every library.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// Granting this library name grants every library
+	allLibraries = "*"
+	// Principals starting with this prefix name groups rather
+	// than users
+	groupPrefix = "@"
+
+	principalUser  = "user"
+	principalGroup = "group"
+)
+
+// A row of the access control list
+type libraryGrant struct {
+	PrincipalType string
+	Principal     string
+	Library       string
+}
+
+// A user's membership in a group
+type groupMember struct {
+	Group string
+	User  string
+}
+
+// Splits a principal given on the command line (a username, or a
+// group name prefixed with groupPrefix) into its type and name
+func parsePrincipal(principal string) (string, string, error) {
+	if strings.HasPrefix(principal, groupPrefix) {
+		principal = principal[len(groupPrefix):]
+		if principal == "" {
+			return "", "", fmt.Errorf("Group name cannot be empty")
+		}
+		return principalGroup, principal, nil
+	}
+	return principalUser, principal, nil
+}
+
+// Returns the set of moviePaths keys that the user may list and
+// download from. These are the libraries granted to the user
+// directly or through one of the user's groups. If the user hasn't
+// been granted anything at all, it falls back to the
+// default-library-access flag.
+func allowedLibraries(user string) (map[string]bool, error) {
+	libraries, err := dbStore.UserLibraries(user)
+	if err != nil {
+		return nil, err
+	}
+	granted := make(map[string]bool)
+	for _, library := range libraries {
+		granted[library] = true
+	}
+
+	if len(granted) == 0 && *defaultLibraryAccess == "all" {
+		granted[allLibraries] = true
+	}
+	allowed := make(map[string]bool)
+	for k, _ := range moviePaths {
+		if granted[allLibraries] || granted[k] {
+			allowed[k] = true
+		}
+	}
+	return allowed, nil
+}
+
+// Returns true if the user may list and download from the library
+func canAccessLibrary(user, library string) (bool, error) {
+	allowed, err := allowedLibraries(user)
+	if err != nil {
+		return false, err
+	}
+	return allowed[library], nil
+}
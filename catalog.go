@@ -0,0 +1,178 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// The catalog, a versioned JSON dump of everything a store keeps
+// except sessions. The export and import commands use it to move a
+// server between databases and backends, or to restore one from a
+// backup.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// The version of the catalog format. Catalogs with any other version
+// are refused.
+const catalogVersion = 1
+
+type catalogMovie struct {
+	Path      string `json:"path"`
+	Name      string `json:"name"`
+	Downloads uint64 `json:"downloads"`
+	movieMeta
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type catalogUser struct {
+	Name         string     `json:"name"`
+	PasswordHash string     `json:"password_hash"`
+	Created      time.Time  `json:"created"`
+	LastLogin    *time.Time `json:"last_login,omitempty"`
+}
+
+type catalogGroupMember struct {
+	Group string `json:"group"`
+	User  string `json:"user"`
+}
+
+type catalogGrant struct {
+	PrincipalType string `json:"principal_type"`
+	Principal     string `json:"principal"`
+	Library       string `json:"library"`
+}
+
+type catalogToken struct {
+	ID       uint64     `json:"id"`
+	User     string     `json:"user"`
+	Hash     string     `json:"hash"`
+	Scope    string     `json:"scope"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+type catalogLock struct {
+	User     string    `json:"user"`
+	LockedAt time.Time `json:"locked_at"`
+}
+
+type catalogShareLink struct {
+	ID      uint64    `json:"id"`
+	Creator string    `json:"creator"`
+	Library string    `json:"library"`
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires"`
+	// Unlimited if missing
+	MaxDownloads *int64 `json:"max_downloads,omitempty"`
+	Downloads    uint64 `json:"downloads"`
+}
+
+// The downloads of a movie, or of a library if the name is empty, on
+// a day
+type catalogDailyDownloads struct {
+	Path string `json:"path"`
+	Name string `json:"name,omitempty"`
+	// In dayFormat
+	Day       string `json:"day"`
+	Downloads uint64 `json:"downloads"`
+}
+
+// Everything a store keeps except sessions. Rows with ids keep them,
+// so that share links and token ids stay valid.
+type catalog struct {
+	Version               int                     `json:"version"`
+	Exported              time.Time               `json:"exported"`
+	Movies                []catalogMovie          `json:"movies"`
+	Users                 []catalogUser           `json:"users"`
+	Groups                []catalogGroupMember    `json:"groups"`
+	Grants                []catalogGrant          `json:"grants"`
+	Tokens                []catalogToken          `json:"tokens"`
+	Locks                 []catalogLock           `json:"locks"`
+	ShareLinks            []catalogShareLink      `json:"share_links"`
+	MovieDownloadsDaily   []catalogDailyDownloads `json:"movie_downloads_daily"`
+	LibraryDownloadsDaily []catalogDailyDownloads `json:"library_downloads_daily"`
+	DownloadEvents        []downloadEvent         `json:"download_events"`
+}
+
+// Returns an empty catalog of the current version
+func newCatalog() *catalog {
+	return &catalog{
+		Version:               catalogVersion,
+		Exported:              time.Now().UTC(),
+		Movies:                make([]catalogMovie, 0),
+		Users:                 make([]catalogUser, 0),
+		Groups:                make([]catalogGroupMember, 0),
+		Grants:                make([]catalogGrant, 0),
+		Tokens:                make([]catalogToken, 0),
+		Locks:                 make([]catalogLock, 0),
+		ShareLinks:            make([]catalogShareLink, 0),
+		MovieDownloadsDaily:   make([]catalogDailyDownloads, 0),
+		LibraryDownloadsDaily: make([]catalogDailyDownloads, 0),
+		DownloadEvents:        make([]downloadEvent, 0),
+	}
+}
+
+// Reads a catalog, refusing versions other than catalogVersion and
+// days that don't parse
+func readCatalog(r io.Reader) (*catalog, error) {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(contents, &header); err != nil {
+		return nil, fmt.Errorf("Could not read catalog: %s", err)
+	}
+	if header.Version != catalogVersion {
+		return nil, fmt.Errorf("The catalog has version %d, but only version %d is supported", header.Version, catalogVersion)
+	}
+	c := newCatalog()
+	if err := json.Unmarshal(contents, c); err != nil {
+		return nil, fmt.Errorf("Could not read catalog: %s", err)
+	}
+	for _, days := range [][]catalogDailyDownloads{c.MovieDownloadsDaily, c.LibraryDownloadsDaily} {
+		for _, d := range days {
+			if _, err := time.Parse(dayFormat, d.Day); err != nil {
+				return nil, fmt.Errorf("Invalid day in catalog: %s", d.Day)
+			}
+		}
+	}
+	return c, nil
+}
+
+// Returns a nullable time as a pointer, which is nil if the time is
+// NULL
+func timePointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// The reverse of timePointer
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
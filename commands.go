@@ -0,0 +1,540 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Subcommands for managing the server from the command line. They
+// are given after the flags, for example "movieserver user add bob"
+// or "movieserver export".
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/term"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type command struct {
+	// The arguments the command takes, shown in the usage message
+	args string
+	// A one-line description, shown in the usage message
+	help string
+	// The minimum and maximum number of arguments the command
+	// takes
+	minArgs, maxArgs int
+	run              func(args []string) error
+}
+
+// Maps the words that name a command (like "user add") to the
+// command
+var commands = map[string]command{
+	"user add":       {"<username>", "Create a user, prompting for the password", 1, 1, userAddCommand},
+	"user remove":    {"<username>", "Delete a user", 1, 1, userRemoveCommand},
+	"user passwd":    {"<username>", "Change a user's password, prompting for the new one, and revoke their sessions", 1, 1, userPasswdCommand},
+	"user list":      {"", "List all the users", 0, 0, userListCommand},
+	"user unlock":    {"<username>", "Unlock an account that was locked after too many failed logins", 1, 1, userUnlockCommand},
+	"group add":      {"<group> <username>", "Add a user to a group", 2, 2, groupAddCommand},
+	"group remove":   {"<group> <username>", "Remove a user from a group", 2, 2, groupRemoveCommand},
+	"group list":     {"", "List every group and its members", 0, 0, groupListCommand},
+	"acl grant":      {"<username|@group> <library|*>", "Let a user or group list and download from a library", 2, 2, aclGrantCommand},
+	"acl revoke":     {"<username|@group> <library|*>", "Revoke a library from a user or group", 2, 2, aclRevokeCommand},
+	"acl list":       {"", "List every library grant", 0, 0, aclListCommand},
+	"token create":   {"<username> [list|download]", "Create an API token with the given scope (download by default)", 1, 2, tokenCreateCommand},
+	"token revoke":   {"<id>", "Revoke an API token", 1, 1, tokenRevokeCommand},
+	"token list":     {"[username]", "List the API tokens of every user, or of the given user", 0, 1, tokenListCommand},
+	"session list":   {"[username]", "List the active sessions of every user, or of the given user", 0, 1, sessionListCommand},
+	"session revoke": {"<username>", "Revoke every session of a user, logging them out everywhere", 1, 1, sessionRevokeCommand},
+	"share list":     {"[username]", "List the share links of every user, or of the given user", 0, 1, shareListCommand},
+	"share revoke":   {"<id>", "Revoke a share link", 1, 1, shareRevokeCommand},
+	"migrate status": {"", "Show which schema migrations have been applied to the database, without applying any", 0, 0, migrateStatusCommand},
+	"export":         {"[file|-]", "Write the movies, users and everything else except sessions to a file (stdout by default) as JSON", 0, 1, exportCommand},
+	"import":         {"<file|->", "Replace everything in the database with an exported catalog, logging out every user", 1, 1, importCommand},
+}
+
+// Commands that open the database without applying pending schema
+// migrations
+var unmigratedCommands = map[string]bool{
+	"migrate status": true,
+}
+
+// Prints every command and its arguments to stderr
+func printCommandUsage() {
+	names := make([]string, 0, len(commands))
+	for name, _ := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "Commands (given after any flags):\n")
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, cmd.args, cmd.help)
+	}
+}
+
+// Finds the command named by the first two words of args, or by the
+// first word if no command has those two, and runs it with the
+// remaining arguments. It connects to the database before running the
+// command and disconnects afterwards. Unless it is one of
+// unmigratedCommands, the database is migrated first.
+func runCommand(args []string) error {
+	var (
+		name string
+		cmd  command
+		ok   bool
+	)
+	if len(args) >= 2 {
+		name = args[0] + " " + args[1]
+		cmd, ok = commands[name]
+	}
+	if ok {
+		args = args[2:]
+	} else if len(args) >= 1 {
+		name = args[0]
+		cmd, ok = commands[name]
+		args = args[1:]
+	}
+	if !ok {
+		printCommandUsage()
+		return fmt.Errorf("Unknown command")
+	}
+	if len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+		printCommandUsage()
+		return fmt.Errorf("Wrong number of arguments: got %d", len(args))
+	}
+
+	if err := openDB(!unmigratedCommands[name]); err != nil {
+		return err
+	}
+	defer cleanupDB()
+	return cmd.run(args)
+}
+
+// Reads a password from stdin. If stdin is a terminal, it prompts for
+// the password twice without echoing it. Otherwise, it reads a single
+// line, so that passwords can be piped in from scripts.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", fmt.Errorf("Could not read password from stdin: %s", err)
+		}
+		password := strings.TrimRight(line, "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("Password cannot be empty")
+		}
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(first) == 0 {
+		return "", fmt.Errorf("Password cannot be empty")
+	}
+	fmt.Fprint(os.Stderr, "Retype password: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("Passwords do not match")
+	}
+	return string(first), nil
+}
+
+func userAddCommand(args []string) error {
+	password, err := readPassword(fmt.Sprintf("Password for %s: ", args[0]))
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := dbStore.NewUser(args[0], hash); err != nil {
+		return fmt.Errorf("Could not add user %s: %s", args[0], err)
+	}
+	fmt.Printf("Added user %s\n", args[0])
+	return nil
+}
+
+// Removes the user along with everything that belongs to them
+func userRemoveCommand(args []string) error {
+	if ok, err := dbStore.DeleteUser(args[0]); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("User %s does not exist", args[0])
+	}
+	fmt.Printf("Removed user %s\n", args[0])
+	return nil
+}
+
+// Returns an error if the user doesn't exist
+func checkUserExists(user string) error {
+	if _, ok, err := dbStore.PasswordHash(user); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("Could not find user %s", user)
+	}
+	return nil
+}
+
+func userPasswdCommand(args []string) error {
+	if err := checkUserExists(args[0]); err != nil {
+		return err
+	}
+	password, err := readPassword(fmt.Sprintf("New password for %s: ", args[0]))
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := dbStore.SetPasswordHash(args[0], hash); err != nil {
+		return err
+	}
+	// Anyone logged in with the old password is logged out
+	if _, err := dbStore.DeleteUserSessions(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Changed the password for %s\n", args[0])
+	return nil
+}
+
+// The format that command output uses for timestamps
+const commandTimeFormat = "2006-01-02 15:04:05 MST"
+
+func userListCommand(args []string) error {
+	users, err := dbStore.Users()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tCREATED\tLAST LOGIN\tLOCKED")
+	for _, u := range users {
+		lastLogin, locked := "never", "no"
+		if u.LastLogin.Valid {
+			lastLogin = u.LastLogin.Time.Local().Format(commandTimeFormat)
+		}
+		if u.LockedAt.Valid {
+			locked = u.LockedAt.Time.Local().Format(commandTimeFormat)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Name, u.Created.Local().Format(commandTimeFormat), lastLogin, locked)
+	}
+	return tw.Flush()
+}
+
+func userUnlockCommand(args []string) error {
+	if ok, err := dbStore.UnlockAccount(args[0]); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s is not locked", args[0])
+	}
+	fmt.Printf("Unlocked %s\n", args[0])
+	return nil
+}
+
+func groupAddCommand(args []string) error {
+	if err := checkUserExists(args[1]); err != nil {
+		return err
+	}
+	if err := dbStore.AddGroupMember(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Added %s to group %s\n", args[1], args[0])
+	return nil
+}
+
+func groupRemoveCommand(args []string) error {
+	if ok, err := dbStore.RemoveGroupMember(args[0], args[1]); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s is not in group %s", args[1], args[0])
+	}
+	fmt.Printf("Removed %s from group %s\n", args[1], args[0])
+	return nil
+}
+
+func groupListCommand(args []string) error {
+	members, err := dbStore.GroupMembers()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "GROUP\tUSER")
+	for _, m := range members {
+		fmt.Fprintf(tw, "%s\t%s\n", m.Group, m.User)
+	}
+	return tw.Flush()
+}
+
+func aclGrantCommand(args []string) error {
+	principalType, principal, err := parsePrincipal(args[0])
+	if err != nil {
+		return err
+	}
+	if err := dbStore.GrantLibrary(principalType, principal, args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Granted %s to %s %s\n", args[1], principalType, principal)
+	return nil
+}
+
+func aclRevokeCommand(args []string) error {
+	principalType, principal, err := parsePrincipal(args[0])
+	if err != nil {
+		return err
+	}
+	if ok, err := dbStore.RevokeLibrary(principalType, principal, args[1]); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s was not granted to %s %s", args[1], principalType, principal)
+	}
+	fmt.Printf("Revoked %s from %s %s\n", args[1], principalType, principal)
+	return nil
+}
+
+func aclListCommand(args []string) error {
+	grants, err := dbStore.Grants()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tPRINCIPAL\tLIBRARY")
+	for _, g := range grants {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", g.PrincipalType, g.Principal, g.Library)
+	}
+	return tw.Flush()
+}
+
+func tokenCreateCommand(args []string) error {
+	if err := checkUserExists(args[0]); err != nil {
+		return err
+	}
+	scope := scopeDownload
+	if len(args) == 2 {
+		scope = args[1]
+	}
+	token, err := createToken(args[0], scope)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Created a %s token for %s. It won't be shown again:\n", scope, args[0])
+	fmt.Println(token)
+	return nil
+}
+
+func tokenRevokeCommand(args []string) error {
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid token id %s: %s", args[0], err)
+	}
+	if ok, err := dbStore.DeleteToken(id); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("Token %d does not exist", id)
+	}
+	fmt.Printf("Revoked token %d\n", id)
+	return nil
+}
+
+func tokenListCommand(args []string) error {
+	user := ""
+	if len(args) == 1 {
+		user = args[0]
+	}
+	tokens, err := dbStore.Tokens(user)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tSCOPE\tCREATED\tLAST USED")
+	for _, t := range tokens {
+		lastUsed := "never"
+		if t.LastUsed.Valid {
+			lastUsed = t.LastUsed.Time.Local().Format(commandTimeFormat)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", t.ID, t.User, t.Scope, t.Created.Local().Format(commandTimeFormat), lastUsed)
+	}
+	return tw.Flush()
+}
+
+func sessionListCommand(args []string) error {
+	user := ""
+	if len(args) == 1 {
+		user = args[0]
+	}
+	sessions, err := dbStore.Sessions(user)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tCREATED\tLAST SEEN\tIP\tUSER AGENT")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.User, s.Created.Local().Format(commandTimeFormat),
+			s.LastSeen.Local().Format(commandTimeFormat), s.IP, s.UserAgent)
+	}
+	return tw.Flush()
+}
+
+func sessionRevokeCommand(args []string) error {
+	rowcount, err := dbStore.DeleteUserSessions(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Revoked %d sessions of %s\n", rowcount, args[0])
+	return nil
+}
+
+func shareListCommand(args []string) error {
+	creator := ""
+	if len(args) == 1 {
+		creator = args[0]
+	}
+	links, err := dbStore.ShareLinks(creator)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATOR\tLIBRARY\tNAME\tEXPIRES\tDOWNLOADS")
+	for _, link := range links {
+		downloads := strconv.FormatUint(link.Downloads, 10)
+		if link.MaxDownloads.Valid {
+			downloads += "/" + strconv.FormatInt(link.MaxDownloads.Int64, 10)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", link.ID, link.Creator, link.Library, link.Name,
+			link.Expires.Local().Format(commandTimeFormat), downloads)
+	}
+	return tw.Flush()
+}
+
+func shareRevokeCommand(args []string) error {
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid share link id %s: %s", args[0], err)
+	}
+	if ok, err := dbStore.DeleteShareLink(id); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("Share link %d does not exist", id)
+	}
+	fmt.Printf("Revoked share link %d\n", id)
+	return nil
+}
+
+// Prints every migration the server knows about and when it was
+// applied. Unlike the other commands, it runs without migrating the
+// database first.
+func migrateStatusCommand(args []string) error {
+	s, ok := dbStore.(*sqlStore)
+	if !ok {
+		return fmt.Errorf("The %s db-backend has no schema migrations", *dbBackend)
+	}
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	appliedAt := make(map[int]appliedMigration)
+	for _, m := range applied {
+		appliedAt[m.Version] = m
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	pending := 0
+	for _, m := range migrations {
+		status := "pending"
+		if a, ok := appliedAt[m.Version]; ok {
+			status = a.Applied.Local().Format(commandTimeFormat)
+		} else {
+			pending++
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, status)
+	}
+	// Lists the versions applied by a newer server too
+	for _, a := range applied {
+		if a.Version > len(migrations) {
+			fmt.Fprintf(tw, "%d\t%s\t%s (unknown to this server)\n", a.Version, a.Name, a.Applied.Local().Format(commandTimeFormat))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d of %d migrations applied, %d pending\n", len(migrations)-pending, len(migrations), pending)
+	return nil
+}
+
+// Writes the catalog of the store to the given file, or to stdout if
+// there isn't one or it is "-"
+func exportCommand(args []string) error {
+	c, err := dbStore.Export()
+	if err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	contents = append(contents, '\n')
+	if len(args) == 0 || args[0] == "-" {
+		_, err = os.Stdout.Write(contents)
+		return err
+	}
+	if err := ioutil.WriteFile(args[0], contents, 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d movies and %d users to %s\n", len(c.Movies), len(c.Users), args[0])
+	return nil
+}
+
+// Replaces everything in the store with the catalog in the given
+// file, or in stdin if the file is "-"
+func importCommand(args []string) error {
+	r := io.Reader(os.Stdin)
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	c, err := readCatalog(r)
+	if err != nil {
+		return err
+	}
+	if err := dbStore.Import(c); err != nil {
+		return fmt.Errorf("Could not import %s: %s", args[0], err)
+	}
+	fmt.Printf("Imported %d movies and %d users\n", len(c.Movies), len(c.Users))
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// The download audit log. Every request to the movie handler is
+// recorded in the download_events table, with who asked for what,
+// when, what part of the file they asked for and how much of it was
+// sent. Admins can query the log through adminDownloadsURL.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// Members of this group can use the admin handlers
+	adminGroup = "admin"
+
+	// The longest Range header stored in the download_events
+	// table
+	maxRangeLen = 255
+	// The number of events returned per page when the request
+	// doesn't say
+	defaultEventsPerPage = 100
+	// The most events returned per page
+	maxEventsPerPage = 1000
+)
+
+// Returns true if the user is a member of adminGroup
+func isAdmin(user string) (bool, error) {
+	return dbStore.IsGroupMember(adminGroup, user)
+}
+
+// A row of the download_events table
+type downloadEvent struct {
+	ID       uint64    `json:"id"`
+	User     string    `json:"user"`
+	Library  string    `json:"library"`
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Bytes    uint64    `json:"bytes"`
+	Status   int       `json:"status"`
+	Range    string    `json:"range,omitempty"`
+	IP       string    `json:"ip"`
+}
+
+// Wraps the ResponseWriter of a movie request, keeping track of the
+// status and the number of bytes sent, so the request can be recorded
+// in the download_events table once it finishes
+type downloadRecorder struct {
+	http.ResponseWriter
+	r     *http.Request
+	event downloadEvent
+}
+
+// Starts recording a request for the given file
+func newDownloadRecorder(w http.ResponseWriter, r *http.Request, library, name string) *downloadRecorder {
+	rangeHeader := r.Header.Get("Range")
+	if len(rangeHeader) > maxRangeLen {
+		rangeHeader = rangeHeader[:maxRangeLen]
+	}
+	return &downloadRecorder{
+		ResponseWriter: w,
+		r:              r,
+		event: downloadEvent{
+			Library: library,
+			Name:    name,
+			Started: time.Now(),
+			Range:   rangeHeader,
+			IP:      remoteIP(r),
+		},
+	}
+}
+
+func (d *downloadRecorder) WriteHeader(code int) {
+	if d.event.Status == 0 {
+		d.event.Status = code
+	}
+	d.ResponseWriter.WriteHeader(code)
+}
+
+func (d *downloadRecorder) Write(b []byte) (int, error) {
+	if d.event.Status == 0 {
+		d.event.Status = http.StatusOK
+	}
+	n, err := d.ResponseWriter.Write(b)
+	d.event.Bytes += uint64(n)
+	return n, err
+}
+
+// Lets http.ServeContent hand files to the ResponseWriter's ReadFrom,
+// which can send them with sendfile instead of copying them through
+// userspace
+func (d *downloadRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if d.event.Status == 0 {
+		d.event.Status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := d.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(d.ResponseWriter, src)
+	}
+	d.event.Bytes += uint64(n)
+	return n, err
+}
+
+// Lets http.ResponseController reach the ResponseWriter's Flush and
+// deadlines
+func (d *downloadRecorder) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// Inserts the finished request into the download_events table. It is
+// meant to be deferred, so it only logs errors.
+func (d *downloadRecorder) record() {
+	event := d.event
+	event.User, event.Finished = requestUser(d.r), time.Now()
+	if event.Status == 0 {
+		event.Status = http.StatusOK
+	}
+	if err := dbStore.NewDownloadEvent(event); err != nil {
+		glog.Errorf("Error recording download of %s/%s: %s", event.Library, event.Name, err)
+	}
+}
+
+// Builds a query of the download audit log from the request's
+// filters: user, library, name, status, since and until (RFC 3339
+// times). Like the table handler's q parameter, q filters names by
+// prefix with * and ? wildcards.
+func parseDownloadEventQuery(query url.Values) (downloadEventQuery, error) {
+	q := downloadEventQuery{
+		User:    query.Get("user"),
+		Library: query.Get("library"),
+		Name:    query.Get("name"),
+	}
+	if pattern := query.Get("q"); pattern != "" {
+		q.Pattern = string(convertFilterString([]byte(pattern))) + "%"
+	}
+	if value := query.Get("status"); value != "" {
+		status, err := strconv.Atoi(value)
+		if err != nil {
+			return q, fmt.Errorf("Invalid status: %s", value)
+		}
+		q.Status = status
+	}
+	for _, bound := range []struct {
+		key string
+		t   *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		if value := query.Get(bound.key); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return q, fmt.Errorf("Invalid %s time: %s", bound.key, err)
+			}
+			*bound.t = t
+		}
+	}
+	return q, nil
+}
+
+// Serves the download_events table as a JSON object, newest first, to
+// members of adminGroup. The events can be filtered as described in
+// parseDownloadEventQuery and paginated with page and per_page.
+func adminDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	httpError := func(err error, code int) {
+		glog.Errorf("Error in admin downloads handler: %s", err)
+		http.Error(w, fmt.Sprintf("Failed to fetch downloads: %s", err), code)
+	}
+
+	user := requestUser(r)
+	if ok, err := isAdmin(user); err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	} else if !ok {
+		httpError(fmt.Errorf("%s is not in the %s group", user, adminGroup), http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	q, err := parseDownloadEventQuery(query)
+	if err != nil {
+		httpError(err, http.StatusBadRequest)
+		return
+	}
+	page, perPage := uint64(1), uint64(defaultEventsPerPage)
+	if value := query.Get("page"); value != "" {
+		if page, err = strconv.ParseUint(value, 10, 64); err != nil || page == 0 {
+			httpError(fmt.Errorf("Invalid page: %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("per_page"); value != "" {
+		if perPage, err = strconv.ParseUint(value, 10, 64); err != nil || perPage == 0 || perPage > maxEventsPerPage {
+			httpError(fmt.Errorf("per_page must be between 1 and %d", maxEventsPerPage), http.StatusBadRequest)
+			return
+		}
+	}
+	q.Offset, q.Limit = (page-1)*perPage, perPage
+
+	total, events, err := dbStore.DownloadEvents(q)
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"total_entries": total,
+		"page":          page,
+		"per_page":      perPage,
+		"events":        events,
+	})
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(jsonData))
+}
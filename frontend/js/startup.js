@@ -65,6 +65,13 @@ requirejs.config({
 });
 
 requirejs(['jquery', 'underscore', 'app'], function($, _, App) {
+  // If the session expires, the server answers requests with a 401,
+  // so we send the user back to the login page
+  $(document).ajaxError(function(event, jqxhr) {
+    if (jqxhr.status === 401) {
+      window.location.href = '/';
+    }
+  });
   setInterval(_.bind(App.poller, App), 1000);
   App.initialize();
 });
@@ -0,0 +1,67 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+ */
+
+/*
+ * Defines Backgrid cells for the metadata the indexer records about
+ * each movie: its size, modification time and type.
+ * exports: MovieMeta
+ */
+
+define(['jquery', 'underscore', 'backgrid'], function($, _, Backgrid) {
+  var units = ['B', 'KB', 'MB', 'GB', 'TB'];
+
+  // Formats a number of bytes in the largest unit it's at least one
+  // of, like 1.4 GB
+  var formatSize = function(bytes) {
+    var unit = 0;
+    while (bytes >= 1024 && unit < units.length - 1) {
+      bytes /= 1024;
+      unit++;
+    }
+    return (unit === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[unit];
+  };
+
+  var MetaCell = Backgrid.Cell.extend({
+    render: function () {
+      this.$el.empty();
+      this.$el.text(this.format(this.model));
+      this.delegateEvents();
+      return this;
+    }
+  });
+
+  var MovieMeta = {
+    SizeCell: MetaCell.extend({
+      className: 'integer-cell',
+      format: function(model) {
+        return formatSize(model.get('size'));
+      }
+    }),
+
+    MtimeCell: MetaCell.extend({
+      format: function(model) {
+        return new Date(model.get('mtime')).toLocaleString();
+      }
+    }),
+
+    TypeCell: MetaCell.extend({
+      format: function(model) {
+        return model.get('is_dir') ? 'Directory' : model.get('mime');
+      }
+    })
+  };
+
+  return MovieMeta;
+});
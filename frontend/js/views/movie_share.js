@@ -0,0 +1,55 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+ */
+
+/*
+ * Defines a Backgrid cell with a button that creates a share link for
+ * the row's movie and shows it, so it can be copied and sent to
+ * someone without an account.
+ * exports: MovieShare
+ */
+
+define(['jquery', 'underscore', 'backgrid'], function($, _, Backgrid) {
+  var MovieShare = function(tableName) {
+    return Backgrid.Cell.extend({
+      events: {
+        'click a': 'share'
+      },
+
+      render: function () {
+        this.$el.empty();
+        this.$el.append($("<a>", {
+          tabIndex: -1,
+          href: "#",
+          title: "Create a share link"
+        }).text("Share"));
+        this.delegateEvents();
+        return this;
+      },
+
+      share: function(e) {
+        e.preventDefault();
+        $.post('share/', { library: tableName, name: this.model.get("name") })
+          .done(function(data) {
+            window.prompt("Share link, valid until " + new Date(data.expires * 1000).toLocaleString() + ":", data.url);
+          })
+          .fail(function(xhr) {
+            window.alert(xhr.responseText);
+          });
+      }
+    });
+  };
+
+  return MovieShare;
+});
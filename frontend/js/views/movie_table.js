@@ -19,8 +19,8 @@ specific language governing permissions and limitations under the License.
  * exports: MovieTableView
  */
 
-define(['jquery', 'underscore', 'backbone', 'collections/movie_pageable', 'backgrid', 'views/movie_uri', 'backgrid_paginator', 'backgrid_filter'],
-       function($, _, Backbone, PageableMovieCollection, Backgrid, MovieUri) {
+define(['jquery', 'underscore', 'backbone', 'collections/movie_pageable', 'backgrid', 'views/movie_uri', 'views/movie_share', 'views/movie_meta', 'backgrid_paginator', 'backgrid_filter'],
+       function($, _, Backbone, PageableMovieCollection, Backgrid, MovieUri, MovieShare, MovieMeta) {
          var MovieTableView = Backbone.View.extend({
 
            templates: {
@@ -35,11 +35,37 @@ define(['jquery', 'underscore', 'backbone', 'collections/movie_pageable', 'backg
                  editable: false,
                  cell: MovieUri(tableName)
                },
+               {
+                 name: "size",
+                 label: "Size",
+                 editable: false,
+                 cell: MovieMeta.SizeCell
+               },
+               {
+                 name: "mtime",
+                 label: "Modified",
+                 editable: false,
+                 cell: MovieMeta.MtimeCell
+               },
+               {
+                 name: "mime",
+                 label: "Type",
+                 editable: false,
+                 sortable: false,
+                 cell: MovieMeta.TypeCell
+               },
                {
                  name: "downloads",
                  label: "Downloads",
                  editable: false,
                  cell: "integer"
+               },
+               {
+                 name: "share",
+                 label: "",
+                 editable: false,
+                 sortable: false,
+                 cell: MovieShare(tableName)
                }
              ];
            },
@@ -34,12 +34,18 @@ import (
 )
 
 const (
-	mainURL        = "/main/"
-	tableURL       = mainURL + "table/"
-	movieURL       = mainURL + "movie/"
-	tableKeysURL   = mainURL + "tableKeys/"
-	loginURL       = "/"
-	checkAccessURL = "/checkAccess/"
+	mainURL           = "/main/"
+	tableURL          = mainURL + "table/"
+	movieURL          = mainURL + "movie/"
+	tableKeysURL      = mainURL + "tableKeys/"
+	sessionsURL       = mainURL + "sessions/"
+	revokeSessionURL  = sessionsURL + "revoke/"
+	shareURL          = mainURL + "share/"
+	adminDownloadsURL = mainURL + "admin/downloads/"
+	topURL            = mainURL + "top/"
+	loginURL          = "/"
+	checkAccessURL    = "/checkAccess/"
+	logoutURL         = "/logout/"
 )
 
 // Launches the login template when the user opens up http://[ip]:[port]/
@@ -51,22 +57,114 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Makes sure client has valid username and password submitted
-// on the login page. If not, an error message will be returned.
+// on the login page, checking the password against its hash in the
+// users table. If so, it starts a session and redirects to the main
+// page. If not, an error message will be returned. Failed logins are
+// throttled by attemptLogin.
 func checkAccessHandler(w http.ResponseWriter, r *http.Request) {
 	user, password := r.FormValue("username"), r.FormValue("password")
-	row := dbHandle.QueryRow(sqlStatements["getUserAndPassword"], user, password)
-	var throwaway string
-	if err := row.Scan(&throwaway); err != nil {
+	result, wait, err := attemptLogin(r, user, password)
+	if err != nil {
 		glog.Error(err)
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return
+	}
+	switch result {
+	case loginFailed:
 		http.Error(w, "Invalid username or password", http.StatusForbidden)
 		return
+	case loginLocked:
+		http.Error(w, "This account is locked", http.StatusForbidden)
+		return
+	case loginThrottled:
+		throttledError(w, wait)
+		return
+	}
+	if err := startSession(w, r, user); err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
 	}
 	http.Redirect(w, r, mainURL, http.StatusFound)
 }
 
+// Revokes the current session, clears the session cookie, and
+// redirects to the login page
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if sessionID := requestSession(r); sessionID != "" {
+		if _, err := dbStore.DeleteSession(sessionID, requestUser(r)); err != nil {
+			glog.Error(err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+	clearSessionCookie(w)
+	http.Redirect(w, r, loginURL, http.StatusFound)
+}
+
+// A row of the sessions table, as shown on the sessions page
+type sessionRow struct {
+	ID        string
+	User      string
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+	// Whether this is the session making the request
+	Current bool
+}
+
+// Lists the user's active sessions, each with a button that revokes
+// it
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := dbStore.Sessions(requestUser(r))
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == requestSession(r)
+	}
+
+	data := map[string]interface{}{
+		"User":      requestUser(r),
+		"Sessions":  sessions,
+		"RevokeURL": revokeSessionURL,
+		"LogoutURL": logoutURL,
+		"MainURL":   mainURL,
+	}
+	if err := runTemplate("sessions", w, data); err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to fetch sessions page", http.StatusInternalServerError)
+	}
+}
+
+// Revokes one of the user's sessions, named by the id form value,
+// and redirects back to the sessions page. The revoked session is
+// rejected on its next request.
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sessions can only be revoked with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	ok, err := dbStore.DeleteSession(r.FormValue("id"), requestUser(r))
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, sessionsURL, http.StatusFound)
+}
+
 type movieRow struct {
 	Name      string `json:"name"`
 	Downloads uint64 `json:"downloads"`
+	movieMeta
 }
 
 // If the URL is empty (just mainURL), then it serves the index
@@ -79,10 +177,17 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Returns a json array of the moviePaths keys
+// Returns a json array of the moviePaths keys that the user can
+// access
 func tableKeysHandler(w http.ResponseWriter, r *http.Request) {
-	jsonResponse := make([]interface{}, 0, len(moviePaths))
-	for k, _ := range moviePaths {
+	allowed, err := allowedLibraries(requestUser(r))
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to fetch table keys", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse := make([]interface{}, 0, len(allowed))
+	for k, _ := range allowed {
 		jsonResponse = append(jsonResponse, k)
 	}
 
@@ -118,17 +223,11 @@ func convertFilterString(filterString []byte) (result []byte) {
 	return
 }
 
-type paramPair struct {
-	str  string
-	args []interface{}
-}
-
-// Looking at the form values in a request, it returns a map of SQL
-// clauses to a pair of the string of the clause and its query params.
-// So far it checks for q (a filter string), page and per_page
-// (paging info), and sort_by and order (sorting)
-func addQueryParams(r *http.Request, moviePath string) (map[string]paramPair, error) {
-	paramMap := make(map[string]paramPair)
+// Builds a query of the movies in moviePath from the form values in a
+// request. So far it checks for q (a filter string), page and
+// per_page (paging info), and sort_by and order (sorting)
+func parseMovieQuery(r *http.Request, moviePath string) (movieQuery, error) {
+	q := movieQuery{Path: moviePath}
 	queryParams := r.URL.Query()
 	// We implement searching via LIKE. REGEXP is too slow, since
 	// it can't use an index. Since the filter uses wildcard
@@ -136,41 +235,46 @@ func addQueryParams(r *http.Request, moviePath string) (map[string]paramPair, er
 	// treat it as a prefix search, so we append a % to the string
 	// always
 	if filterString := queryParams.Get("q"); filterString != "" {
-		fixedString := string(convertFilterString([]byte(filterString))) + "%"
-		paramMap["where"] = paramPair{" path = ? AND name LIKE ?",
-			[]interface{}{moviePath, fixedString}}
-	} else {
-		paramMap["where"] = paramPair{" path = ?", []interface{}{moviePath}}
+		q.Pattern = string(convertFilterString([]byte(filterString))) + "%"
 	}
 
-	if sort_col, order := queryParams.Get("sort_by"), queryParams.Get("order"); len(sort_col+order) > 0 {
-		paramMap["order"] = paramPair{str: fmt.Sprintf(" ORDER BY `%s` %s", sort_col, order)}
-	} else {
-		paramMap["order"] = paramPair{}
+	// Only known columns can be sorted by, since the column name
+	// ends up in the query
+	if sort_col := queryParams.Get("sort_by"); sort_col != "" {
+		if !sortableMovieColumns[sort_col] {
+			return q, fmt.Errorf("Cannot sort by %s", sort_col)
+		}
+		q.SortBy = sort_col
+	}
+	switch order := strings.ToLower(queryParams.Get("order")); order {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, fmt.Errorf("Invalid order: %s", order)
 	}
 
 	if page, per_page := queryParams.Get("page"), queryParams.Get("per_page"); len(page+per_page) > 0 {
 		page_num, err := strconv.ParseUint(page, 10, 64)
-		if err != nil {
-			return nil, err
+		if err != nil || page_num == 0 {
+			return q, fmt.Errorf("Invalid page: %s", page)
 		}
 		per_page_num, err := strconv.ParseUint(per_page, 10, 64)
-		if err != nil {
-			return nil, err
+		if err != nil || per_page_num == 0 {
+			return q, fmt.Errorf("Invalid per_page: %s", per_page)
 		}
-		paramMap["limit"] = paramPair{" LIMIT ?, ?",
-			[]interface{}{(page_num - 1) * per_page_num, per_page_num}}
-	} else {
-		paramMap["limit"] = paramPair{}
+		q.Offset, q.Limit = (page_num-1)*per_page_num, per_page_num
 	}
 
-	return paramMap, nil
+	return q, nil
 }
 
-// Serves the movies and downloads of the requested table from the
-// movie table as a JSON object. It returns pagination settings for
-// the client side paginator object in the JSON as well. The first
-// segment in the url is the key of the movie path.
+// Serves the movies of the requested table from the movie table, with
+// their downloads, sizes, modification times and types, as a JSON
+// object. It returns pagination settings for the client side
+// paginator object in the JSON as well. The first segment in the url
+// is the key of the movie path, which the user must be allowed to
+// access.
 func tableHandler(w http.ResponseWriter, r *http.Request) {
 	httpError := func(err error, code int) {
 		glog.Errorf("Error in table handler: %s", err)
@@ -184,77 +288,37 @@ func tableHandler(w http.ResponseWriter, r *http.Request) {
 		httpError(fmt.Errorf("Invalid key name: %s", moviePathKey), http.StatusBadRequest)
 		return
 	}
-	// Get any additional query params as a query string
-	paramMap, err := addQueryParams(r, moviePath)
-	if err != nil {
+	if ok, err := canAccessLibrary(requestUser(r), moviePathKey); err != nil {
 		httpError(err, http.StatusInternalServerError)
 		return
+	} else if !ok {
+		httpError(fmt.Errorf("%s cannot access %s", requestUser(r), moviePathKey), http.StatusForbidden)
+		return
 	}
-
-	// Performs the select queries under a repeatable-read
-	// transaction, so their results remain consistent
-	trans, err := dbHandle.Begin()
+	// Get any additional query params as a movie query
+	q, err := parseMovieQuery(r, moviePath)
 	if err != nil {
-		httpError(err, http.StatusInternalServerError)
+		httpError(err, http.StatusBadRequest)
 		return
 	}
 
-	// We need to first get the number of entries the query will
-	// return. Sometimes, if the number of file entries decreased
-	// since the client accessed a page, they could be accessing
-	// an invalid page, so if that's the case, we change the page
-	// in paginationState to 1 and use a limit offset of 0
-	var total_entries uint64
-
-	countRow := trans.QueryRow(fmt.Sprintf(sqlStatements["getMovieNum"], paramMap["where"].str), paramMap["where"].args...)
-	if err := countRow.Scan(&total_entries); err != nil {
+	total_entries, movies, err := dbStore.Movies(q)
+	if err != nil {
 		httpError(err, http.StatusInternalServerError)
 		return
 	}
 	paginationState := map[string]interface{}{
 		"total_entries": total_entries,
 	}
-	// If there's a limit clause that's out of bounds, make the
-	// offset 0 and adjust the paginationState accordingly
-	if pp := paramMap["limit"]; len(pp.args) == 2 {
-		offset, limit := pp.args[0].(uint64), pp.args[1].(uint64)
-		if offset >= total_entries {
-			// We're out of bounds, change args[0]
-			// (offset) to 0, and paginationState["page"]
-			// to 1. We also need explicitly set per_page,
-			// because otherwise backbone-paginator will
-			// reset it incorrectly
-			pp.args[0] = 0
-			paginationState["page"] = 1
-			paginationState["per_page"] = limit
-		}
-	}
-
-	rows, err := trans.Query(
-		fmt.Sprintf(sqlStatements["getMovies"], paramMap["where"].str, paramMap["order"].str, paramMap["limit"].str),
-		append(paramMap["where"].args, append(paramMap["order"].args, paramMap["limit"].args...)...)...)
-	if err != nil {
-		httpError(err, http.StatusInternalServerError)
-		return
-	}
-
-	movies := make([]interface{}, 0)
-	for rows.Next() {
-		var r movieRow
-		if err = rows.Scan(&r.Name, &r.Downloads); err != nil {
-			httpError(err, http.StatusInternalServerError)
-			return
-		}
-		movies = append(movies, r)
-	}
-	if err = rows.Err(); err != nil {
-		httpError(err, http.StatusInternalServerError)
-		return
-	}
-
-	if err := trans.Commit(); err != nil {
-		httpError(err, http.StatusInternalServerError)
-		return
+	// Sometimes, if the number of file entries decreased since
+	// the client accessed a page, they could be accessing an
+	// invalid page, in which case the store returned the first
+	// page. We change the page in paginationState to 1 to match.
+	// We also need explicitly set per_page, because otherwise
+	// backbone-paginator will reset it incorrectly
+	if q.Limit > 0 && q.Offset >= total_entries {
+		paginationState["page"] = 1
+		paginationState["per_page"] = q.Limit
 	}
 
 	// Marshalls the json response, which is an array describing
@@ -270,43 +334,78 @@ func tableHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, string(jsonData))
 }
 
+// Splits the path of a movieURL request into the movie path key,
+// which is the first segment after movieURL, and the cleaned name of
+// the file, which is everything after that
+func splitMovieURL(urlPath string) (moviePathKey, filename string) {
+	rest := urlPath[len(movieURL):]
+	slashIndex := strings.Index(rest, "/")
+	if slashIndex == -1 {
+		// The movie path key must be the last segment in the
+		// URL, and there's no trailing slash. Assumes the
+		// filename will be the directory named by moviePath
+		// itself
+		return rest, filepath.Clean("")
+	}
+	return rest[:slashIndex], filepath.Clean(rest[slashIndex+1:])
+}
+
 // Serves the movie identified by the given pathname, incrementing the
-// download count. The keyname of the path should be be the first
-// segment in the url, and the path of the file should be everything
-// after that. If it's a directory, we create a tar, skipping all the
-// dotfiles, and return that
+// download count and recording the request in the download audit
+// log. The keyname of the path should be be the first segment in the
+// url, and the path of the file should be everything after that. If
+// it's a directory, we create a tar, skipping all the dotfiles, and
+// return that. Paths through symlinks are only served if the
+// library's rules follow them, and files the rules or ignore files
+// skip aren't served at all. The user must be allowed to access the movie path key.
 func movieHandler(w http.ResponseWriter, r *http.Request) {
+	moviePathKey, filename := splitMovieURL(r.URL.Path)
+	// Records the request in the download audit log once it's
+	// done, whether or not it succeeds
+	recorder := newDownloadRecorder(w, r, moviePathKey, filename)
+	defer recorder.record()
+	w = recorder
+
 	httpError := func(err error, code int) {
 		glog.Errorf("Error in movie handler: %s", err)
 		http.Error(w, fmt.Sprintf("Could not serve request %s", r.URL.Path), code)
 	}
 
-	rest := r.URL.Path[len(movieURL):]
-	var moviePathKey, filename string
-	if slashIndex := strings.Index(rest, "/"); slashIndex == -1 {
-		// The movie path key must be the last segment in the
-		// URL, and there's no trailing slash. Assumes the
-		// filename will be the directory named by moviePath
-		// itself
-		moviePathKey = rest
-		filename = filepath.Clean("")
-	} else {
-		moviePathKey = rest[:slashIndex]
-		filename = filepath.Clean(rest[len(moviePathKey)+1:])
-	}
 	moviePath, ok := moviePaths[moviePathKey]
 	if !ok {
 		httpError(fmt.Errorf("Could not find movie path key: %s", moviePathKey), http.StatusBadRequest)
 		return
 	}
+	if ok, err := canAccessLibrary(requestUser(r), moviePathKey); err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	} else if !ok {
+		httpError(fmt.Errorf("%s cannot access %s", requestUser(r), moviePathKey), http.StatusForbidden)
+		return
+	}
 	filelocation := filepath.Join(moviePath, filename)
 	glog.V(vLevel).Infof("Fetching file: %s", filelocation)
+	// Symlinks the library doesn't follow aren't served either
+	if err := rulesForPath(moviePath).checkLinks(moviePath, filelocation); err != nil {
+		httpError(err, http.StatusNotFound)
+		return
+	}
+	// Neither are the files the library's rules or ignore files skip
+	if !reachable(moviePath, filelocation, libraryFilter(moviePath)) {
+		httpError(fmt.Errorf("The rules or ignore files of %s skip %s", moviePath, filelocation), http.StatusNotFound)
+		return
+	}
 
 	fi, err := os.Stat(filelocation)
 	if err != nil {
 		httpError(err, http.StatusNotFound)
 		return
 	}
+	// A share link only loses a download once there's something to
+	// serve
+	if !countShareDownload(w, r) {
+		return
+	}
 	var (
 		rs        io.ReadSeeker
 		servename string
@@ -329,7 +428,7 @@ func movieHandler(w http.ResponseWriter, r *http.Request) {
 		// Given this range, this function has a 1/58^64
 		// chance of producing duplicate file strings and thus
 		// failing
-		servefilename := "." + string(bytes.Map(func(r rune) rune {return r % (123-65) + 65}, randbuf))
+		servefilename := "." + string(bytes.Map(func(r rune) rune { return r%(123-65) + 65 }, randbuf))
 		servefile, err := os.Create(servefilename)
 		if err != nil {
 			httpError(err, http.StatusInternalServerError)
@@ -337,7 +436,7 @@ func movieHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer os.Remove(servefilename)
 		tw := tar.NewWriter(servefile)
-		if err := tarDir(filepath.Join(moviePath, filename), tw); err != nil {
+		if err := tarDir(moviePath, filepath.Join(moviePath, filename), tw); err != nil {
 			httpError(err, http.StatusInternalServerError)
 			return
 		}
@@ -357,32 +456,48 @@ func movieHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	http.ServeContent(w, r, servename, time.Time{}, rs)
-	glog.V(vLevel).Infof("Served file: %s", filelocation)
+	glog.V(vLevel).Infof("Served file: %s to %s", filelocation, requestUser(r))
 
-	// Updates the download count, if no rows were affected, it
-	// should have thrown the "could not serve file" error, so it
-	// panics here
-	res, err := dbHandle.Exec(sqlStatements["addDownload"], moviePath, filename)
+	// Updates the download count. A file that was just added may
+	// not be indexed yet, so no rows changing is only logged.
+	ok, err = dbStore.AddDownload(moviePath, filename, time.Now())
 	if err != nil {
 		glog.Errorf("Error updating download count for %s: %s", filename, err)
 		return
 	}
-	rowcount, err := res.RowsAffected()
-	if err != nil {
-		glog.Error("Error retrieving rows affected for addDownload query")
-		return
-	}
-	if rowcount == 0 {
-		panic("Update changed 0 rows, so it should have thrown an error above")
+	if !ok {
+		glog.Errorf("Could not count the download of %s, which isn't indexed", filelocation)
 	}
 }
 
+// Installs every handler behind authHandler. Browsers opening the
+// main page without a session are sent to the login page, while the
+// json and download handlers just return a 401. The json and
+// download handlers also accept API tokens, and the table and movie
+// handlers accept Basic credentials if the basic-auth flag is set.
+// The movie handler also serves share links without a session.
 func setupHandlers() error {
-	http.HandleFunc(mainURL, mainHandler)
-	http.HandleFunc(tableURL, tableHandler)
-	http.HandleFunc(movieURL, movieHandler)
-	http.HandleFunc(tableKeysURL, tableKeysHandler)
-	http.HandleFunc(loginURL, loginHandler)
-	http.HandleFunc(checkAccessURL, checkAccessHandler)
+	var (
+		page     = authOptions{anonymous: redirectAnonymous}
+		action   = authOptions{anonymous: rejectAnonymous}
+		public   = authOptions{anonymous: allowAnonymous}
+		listing  = authOptions{anonymous: rejectAnonymous, tokenScope: scopeList}
+		table    = authOptions{anonymous: rejectAnonymous, tokenScope: scopeList, basic: true}
+		download = authOptions{anonymous: rejectAnonymous, tokenScope: scopeDownload, basic: true, share: true}
+		sharing  = authOptions{anonymous: rejectAnonymous, tokenScope: scopeDownload}
+		admin    = authOptions{anonymous: rejectAnonymous, basic: true}
+	)
+	http.HandleFunc(mainURL, authHandler(page, mainHandler))
+	http.HandleFunc(tableURL, authHandler(table, tableHandler))
+	http.HandleFunc(movieURL, authHandler(download, movieHandler))
+	http.HandleFunc(tableKeysURL, authHandler(listing, tableKeysHandler))
+	http.HandleFunc(sessionsURL, authHandler(page, sessionsHandler))
+	http.HandleFunc(revokeSessionURL, authHandler(action, revokeSessionHandler))
+	http.HandleFunc(shareURL, authHandler(sharing, shareHandler))
+	http.HandleFunc(adminDownloadsURL, authHandler(admin, adminDownloadsHandler))
+	http.HandleFunc(topURL, authHandler(listing, topHandler))
+	http.HandleFunc(loginURL, authHandler(public, loginHandler))
+	http.HandleFunc(checkAccessURL, authHandler(public, checkAccessHandler))
+	http.HandleFunc(logoutURL, authHandler(public, logoutHandler))
 	return nil
 }
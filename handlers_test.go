@@ -0,0 +1,345 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of the table and movie handlers, run against the memory
+// backend
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sets up a memory store and a library named "a" holding the given
+// files, indexed by the movie indexer
+func setupTestLibrary(t *testing.T, files map[string]string) {
+	s, err := openMemoryStore("")
+	check(t, err)
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		check(t, os.MkdirAll(filepath.Dir(path), 0755))
+		check(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+	oldStore, oldPaths := dbStore, moviePaths
+	dbStore, moviePaths = s, moviePathMap{"a": dir}
+	t.Cleanup(func() { dbStore, moviePaths = oldStore, oldPaths })
+	check(t, bootstrapIndexMovies("Test Indexer"))
+	check(t, indexMovies("Test Indexer"))
+}
+
+// Runs a handler on a GET of the url, as if authHandler had
+// authenticated the user
+func serveAs(handler http.HandlerFunc, user, url string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// Fetches a table and decodes the pagination state and movies
+func fetchTable(t *testing.T, user, url string) (map[string]interface{}, []movieRow) {
+	t.Helper()
+	w := serveAs(tableHandler, user, url)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: got status %d: %s", url, w.Code, w.Body)
+	}
+	var response []json.RawMessage
+	check(t, json.Unmarshal(w.Body.Bytes(), &response))
+	if len(response) != 2 {
+		t.Fatalf("GET %s: got %s, want a pagination state and movies", url, w.Body)
+	}
+	var (
+		state  map[string]interface{}
+		movies []movieRow
+	)
+	check(t, json.Unmarshal(response[0], &state))
+	check(t, json.Unmarshal(response[1], &movies))
+	return state, movies
+}
+
+// Returns the names and downloads of movies, without their metadata
+func movieCounts(movies []movieRow) []movieRow {
+	counts := make([]movieRow, len(movies))
+	for i, m := range movies {
+		counts[i] = movieRow{Name: m.Name, Downloads: m.Downloads}
+	}
+	return counts
+}
+
+func TestTableHandler(t *testing.T) {
+	setupTestLibrary(t, map[string]string{
+		"Alien.mkv":        "alien",
+		"Aliens.mkv":       "aliens",
+		"Brazil/disc1.mkv": "brazil",
+		".hidden":          "hidden",
+	})
+	for i := 0; i < 3; i++ {
+		_, err := dbStore.AddDownload(moviePaths["a"], "Brazil", time.Now())
+		check(t, err)
+	}
+
+	state, movies := fetchTable(t, "bob", tableURL+"a?sort_by=name")
+	// The library itself is indexed as ".", so that it can be
+	// downloaded whole
+	expect(t, "total", state["total_entries"], float64(5))
+	expect(t, "names", movieNames(movies), []string{".", "Alien.mkv", "Aliens.mkv", "Brazil", "Brazil/disc1.mkv"})
+
+	_, movies = fetchTable(t, "bob", tableURL+"a?sort_by=downloads&order=desc&page=1&per_page=1")
+	expect(t, "most downloaded", movieCounts(movies), []movieRow{{Name: "Brazil", Downloads: 3}})
+
+	// Directories are as big as the files in them
+	_, movies = fetchTable(t, "bob", tableURL+"a?sort_by=size&order=desc&page=1&per_page=1")
+	expect(t, "largest", movies, []movieRow{{".", 0, movieMeta{17, movies[0].Mtime, true, directoryMIME}}})
+	info, err := os.Stat(filepath.Join(moviePaths["a"], "Brazil"))
+	check(t, err)
+	dirMtime := info.ModTime().UTC().Truncate(time.Second)
+	info, err = os.Stat(filepath.Join(moviePaths["a"], "Brazil", "disc1.mkv"))
+	check(t, err)
+	fileMtime := info.ModTime().UTC().Truncate(time.Second)
+	_, movies = fetchTable(t, "bob", tableURL+"a?q=brazil&sort_by=name")
+	expect(t, "metadata", movies, []movieRow{
+		{"Brazil", 3, movieMeta{6, dirMtime, true, directoryMIME}},
+		{"Brazil/disc1.mkv", 0, movieMeta{6, fileMtime, false, "video/x-matroska"}},
+	})
+
+	state, movies = fetchTable(t, "bob", tableURL+"a?q=alien*&sort_by=name")
+	expect(t, "filtered total", state["total_entries"], float64(2))
+	expect(t, "filtered names", movieNames(movies), []string{"Alien.mkv", "Aliens.mkv"})
+
+	_, movies = fetchTable(t, "bob", tableURL+"a?q=?lien.mkv")
+	expect(t, "wildcard names", movieNames(movies), []string{"Alien.mkv"})
+
+	state, movies = fetchTable(t, "bob", tableURL+"a?sort_by=name&page=2&per_page=3")
+	expect(t, "second page", movieNames(movies), []string{"Brazil", "Brazil/disc1.mkv"})
+	if _, ok := state["page"]; ok {
+		t.Errorf("Valid page was reset: %v", state)
+	}
+
+	// A page past the end gets the first page
+	state, movies = fetchTable(t, "bob", tableURL+"a?sort_by=name&page=5&per_page=3")
+	expect(t, "reset page", state["page"], float64(1))
+	expect(t, "reset per_page", state["per_page"], float64(3))
+	expect(t, "first page", movieNames(movies), []string{".", "Alien.mkv", "Aliens.mkv"})
+
+	for url, code := range map[string]int{
+		tableURL + "b":                  http.StatusBadRequest,
+		tableURL + "a?sort_by=bogus":    http.StatusBadRequest,
+		tableURL + "a?order=sideways":   http.StatusBadRequest,
+		tableURL + "a?page=0&per_page=": http.StatusBadRequest,
+	} {
+		if w := serveAs(tableHandler, "bob", url); w.Code != code {
+			t.Errorf("GET %s: got status %d, want %d", url, w.Code, code)
+		}
+	}
+
+	// Users granted other libraries can't see this one
+	check(t, dbStore.GrantLibrary(principalUser, "bob", "b"))
+	if w := serveAs(tableHandler, "bob", tableURL+"a"); w.Code != http.StatusForbidden {
+		t.Errorf("Table of an ungranted library: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestMovieHandler(t *testing.T) {
+	setupTestLibrary(t, map[string]string{
+		"Alien.mkv":        "alien",
+		"Brazil/disc1.mkv": "brazil",
+	})
+	path := moviePaths["a"]
+
+	w := serveAs(movieHandler, "bob", movieURL+"a/Alien.mkv")
+	expect(t, "status", w.Code, http.StatusOK)
+	expect(t, "body", w.Body.String(), "alien")
+	expect(t, "content type", w.Header().Get("Content-Type"), "binary/octet-stream")
+
+	// Ranges are served partially
+	r := httptest.NewRequest("GET", movieURL+"a/Alien.mkv", nil)
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, "bob"))
+	r.Header.Set("Range", "bytes=1-2")
+	w = httptest.NewRecorder()
+	movieHandler(w, r)
+	expect(t, "partial status", w.Code, http.StatusPartialContent)
+	expect(t, "partial body", w.Body.String(), "li")
+
+	// Directories are served as tars
+	w = serveAs(movieHandler, "bob", movieURL+"a/Brazil")
+	expect(t, "directory status", w.Code, http.StatusOK)
+	tr := tar.NewReader(w.Body)
+	hdr, err := tr.Next()
+	check(t, err)
+	expect(t, "tar entry", filepath.Base(hdr.Name), "disc1.mkv")
+	contents, err := ioutil.ReadAll(tr)
+	check(t, err)
+	expect(t, "tar contents", string(contents), "brazil")
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Directory tar has more than one file: %v", err)
+	}
+
+	w = serveAs(movieHandler, "bob", movieURL+"a/Missing.mkv")
+	expect(t, "missing movie status", w.Code, http.StatusNotFound)
+	w = serveAs(movieHandler, "bob", movieURL+"b/Alien.mkv")
+	expect(t, "missing library status", w.Code, http.StatusBadRequest)
+
+	// Every download is counted and recorded
+	_, movies, err := dbStore.Movies(movieQuery{Path: path, SortBy: "name"})
+	check(t, err)
+	expect(t, "download counts", movieCounts(movies), []movieRow{
+		{Name: ".", Downloads: 0}, {Name: "Alien.mkv", Downloads: 2},
+		{Name: "Brazil", Downloads: 1}, {Name: "Brazil/disc1.mkv", Downloads: 0},
+	})
+	total, events, err := dbStore.DownloadEvents(downloadEventQuery{User: "bob"})
+	check(t, err)
+	expect(t, "recorded downloads", total, uint64(5))
+	statuses := make([]int, len(events))
+	for i, e := range events {
+		statuses[i] = e.Status
+	}
+	expect(t, "recorded statuses", statuses, []int{400, 404, 200, 206, 200})
+	expect(t, "recorded range", events[3].Range, "bytes=1-2")
+	expect(t, "recorded bytes", events[3].Bytes, uint64(2))
+}
+
+func TestShareLinkDownloads(t *testing.T) {
+	setupTestLibrary(t, map[string]string{"Brazil/disc1.mkv": "brazil"})
+	link := shareLink{
+		Creator: "bob", Library: "a", Name: "Brazil", Expires: time.Now().Add(time.Hour),
+		MaxDownloads: sql.NullInt64{Int64: 1, Valid: true},
+	}
+	var err error
+	link.ID, err = dbStore.NewShareLink(link)
+	check(t, err)
+	path := shareURLPath(link)
+	query := path[strings.Index(path, "?"):]
+	handler := authHandler(authOptions{anonymous: rejectAnonymous, share: true}, movieHandler)
+	status := func(name string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", movieURL+"a/"+name+query, nil))
+		return w.Code
+	}
+
+	// Requests that fail don't use up the link's downloads
+	expect(t, "missing file status", status("Brazil/missing.mkv"), http.StatusNotFound)
+	expect(t, "first download status", status("Brazil/disc1.mkv"), http.StatusOK)
+	expect(t, "second download status", status("Brazil/disc1.mkv"), http.StatusGone)
+	got, _, err := dbStore.ShareLink(link.ID)
+	check(t, err)
+	expect(t, "share downloads", got.Downloads, uint64(1))
+}
+
+// A ResponseWriter that can read from a reader, like the server's
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFroms int
+}
+
+func (w *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.readFroms++
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestDownloadRecorder(t *testing.T) {
+	w := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	r := httptest.NewRequest("GET", movieURL+"a/Alien.mkv", nil)
+	d := newDownloadRecorder(w, r, "a", "Alien.mkv")
+
+	// Files are handed to the ResponseWriter's ReadFrom, and still
+	// counted
+	http.ServeContent(d, r, "Alien.mkv", time.Time{}, strings.NewReader("alien"))
+	expect(t, "ReadFrom calls", w.readFroms, 1)
+	expect(t, "body", w.Body.String(), "alien")
+	expect(t, "recorded status", d.event.Status, http.StatusOK)
+	expect(t, "recorded bytes", d.event.Bytes, uint64(len("alien")))
+
+	check(t, http.NewResponseController(d).Flush())
+	expect(t, "flushed", w.Flushed, true)
+}
+
+func TestTopHandler(t *testing.T) {
+	setupTestLibrary(t, map[string]string{
+		"Alien.mkv":  "alien",
+		"Brazil.mkv": "brazil",
+	})
+	path := moviePaths["a"]
+	now := time.Now()
+	for _, name := range []string{"Alien.mkv", "Brazil.mkv", "Brazil.mkv"} {
+		_, err := dbStore.AddDownload(path, name, now)
+		check(t, err)
+	}
+	_, err := dbStore.AddDownload(path, "Alien.mkv", now.AddDate(0, 0, -60))
+	check(t, err)
+
+	fetchTop := func(url string) (map[string]uint64, []topMovie) {
+		t.Helper()
+		w := serveAs(topHandler, "bob", url)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d: %s", url, w.Code, w.Body)
+		}
+		var response struct {
+			Libraries map[string]uint64 `json:"libraries"`
+			Movies    []topMovie        `json:"movies"`
+		}
+		check(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Libraries, response.Movies
+	}
+
+	// The last 30 days by default
+	libraries, movies := fetchTop(topURL)
+	expect(t, "libraries", libraries, map[string]uint64{"a": 3})
+	expect(t, "top movies", movies, []topMovie{{"a", "Brazil.mkv", 2}, {"a", "Alien.mkv", 1}})
+
+	since := now.AddDate(0, 0, -90).Format(dayFormat)
+	_, movies = fetchTop(topURL + "?library=a&limit=1&since=" + since)
+	expect(t, "top movie since "+since, movies, []topMovie{{"a", "Alien.mkv", 2}})
+
+	until := now.AddDate(0, 0, -30).UTC().Format(time.RFC3339)
+	libraries, movies = fetchTop(topURL + "?since=" + since + "&until=" + until)
+	expect(t, "libraries until "+until, libraries, map[string]uint64{"a": 1})
+	expect(t, "top movies until "+until, movies, []topMovie{{"a", "Alien.mkv", 1}})
+
+	for url, code := range map[string]int{
+		topURL + "?library=b":         http.StatusBadRequest,
+		topURL + "?limit=0":           http.StatusBadRequest,
+		topURL + "?limit=1000":        http.StatusBadRequest,
+		topURL + "?since=yesterday":   http.StatusBadRequest,
+		topURL + "?until=2014-13-01":  http.StatusBadRequest,
+		topURL + "?library=a&limit=5": http.StatusOK,
+	} {
+		if w := serveAs(topHandler, "bob", url); w.Code != code {
+			t.Errorf("GET %s: got status %d, want %d", url, w.Code, code)
+		}
+	}
+
+	// Users only see the libraries they can access
+	check(t, dbStore.GrantLibrary(principalUser, "bob", "b"))
+	libraries, movies = fetchTop(topURL)
+	expect(t, "inaccessible libraries", libraries, map[string]uint64{})
+	expect(t, "inaccessible movies", movies, []topMovie{})
+	if w := serveAs(topHandler, "bob", topURL+"?library=a"); w.Code != http.StatusForbidden {
+		t.Errorf("Top movies of an ungranted library: got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
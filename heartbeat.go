@@ -18,17 +18,17 @@ specific language governing permissions and limitations under the License.
 package main
 
 import (
-	"fmt"
 	"github.com/golang/glog"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	numTasks = 1
+	numTasks = 5
 )
 
 var (
@@ -36,139 +36,437 @@ var (
 	heartbeatWG sync.WaitGroup
 )
 
-// The indexer keeps a set of movies in the moviePaths directories in
-// memory, so that reindexing and adding/deleting entries from the
-// database is faster. movieMap is a map from paths to a map of names
-// to bools. It should only be accessed by the indexMovies bootstrap
-// and task functions.
-var movieMap map[string](map[string]bool)
+// The indexer keeps the movies in the moviePaths directories, their
+// metadata and fingerprints in memory, so that reindexing only has to
+// write what changed to the database. movieMap is a map from paths to
+// a map of names to movies. orphanedMovies holds the movies with
+// fingerprints in library paths that aren't served anymore, which the
+// indexer moves into the served ones if it finds them there. They
+// should only be accessed by the indexMovies bootstrap and task
+// functions.
+var (
+	movieMap       map[string](map[string]indexedMovie)
+	orphanedMovies map[movieKey]indexedMovie
+)
 
-// Initializes movieMap to the existing entries in the database
+// The watcher the indexer takes changes from, which is nil if the
+// libraries are polled, and when it last walked every library
+var (
+	movieWatcher  libraryWatcher
+	lastFullIndex time.Time
+)
+
+// Initializes movieMap and orphanedMovies to the existing entries in
+// the database
 func bootstrapIndexMovies(name string) error {
 	glog.V(vvLevel).Infof("%s: bootstrapping", name)
-	movieMap = make(map[string](map[string]bool))
+	movieMap = make(map[string](map[string]indexedMovie))
 	for _, path := range moviePaths {
-		movieMap[path] = make(map[string]bool)
+		movieMap[path] = make(map[string]indexedMovie)
 	}
 
-	moviePathStr := strings.Repeat("?, ", len(moviePaths)-1) + "?"
-	moviePathArgs := make([]interface{}, 0, len(moviePaths))
+	paths := make([]string, 0, len(moviePaths))
 	for _, v := range moviePaths {
-		moviePathArgs = append(moviePathArgs, v)
+		paths = append(paths, v)
+	}
+	movies, err := dbStore.IndexedMovies(paths)
+	if err != nil {
+		return err
+	}
+	for _, m := range movies {
+		movieMap[m.Path][m.Name] = m
 	}
-	rows, err := dbHandle.Query(
-		fmt.Sprintf("SELECT path, name FROM movies WHERE path IN (%s)", moviePathStr),
-		moviePathArgs...)
+	orphans, err := dbStore.OrphanedMovies(paths)
 	if err != nil {
 		return err
 	}
-	for rows.Next() {
-		var path, name string
-		if err := rows.Scan(&path, &name); err != nil {
+	orphanedMovies = make(map[movieKey]indexedMovie)
+	for _, m := range orphans {
+		orphanedMovies[m.movieKey] = m
+	}
+	return nil
+}
+
+// Walks a library, returning every movie in it by its path relative
+// to the library
+func scanLibrary(moviePath string, indexed map[string]indexedMovie) (map[string]indexedMovie, error) {
+	movies := make(map[string]indexedMovie)
+	if err := walkMovies(moviePath, moviePath, indexed, movies); err != nil {
+		return nil, err
+	}
+	sumDirectories(movies)
+	return movies, nil
+}
+
+// Walks root, a file or directory in the library at moviePath, adding
+// every movie in it to movies by its path relative to the library.
+// Dotfiles and symlinks are skipped. Files are only fingerprinted if
+// they aren't in indexed, the library's movies from the last walk,
+// with the same metadata and a fingerprint. Directory sizes and
+// fingerprints are left to sumDirectories.
+func walkMovies(moviePath, root string, indexed, movies map[string]indexedMovie) error {
+	fileChan := make(chan filePair)
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- walkLibrary(moviePath, root, fileChan, libraryFilter(moviePath))
+	}()
+	var files []string
+	for fp := range fileChan {
+		relpath, err := filepath.Rel(moviePath, fp.path)
+		if err != nil {
+			// Drains the walk
+			for range fileChan {
+			}
 			return err
 		}
-		movieMap[path][name] = true
+		movies[relpath] = indexedMovie{movieKey: movieKey{moviePath, relpath}, movieMeta: fileMeta(fp.fi)}
+		if !fp.fi.IsDir() {
+			files = append(files, relpath)
+		}
 	}
-	if err := rows.Err(); err != nil {
+	if err := <-walkErr; err != nil {
 		return err
 	}
+	for _, file := range files {
+		m := movies[file]
+		if old, ok := indexed[file]; ok && old.movieMeta.equal(m.movieMeta) && (old.Fingerprint != "" || m.Size == 0) {
+			m.Fingerprint = old.Fingerprint
+		} else if fingerprint, err := fileFingerprint(filepath.Join(moviePath, file), m.Size); err != nil {
+			// It is tried again on the next walk
+			glog.V(vvLevel).Infof("Could not fingerprint %s: %s", filepath.Join(moviePath, file), err)
+		} else {
+			m.Fingerprint = fingerprint
+		}
+		movies[file] = m
+	}
 	return nil
 }
 
-// Reindexes the movies directory, deleting any movie in movieMap that
-// wasn't encountered, and adding any new movies.
-func indexMovies(name string) error {
-	trans, err := dbHandle.Begin()
-	if err != nil {
-		return err
+// Sets the size of every directory in a library's movies to the total
+// size of the files under it, and its fingerprint to one of theirs
+func sumDirectories(movies map[string]indexedMovie) {
+	fileFingerprints := make(map[string]string)
+	for relpath, m := range movies {
+		if m.IsDir {
+			m.Size, m.Fingerprint = 0, ""
+			movies[relpath] = m
+		} else {
+			fileFingerprints[relpath] = m.Fingerprint
+		}
 	}
-	// Double-buffers the movieMap, so that if the transaction
-	// rolls back, the movieMap isn't modified.
-	innerMovieMap := make(map[string](map[string]bool))
-	for _, path := range moviePaths {
-		innerMovieMap[path] = make(map[string]bool)
+	for file := range fileFingerprints {
+		size := movies[file].Size
+		for dir := file; dir != "."; {
+			dir = filepath.Dir(dir)
+			if meta, ok := movies[dir]; ok {
+				meta.Size += size
+				movies[dir] = meta
+			}
+		}
 	}
-	// When copying the data over to innerMovieMap, we set all the
-	// movies in the current list to false, to indicate that they
-	// are to be deleted. We set all the movies we encounter in
-	// the indexing to true (if it's a new movie, we add it to the
-	// database with an insert query). The remaining movies that
-	// are false are deleted from the map and from the database
-	for path, nameMap := range movieMap {
-		for name, _ := range nameMap {
-			innerMovieMap[path][name] = false
+	for dir, fingerprint := range dirFingerprints(fileFingerprints) {
+		if meta, ok := movies[dir]; ok {
+			meta.Fingerprint = fingerprint
+			movies[dir] = meta
 		}
 	}
+}
+
+// Sorts movies by path and name
+func sortMovies(movies []indexedMovie) {
+	sort.Slice(movies, func(i, j int) bool {
+		if movies[i].Path != movies[j].Path {
+			return movies[i].Path < movies[j].Path
+		}
+		return movies[i].Name < movies[j].Name
+	})
+}
+
+// Pairs up added movies with removed or orphaned movies that have the
+// same fingerprint, which must have been renamed or moved. When there
+// is more than one candidate, one with the same base name wins.
+// Returns the movies that are still added, the moves, and the keys of
+// the movies that are still removed.
+func findMoves(added, removed []indexedMovie) ([]indexedMovie, []movedMovie, []movieKey) {
+	candidates := make([]indexedMovie, 0, len(removed)+len(orphanedMovies))
+	candidates = append(candidates, removed...)
+	for _, m := range orphanedMovies {
+		candidates = append(candidates, m)
+	}
+	sortMovies(candidates)
+	byFingerprint := make(map[string][]movieKey)
+	for _, m := range candidates {
+		if m.Fingerprint != "" {
+			byFingerprint[m.Fingerprint] = append(byFingerprint[m.Fingerprint], m.movieKey)
+		}
+	}
+
+	sortMovies(added)
+	var (
+		stillAdded []indexedMovie
+		moved      []movedMovie
+		movedFrom  = make(map[movieKey]bool)
+	)
+	for _, m := range added {
+		keys := byFingerprint[m.Fingerprint]
+		if m.Fingerprint == "" || len(keys) == 0 {
+			stillAdded = append(stillAdded, m)
+			continue
+		}
+		match := 0
+		for i, key := range keys {
+			if filepath.Base(key.Name) == filepath.Base(m.Name) {
+				match = i
+				break
+			}
+		}
+		moved = append(moved, movedMovie{keys[match], m})
+		movedFrom[keys[match]] = true
+		byFingerprint[m.Fingerprint] = append(keys[:match:match], keys[match+1:]...)
+	}
+	var stillRemoved []movieKey
+	for _, m := range removed {
+		if !movedFrom[m.movieKey] {
+			stillRemoved = append(stillRemoved, m.movieKey)
+		}
+	}
+	return stillAdded, moved, stillRemoved
+}
+
+// Reindexes the movies directory by walking every library, all at
+// once. See applyIndex.
+func indexMovies(name string) error {
+	type scan struct {
+		moviePath string
+		movies    map[string]indexedMovie
+		err       error
+	}
+	scans := make(chan scan, len(moviePaths))
 	for _, moviePath := range moviePaths {
 		glog.V(vvLevel).Infof("%s: indexing %s", name, moviePath)
-		fileChan := make(chan filePair)
-		go walkDir(moviePath, fileChan, func(fp filePair) bool {
-			if (fp.path != moviePath && filepath.Base(fp.path)[0] == '.') ||
-				fp.fi.Mode()&os.ModeSymlink > 0 {
-				return false
-			}
-			return true
-		})
-		for fp := range fileChan {
-			relpath, err := filepath.Rel(moviePath, fp.path)
+		go func(moviePath string, indexed map[string]indexedMovie) {
+			movies, err := scanLibrary(moviePath, indexed)
+			scans <- scan{moviePath, movies, err}
+		}(moviePath, movieMap[moviePath])
+	}
+	libraries := make(map[string](map[string]indexedMovie))
+	var err error
+	for range moviePaths {
+		s := <-scans
+		if s.err != nil && err == nil {
+			err = s.err
+		}
+		libraries[s.moviePath] = s.movies
+	}
+	if err != nil {
+		return err
+	}
+	if err := applyIndex(name, libraries); err != nil {
+		return err
+	}
+	lastFullIndex = time.Now()
+	return nil
+}
+
+// Reindexes the paths the watcher saw change, by walking just them.
+// changes maps library paths to paths relative to them, as returned
+// by libraryWatcher.Changes.
+func indexChanges(name string, changes map[string]map[string]bool) error {
+	libraries := make(map[string](map[string]indexedMovie))
+	for _, moviePath := range moviePaths {
+		relpaths := changes[moviePath]
+		if len(relpaths) == 0 {
+			continue
+		}
+		glog.V(vvLevel).Infof("%s: indexing %d changes in %s", name, len(relpaths), moviePath)
+		if relpaths["."] {
+			movies, err := scanLibrary(moviePath, movieMap[moviePath])
 			if err != nil {
-				trans.Rollback()
 				return err
 			}
-			_, ok := innerMovieMap[moviePath][relpath]
-			if !ok {
-				// Inserts the movie into the db,
-				// since it wasn't in movieMap
-				// originally
-				if _, err := trans.Exec(sqlStatements["newMovie"], moviePath, relpath); err != nil {
-					trans.Rollback()
-					return err
+			libraries[moviePath] = movies
+			continue
+		}
+		// Copies the library, so that if the update fails, movieMap
+		// isn't modified
+		movies := make(map[string]indexedMovie, len(movieMap[moviePath]))
+		for relpath, m := range movieMap[moviePath] {
+			movies[relpath] = m
+		}
+		// A changed path may have been deleted or replaced, so
+		// everything under it is forgotten and walked again
+		for changed := range relpaths {
+			prefix := changed + string(filepath.Separator)
+			for relpath := range movies {
+				if relpath == changed || strings.HasPrefix(relpath, prefix) {
+					delete(movies, relpath)
 				}
 			}
-			innerMovieMap[moviePath][relpath] = true
 		}
+		for changed := range relpaths {
+			parent := filepath.Dir(changed)
+			if _, ok := movies[parent]; !ok {
+				// Its parent is gone too, or it was never indexed
+				continue
+			}
+			err := walkMovies(moviePath, filepath.Join(moviePath, changed), movieMap[moviePath], movies)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			// Creating, deleting or renaming something changes
+			// the modification time of its directory
+			if fi, err := os.Lstat(filepath.Join(moviePath, parent)); err == nil {
+				meta := movies[parent]
+				meta.Mtime = fileMeta(fi).Mtime
+				movies[parent] = meta
+			}
+		}
+		sumDirectories(movies)
+		libraries[moviePath] = movies
 	}
-	// Deletes all movies in innerMovieMap that are false
-	for path, innerNameMap := range innerMovieMap {
-		for name, ok := range innerNameMap {
-			if !ok {
-				if _, err := trans.Exec(sqlStatements["deleteMovie"], path, name); err != nil {
-					trans.Rollback()
-					return err
+	return applyIndex(name, libraries)
+}
+
+// Replaces the libraries in movieMap with the given walks of them,
+// adding any new movies to the database, updating the metadata of
+// movies that changed, moving movies that were renamed or moved (from
+// another library or a library path that isn't served anymore), and
+// deleting any movie that wasn't encountered.
+func applyIndex(name string, libraries map[string](map[string]indexedMovie)) error {
+	var added, changed, removed []indexedMovie
+	for moviePath, movies := range libraries {
+		for relpath, m := range movies {
+			if old, ok := movieMap[moviePath][relpath]; !ok {
+				added = append(added, m)
+			} else if !old.movieMeta.equal(m.movieMeta) || old.Fingerprint != m.Fingerprint {
+				changed = append(changed, m)
+			}
+		}
+		for relpath, old := range movieMap[moviePath] {
+			if _, ok := movies[relpath]; !ok {
+				removed = append(removed, old)
+			}
+		}
+	}
+
+	added, moved, removedKeys := findMoves(added, removed)
+	if len(added) > 0 || len(changed) > 0 || len(moved) > 0 || len(removedKeys) > 0 {
+		if err := dbStore.UpdateMovies(added, changed, moved, removedKeys); err != nil {
+			// Committing in chunks may have written some of the
+			// update, so movieMap is reloaded to match the
+			// database, and the next walk writes the rest
+			if *indexCommitSize > 0 {
+				if err := bootstrapIndexMovies(name); err != nil {
+					glog.Errorf("%s: %s", name, err)
 				}
-				delete(innerNameMap, name)
+			}
+			return err
+		}
+	}
+	for moviePath, movies := range libraries {
+		movieMap[moviePath] = movies
+	}
 
+	// A library path that isn't served anymore takes its library
+	// statistics to the path most of its movies moved to
+	relocations := make(map[string]map[string]int)
+	for _, m := range moved {
+		glog.V(vLevel).Infof("%s: %s in %s moved to %s in %s", name, m.From.Name, m.From.Path, m.Name, m.Path)
+		if _, ok := orphanedMovies[m.From]; ok {
+			delete(orphanedMovies, m.From)
+			if relocations[m.From.Path] == nil {
+				relocations[m.From.Path] = make(map[string]int)
 			}
+			relocations[m.From.Path][m.Path]++
 		}
 	}
+	for from, targets := range relocations {
+		var to string
+		for path, count := range targets {
+			if to == "" || count > targets[to] || (count == targets[to] && path < to) {
+				to = path
+			}
+		}
+		if err := dbStore.MoveLibraryDownloads(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts the watcher, if watch-libraries is set, after bootstrapping
+// the indexer
+func bootstrapWatchMovies(name string) error {
+	if err := bootstrapIndexMovies(name); err != nil {
+		return err
+	}
+	if !*watchLibraries {
+		return nil
+	}
+	paths := make([]string, 0, len(moviePaths))
+	for _, v := range moviePaths {
+		paths = append(paths, v)
+	}
+	w, err := newLibraryWatcher(paths)
+	if err != nil {
+		glog.Warningf("%s: %s. Polling the libraries instead", name, err)
+		return nil
+	}
+	movieWatcher = w
+	return nil
+}
 
-	if err := trans.Commit(); err != nil {
+// Indexes what the watcher saw change, or every library if there is no
+// watcher, the watcher lost events, or it's been rescan-interval since
+// the last full walk. If the watcher stops working, it is closed and
+// the libraries are polled from then on.
+func watchMovies(name string) error {
+	if movieWatcher == nil {
+		return indexMovies(name)
+	}
+	changes, rescan, err := movieWatcher.Changes()
+	if err != nil {
+		glog.Warningf("%s: %s. Polling the libraries instead", name, err)
+		movieWatcher.Close()
+		movieWatcher = nil
+		return indexMovies(name)
+	}
+	if rescan || time.Since(lastFullIndex) >= *rescanInterval {
+		return indexMovies(name)
+	}
+	if err := indexChanges(name, changes); err != nil {
+		// The changes are lost, so the next run walks everything
+		lastFullIndex = time.Time{}
 		return err
 	}
-	movieMap = innerMovieMap
 	return nil
 }
 
 type taskFunc func(string) error
 
+// A bootstrap function for tasks that don't need bootstrapping
+func noBootstrap(name string) error {
+	return nil
+}
+
 // Runs the given task continuously after sleeping for the given
 // interval and logs any errors. Returns when it finds a value on the
-// channel
+// channel, which it also checks while sleeping, so that tasks with
+// long intervals don't hold up cleanup
 func runTask(bFunc taskFunc, tFunc taskFunc, name string, interval time.Duration) {
 	if err := bFunc(name); err != nil {
 		glog.Errorf("%s: %s", name, err)
 	}
 	for {
+		if err := tFunc(name); err != nil {
+			glog.Errorf("%s: %s", name, err)
+		}
 		select {
 		case <-killTask:
 			glog.V(vvLevel).Infof("Exiting %s", name)
 			heartbeatWG.Done()
 			return
-		default:
-			if err := tFunc(name); err != nil {
-				glog.Errorf("%s: %s", name, err)
-			}
-			time.Sleep(interval)
+		case <-time.After(interval):
 		}
 	}
 }
@@ -176,7 +474,11 @@ func runTask(bFunc taskFunc, tFunc taskFunc, name string, interval time.Duration
 // Starts each task at it's time interval
 func startupHeartbeat() error {
 	heartbeatWG.Add(numTasks)
-	go runTask(bootstrapIndexMovies, indexMovies, "Movie Indexer", 5*time.Second)
+	go runTask(bootstrapWatchMovies, watchMovies, "Movie Indexer", 5*time.Second)
+	go runTask(noBootstrap, pruneLoginThrottle, "Login Throttle Pruner", time.Minute)
+	go runTask(noBootstrap, pruneSessions, "Session Pruner", 10*time.Minute)
+	go runTask(noBootstrap, snapshotStore, "Store Snapshotter", *snapshotInterval)
+	go runTask(noBootstrap, compactDownloadStats, "Download Stats Compactor", time.Hour)
 	return nil
 }
 
@@ -188,4 +490,7 @@ func cleanupHeartbeat() {
 		killTask <- true
 	}
 	heartbeatWG.Wait()
+	if movieWatcher != nil {
+		movieWatcher.Close()
+	}
 }
@@ -0,0 +1,232 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of the movie indexer
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Returns the indexed movies of library "a" by name
+func indexedLibrary(t *testing.T) map[string]movieMeta {
+	t.Helper()
+	movies, err := dbStore.IndexedMovies([]string{moviePaths["a"]})
+	check(t, err)
+	metas := make(map[string]movieMeta)
+	for _, m := range movies {
+		metas[m.Name] = m.movieMeta
+	}
+	return metas
+}
+
+func TestIndexMovies(t *testing.T) {
+	setupTestLibrary(t, map[string]string{
+		"Alien.mkv":      "alien",
+		"Alien.en.srt":   "subtitles",
+		"Brazil/disc1":   "brazil",
+		".hidden/x.mkv":  "hidden",
+		"Brazil/.hidden": "hidden",
+	})
+	dir := moviePaths["a"]
+	indexed := indexedLibrary(t)
+	expect(t, "names", len(indexed), 5)
+	expect(t, "file", []interface{}{indexed["Alien.mkv"].Size, indexed["Alien.mkv"].IsDir, indexed["Alien.mkv"].MIME},
+		[]interface{}{uint64(5), false, "video/x-matroska"})
+	expect(t, "subtitles type", indexed["Alien.en.srt"].MIME, "application/x-subrip")
+	expect(t, "unknown type", indexed["Brazil/disc1"].MIME, "application/octet-stream")
+	expect(t, "directory", []interface{}{indexed["Brazil"].Size, indexed["Brazil"].IsDir, indexed["Brazil"].MIME},
+		[]interface{}{uint64(6), true, directoryMIME})
+	expect(t, "library", indexed["."].Size, uint64(20))
+
+	// Changed files and the directories they're in are updated,
+	// keeping their downloads
+	_, err := dbStore.AddDownload(dir, "Alien.mkv", time.Now())
+	check(t, err)
+	mtime := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	check(t, ioutil.WriteFile(filepath.Join(dir, "Alien.mkv"), []byte("alien, director's cut"), 0644))
+	check(t, os.Chtimes(filepath.Join(dir, "Alien.mkv"), mtime, mtime))
+	check(t, os.Remove(filepath.Join(dir, "Alien.en.srt")))
+	check(t, ioutil.WriteFile(filepath.Join(dir, "Brazil", "disc2"), []byte("more brazil"), 0644))
+	check(t, indexMovies("Test Indexer"))
+	indexed = indexedLibrary(t)
+	expect(t, "changed file", indexed["Alien.mkv"], movieMeta{21, mtime, false, "video/x-matroska"})
+	if _, ok := indexed["Alien.en.srt"]; ok {
+		t.Error("A removed file is still indexed")
+	}
+	expect(t, "added file", indexed["Brazil/disc2"].Size, uint64(11))
+	expect(t, "grown directory", indexed["Brazil"].Size, uint64(17))
+	expect(t, "grown library", indexed["."].Size, uint64(38))
+	_, movies, err := dbStore.Movies(movieQuery{Path: dir, Pattern: "alien.mkv"})
+	check(t, err)
+	expect(t, "downloads kept", movieCounts(movies), []movieRow{{Name: "Alien.mkv", Downloads: 1}})
+
+	// Metadata is reloaded from the store on startup
+	check(t, bootstrapIndexMovies("Test Indexer"))
+	expect(t, "bootstrapped metadata", movieMap[dir]["Alien.mkv"].movieMeta, indexed["Alien.mkv"])
+}
+
+// Returns the downloads of library a's movies, sorted by name
+func libraryCounts(t *testing.T) []movieRow {
+	t.Helper()
+	_, movies, err := dbStore.Movies(movieQuery{Path: moviePaths["a"], SortBy: "name"})
+	check(t, err)
+	return movieCounts(movies)
+}
+
+func TestIndexMoves(t *testing.T) {
+	setupTestLibrary(t, map[string]string{
+		"Alien.mkv":    "alien",
+		"Brazil/disc1": "brazil 1",
+		"Brazil/disc2": "brazil 2",
+		"Empty.mkv":    "",
+	})
+	dir := moviePaths["a"]
+	expect(t, "empty file fingerprint", movieMap[dir]["Empty.mkv"].Fingerprint, "")
+	if movieMap[dir]["Alien.mkv"].Fingerprint == "" || movieMap[dir]["Brazil"].Fingerprint == "" {
+		t.Fatal("Movies weren't fingerprinted")
+	}
+	now := time.Now()
+	for _, name := range []string{"Alien.mkv", "Brazil", "Brazil/disc1"} {
+		_, err := dbStore.AddDownload(dir, name, now)
+		check(t, err)
+	}
+
+	// Renamed files and directories keep their downloads and
+	// statistics
+	check(t, os.Rename(filepath.Join(dir, "Alien.mkv"), filepath.Join(dir, "Alien (1979).mkv")))
+	check(t, os.Rename(filepath.Join(dir, "Brazil"), filepath.Join(dir, "Brazil (1985)")))
+	check(t, indexMovies("Test Indexer"))
+	renamed := []movieRow{
+		{Name: "."}, {Name: "Alien (1979).mkv", Downloads: 1}, {Name: "Brazil (1985)", Downloads: 1},
+		{Name: "Brazil (1985)/disc1", Downloads: 1}, {Name: "Brazil (1985)/disc2"}, {Name: "Empty.mkv"},
+	}
+	expect(t, "renamed movies", libraryCounts(t), renamed)
+	today := downloadStatsQuery{Paths: []string{dir}, Since: now, Until: now.AddDate(0, 0, 1), Limit: 10}
+	top, err := dbStore.TopMovies(today)
+	check(t, err)
+	expect(t, "renamed statistics", top, []movieDownloads{
+		{movieKey{dir, "Alien (1979).mkv"}, 1}, {movieKey{dir, "Brazil (1985)"}, 1}, {movieKey{dir, "Brazil (1985)/disc1"}, 1},
+	})
+
+	// So does a library moved to a new path, once the server is
+	// restarted with it
+	newDir := t.TempDir()
+	for name, contents := range map[string]string{
+		"Alien (1979).mkv":    "alien",
+		"Brazil (1985)/disc1": "brazil 1",
+		"Brazil (1985)/disc2": "brazil 2",
+		"Empty.mkv":           "",
+	} {
+		check(t, os.MkdirAll(filepath.Dir(filepath.Join(newDir, name)), 0755))
+		check(t, ioutil.WriteFile(filepath.Join(newDir, name), []byte(contents), 0644))
+	}
+	moviePaths["a"] = newDir
+	check(t, bootstrapIndexMovies("Test Indexer"))
+	check(t, indexMovies("Test Indexer"))
+	expect(t, "relocated movies", libraryCounts(t), renamed)
+	today.Paths = []string{newDir}
+	top, err = dbStore.TopMovies(today)
+	check(t, err)
+	expect(t, "relocated statistics", len(top), 3)
+	libraries, err := dbStore.LibraryDownloads(downloadStatsQuery{Paths: []string{dir, newDir}, Since: now, Until: now.AddDate(0, 0, 1)})
+	check(t, err)
+	expect(t, "relocated library statistics", libraries, map[string]uint64{newDir: 3})
+	orphans, err := dbStore.OrphanedMovies([]string{newDir})
+	check(t, err)
+	expect(t, "orphans left", len(orphans), 0)
+}
+
+func TestIndexChanges(t *testing.T) {
+	setupTestLibrary(t, map[string]string{
+		"Alien.mkv":    "alien",
+		"Brazil/disc1": "brazil 1",
+		"Brazil/disc2": "brazil 2",
+		"Casablanca":   "casablanca",
+	})
+	dir := moviePaths["a"]
+	_, err := dbStore.AddDownload(dir, "Brazil/disc1", time.Now())
+	check(t, err)
+
+	check(t, os.Rename(filepath.Join(dir, "Brazil"), filepath.Join(dir, "Brazil (1985)")))
+	check(t, os.Remove(filepath.Join(dir, "Casablanca")))
+	check(t, ioutil.WriteFile(filepath.Join(dir, "Alien.mkv"), []byte("alien, director's cut"), 0644))
+	check(t, os.MkdirAll(filepath.Join(dir, "Dune/extras"), 0755))
+	check(t, ioutil.WriteFile(filepath.Join(dir, "Dune/extras/trailer"), []byte("dune"), 0644))
+	check(t, indexChanges("Test Indexer", map[string]map[string]bool{dir: {
+		"Brazil": true, "Brazil (1985)": true, "Casablanca": true, "Alien.mkv": true, "Dune": true,
+		// Changes in directories that are gone are skipped
+		"Casablanca/extras": true,
+	}}))
+	expect(t, "incrementally indexed movies", libraryCounts(t), []movieRow{
+		{Name: "."}, {Name: "Alien.mkv"}, {Name: "Brazil (1985)"}, {Name: "Brazil (1985)/disc1", Downloads: 1},
+		{Name: "Brazil (1985)/disc2"}, {Name: "Dune"}, {Name: "Dune/extras"}, {Name: "Dune/extras/trailer"},
+	})
+
+	// The incremental index matches a full walk
+	movies, err := scanLibrary(dir, movieMap[dir])
+	check(t, err)
+	expect(t, "incremental movieMap", movieMap[dir], movies)
+	expect(t, "library size", movieMap[dir]["."].Size, uint64(len("alien, director's cut")+len("brazil 1")+len("brazil 2")+len("dune")))
+
+	// A changed library is walked in full
+	check(t, os.Remove(filepath.Join(dir, "Alien.mkv")))
+	check(t, indexChanges("Test Indexer", map[string]map[string]bool{dir: {".": true}}))
+	if _, ok := movieMap[dir]["Alien.mkv"]; ok {
+		t.Error("Alien.mkv is still indexed")
+	}
+}
+
+func TestIndexChunkFailure(t *testing.T) {
+	setupTestLibrary(t, map[string]string{})
+	s, err := openSQLiteStore(filepath.Join(t.TempDir(), "movieserver.db"), true)
+	check(t, err)
+	defer s.Close()
+	dbStore = s
+	oldBatch, oldCommit := *indexBatchSize, *indexCommitSize
+	*indexBatchSize, *indexCommitSize = 2, 2
+	defer func() { *indexBatchSize, *indexCommitSize = oldBatch, oldCommit }()
+	dir := moviePaths["a"]
+	for _, name := range []string{"Alien", "Brazil", "Casablanca", "Dune", "Eraserhead"} {
+		check(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644))
+	}
+	// Dune is already in the database, so its chunk fails after the
+	// ones with the library and Alien, Brazil and Casablanca were
+	// committed
+	check(t, s.UpdateMovies([]indexedMovie{testMovie(dir, "Dune", 1, 0)}, nil, nil, nil))
+	check(t, bootstrapIndexMovies("Test Indexer"))
+	delete(movieMap[dir], "Dune")
+	if err := indexMovies("Test Indexer"); err == nil {
+		t.Fatal("Indexing didn't fail")
+	}
+	expect(t, "reloaded movies", movieNames(libraryCounts(t)), []string{".", "Alien", "Brazil", "Casablanca", "Dune"})
+	indexed := make([]string, 0)
+	for name := range movieMap[dir] {
+		indexed = append(indexed, name)
+	}
+	sort.Strings(indexed)
+	expect(t, "reloaded movieMap", indexed, []string{".", "Alien", "Brazil", "Casablanca", "Dune"})
+
+	// The next walk writes the rest
+	check(t, indexMovies("Test Indexer"))
+	expect(t, "indexed movies", movieNames(libraryCounts(t)), []string{".", "Alien", "Brazil", "Casablanca", "Dune", "Eraserhead"})
+	expect(t, "Dune's size", movieMap[dir]["Dune"].Size, uint64(len("Dune")))
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// .movieignore files, which hide files and directories from the index
+// and from directory tars with gitignore-style patterns. A pattern
+// applies to the directory its ignore file is in and everything under
+// it, and the ignore files of deeper directories override those of
+// shallower ones.
+
+package main
+
+import (
+	"bufio"
+	"github.com/golang/glog"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The name of ignore files, which are never indexed themselves
+const ignoreFileName = ".movieignore"
+
+// A line of an ignore file
+type ignorePattern struct {
+	// Whether the pattern starts with !, which includes what an
+	// earlier pattern excluded
+	negate bool
+	// Whether the pattern ends with /, so it only matches
+	// directories
+	dirOnly bool
+	// The pattern split on slashes. Patterns without a slash (other
+	// than a trailing one) match at any depth, so they start with
+	// **.
+	parts []string
+}
+
+type ignoreFile []ignorePattern
+
+// Parses the lines of an ignore file. Blank lines and lines starting
+// with # are skipped, and a backslash escapes a leading # or !.
+func parseIgnoreFile(r io.Reader) (ignoreFile, error) {
+	var f ignoreFile
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var p ignorePattern
+		if line[0] == '!' {
+			p.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		p.parts = strings.Split(line, "/")
+		f = append(f, p)
+	}
+	return f, scanner.Err()
+}
+
+// Returns true if the slash-separated path parts match the pattern
+// parts, where ** matches any number of directories
+func matchParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		// A trailing ** matches everything inside, but not the
+		// directory itself
+		if len(pattern) == 1 {
+			return len(parts) > 0
+		}
+		return matchParts(pattern[1:], parts) || (len(parts) > 0 && matchParts(pattern, parts[1:]))
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], parts[0])
+	return ok && matchParts(pattern[1:], parts[1:])
+}
+
+// Returns whether the ignore file ignores a path relative to its
+// directory, and whether any pattern decided that. The last matching
+// pattern wins.
+func (f ignoreFile) match(relpath string, isDir bool) (ignored, decided bool) {
+	parts := strings.Split(filepath.ToSlash(relpath), "/")
+	for i := len(f) - 1; i >= 0; i-- {
+		p := f[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if matchParts(p.parts, parts) {
+			return !p.negate, true
+		}
+	}
+	return false, false
+}
+
+// The ignore files of the directories of a library that a walk has
+// seen. Each is read once, and a directory without one maps to nil.
+type ignoreCache struct {
+	sync.Mutex
+	files map[string]ignoreFile
+}
+
+// Returns the ignore file of a directory, reading it if it hasn't been
+// read yet. Ignore files that can't be read are treated as empty.
+func (c *ignoreCache) load(dir string) ignoreFile {
+	c.Lock()
+	f, ok := c.files[dir]
+	c.Unlock()
+	if ok {
+		return f
+	}
+	file, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if err == nil {
+		f, err = parseIgnoreFile(file)
+		file.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		glog.V(vvLevel).Infof("Could not read %s: %s", filepath.Join(dir, ignoreFileName), err)
+	}
+	c.Lock()
+	c.files[dir] = f
+	c.Unlock()
+	return f
+}
+
+// Returns true if a file or directory in the library at moviePath is
+// an ignore file or is ignored by the ignore file of a directory it's
+// in
+func (c *ignoreCache) ignored(moviePath string, fp filePair) bool {
+	if fp.path == moviePath {
+		return false
+	}
+	if filepath.Base(fp.path) == ignoreFileName {
+		return true
+	}
+	for dir := filepath.Dir(fp.path); ; dir = filepath.Dir(dir) {
+		if f := c.load(dir); f != nil {
+			relpath, err := filepath.Rel(dir, fp.path)
+			if err != nil {
+				return false
+			}
+			if ignored, decided := f.match(relpath, fp.fi.IsDir()); decided {
+				return ignored
+			}
+		}
+		if dir == moviePath || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// Returns the filter of a walk in the library at moviePath, which
+// applies the library's rules and ignore files. Each walk needs a
+// filter of its own, so that ignore files changed since the last one
+// are read again.
+func libraryFilter(moviePath string) filterFunc {
+	rules := rulesForPath(moviePath)
+	ignores := &ignoreCache{files: make(map[string]ignoreFile)}
+	return func(fp filePair) bool {
+		return rules.allows(moviePath, fp) && !ignores.ignored(moviePath, fp)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of .movieignore files
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreFile(t *testing.T) {
+	f, err := parseIgnoreFile(strings.NewReader(`# Samples and extras
+*sample*
+!keep-sample.mkv
+Extras/
+/partial
+docs/**/*.txt
+downloads/**
+\#hash
+
+`))
+	check(t, err)
+	for _, test := range []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"alien-sample.mkv", false, true},
+		{"Alien/alien-sample.mkv", false, true},
+		{"Alien/keep-sample.mkv", false, false},
+		{"Alien.mkv", false, false},
+		{"Extras", true, true},
+		{"Alien/Extras", true, true},
+		{"Extras", false, false},
+		{"partial", false, true},
+		{"Alien/partial", false, false},
+		{"docs/readme.txt", false, true},
+		{"docs/a/b/readme.txt", false, true},
+		{"docs/readme.md", false, false},
+		{"downloads", true, false},
+		{"downloads/Alien.mkv", false, true},
+		{"#hash", false, true},
+	} {
+		ignored, _ := f.match(filepath.FromSlash(test.path), test.isDir)
+		expect(t, test.path, ignored, test.ignored)
+	}
+}
+
+func TestMovieIgnore(t *testing.T) {
+	setupTestLibrary(t, map[string]string{
+		ignoreFileName:                     "*sample*\nincoming/\n",
+		"Alien/Alien.mkv":                  "alien",
+		"Alien/alien-sample.mkv":           "sample",
+		"Alien/Extras/trailer.mkv":         "trailer",
+		"Alien/Extras/making-of.mkv":       "making of",
+		"Alien/" + ignoreFileName:          "Extras/*\n!Extras/making-of.mkv\n",
+		"incoming/Brazil.mkv.part":         "brazil",
+		"Casablanca/casablanca-sample.mkv": "sample",
+	})
+	dir := moviePaths["a"]
+	expect(t, "index with ignore files", movieNames(libraryCounts(t)), []string{
+		".", "Alien", "Alien/Alien.mkv", "Alien/Extras", "Alien/Extras/making-of.mkv", "Casablanca",
+	})
+	expect(t, "tar with ignore files", tarNames(t, "Alien"), []string{"Alien/Alien.mkv", "Alien/Extras/making-of.mkv"})
+	for name, code := range map[string]int{
+		"Alien/Alien.mkv": http.StatusOK, "Alien/alien-sample.mkv": http.StatusNotFound,
+		"Alien/Extras/making-of.mkv": http.StatusOK, "Alien/Extras/trailer.mkv": http.StatusNotFound,
+		"incoming/Brazil.mkv.part": http.StatusNotFound, "incoming": http.StatusNotFound,
+		"Alien/" + ignoreFileName: http.StatusNotFound,
+	} {
+		expect(t, name+" status", serveAs(movieHandler, "bob", movieURL+"a/"+name).Code, code)
+	}
+
+	// Changed ignore files are read again on the next index, which
+	// removes what they ignore now
+	check(t, ioutil.WriteFile(filepath.Join(dir, "Alien", ignoreFileName), []byte("Extras/\n"), 0644))
+	check(t, os.Remove(filepath.Join(dir, ignoreFileName)))
+	check(t, indexMovies("Test Indexer"))
+	expect(t, "index with changed ignore files", movieNames(libraryCounts(t)), []string{
+		".", "Alien", "Alien/Alien.mkv", "Alien/alien-sample.mkv", "Casablanca", "Casablanca/casablanca-sample.mkv",
+		"incoming", "incoming/Brazil.mkv.part",
+	})
+
+	// So are the ones the watcher reports
+	check(t, ioutil.WriteFile(filepath.Join(dir, "Alien", ignoreFileName), []byte("*.mkv\n"), 0644))
+	check(t, indexChanges("Test Indexer", map[string]map[string]bool{dir: {"Alien": true}}))
+	movies, err := scanLibrary(dir, movieMap[dir])
+	check(t, err)
+	expect(t, "incremental index with a changed ignore file", movieMap[dir], movies)
+	if _, ok := movieMap[dir]["Alien/Alien.mkv"]; ok {
+		t.Error("Alien/Alien.mkv is still indexed")
+	}
+}
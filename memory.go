@@ -0,0 +1,1227 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// The in-memory backend, which keeps everything in maps and slices.
+// It can snapshot itself to a JSON file, which it loads again on
+// startup, so that it survives restarts. Without a snapshot file
+// everything is lost when the server exits, which suits tests.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The version of the snapshot file format
+const memorySnapshotVersion = 2
+
+type memoryMovie struct {
+	Downloads uint64 `json:"downloads"`
+	movieMeta
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type memoryUser struct {
+	PasswordHash string       `json:"password_hash"`
+	Created      time.Time    `json:"created"`
+	LastLogin    sql.NullTime `json:"last_login"`
+}
+
+type memoryToken struct {
+	apiToken
+	Hash string `json:"hash"`
+}
+
+type memorySession struct {
+	sessionRow
+	Expires time.Time `json:"expires"`
+}
+
+// Everything a memoryStore keeps. It is also the format of the
+// snapshot file.
+type memoryState struct {
+	Version int `json:"version"`
+	// Maps library paths to movie names to their downloads and
+	// metadata
+	Movies   map[string]map[string]*memoryMovie `json:"movies"`
+	Users    map[string]*memoryUser             `json:"users"`
+	Groups   []groupMember                      `json:"groups"`
+	Grants   []libraryGrant                     `json:"grants"`
+	Tokens   []*memoryToken                     `json:"tokens"`
+	Locks    map[string]time.Time               `json:"locks"`
+	Sessions map[string]*memorySession          `json:"sessions"`
+	Shares   []*shareLink                       `json:"share_links"`
+	Events   []downloadEvent                    `json:"download_events"`
+	// Maps library paths to movie names to days (as dayFormat) to
+	// downloads
+	MovieDays map[string]map[string]map[string]uint64 `json:"movie_downloads_daily"`
+	// Maps library paths to days to downloads
+	LibraryDays map[string]map[string]uint64 `json:"library_downloads_daily"`
+	// The last ids given out for each kind of row with an id
+	LastTokenID uint64 `json:"last_token_id"`
+	LastShareID uint64 `json:"last_share_id"`
+	LastEventID uint64 `json:"last_event_id"`
+}
+
+// The snapshot format before movies had metadata, when the movies
+// only had their downloads
+type memoryStateV1 struct {
+	memoryState
+	Movies map[string]map[string]uint64 `json:"movies"`
+}
+
+// Upgrades a version 1 snapshot. The indexer fills in the metadata of
+// its movies the next time it runs.
+func upgradeSnapshotV1(snapshot []byte, state *memoryState) error {
+	old := memoryStateV1{memoryState: *state}
+	if err := json.Unmarshal(snapshot, &old); err != nil {
+		return err
+	}
+	*state = old.memoryState
+	state.Version = memorySnapshotVersion
+	state.Movies = make(map[string]map[string]*memoryMovie)
+	for path, names := range old.Movies {
+		state.Movies[path] = make(map[string]*memoryMovie)
+		for name, downloads := range names {
+			state.Movies[path][name] = &memoryMovie{Downloads: downloads}
+		}
+	}
+	return nil
+}
+
+// A store that keeps everything in memory. It is safe for concurrent
+// use.
+type memoryStore struct {
+	sync.Mutex
+	state memoryState
+	// The file the store is snapshotted to, if any
+	snapshotFile string
+	// Whether anything changed since the last snapshot
+	dirty bool
+}
+
+// Creates an empty memoryStore. If snapshotFile is non-empty and
+// exists, the store is loaded from it.
+func openMemoryStore(snapshotFile string) (*memoryStore, error) {
+	s := &memoryStore{
+		state: memoryState{
+			Version:  memorySnapshotVersion,
+			Movies:   make(map[string]map[string]*memoryMovie),
+			Users:    make(map[string]*memoryUser),
+			Locks:    make(map[string]time.Time),
+			Sessions: make(map[string]*memorySession),
+			// Snapshots from before the statistics leave
+			// these empty
+			MovieDays:   make(map[string]map[string]map[string]uint64),
+			LibraryDays: make(map[string]map[string]uint64),
+		},
+		snapshotFile: snapshotFile,
+	}
+	if snapshotFile == "" {
+		return s, nil
+	}
+	snapshot, err := ioutil.ReadFile(snapshotFile)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(snapshot, &header); err != nil {
+		return nil, fmt.Errorf("Could not load snapshot %s: %s", snapshotFile, err)
+	}
+	if header.Version == 1 {
+		err = upgradeSnapshotV1(snapshot, &s.state)
+	} else {
+		err = json.Unmarshal(snapshot, &s.state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not load snapshot %s: %s", snapshotFile, err)
+	}
+	if s.state.Version != memorySnapshotVersion {
+		return nil, fmt.Errorf("Snapshot %s has version %d, but only version %d is supported", snapshotFile, s.state.Version, memorySnapshotVersion)
+	}
+	return s, nil
+}
+
+// Writes the store to its snapshot file if anything changed since
+// the last snapshot. The file is replaced atomically, so a crash
+// leaves the previous snapshot intact.
+func (s *memoryStore) saveSnapshot() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.snapshotFile == "" || !s.dirty {
+		return nil
+	}
+	snapshot, err := json.Marshal(&s.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.snapshotFile), filepath.Base(s.snapshotFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(snapshot); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.snapshotFile); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// A heartbeat task that snapshots the store, if it is a memoryStore
+func snapshotStore(name string) error {
+	if s, ok := dbStore.(*memoryStore); ok {
+		return s.saveSnapshot()
+	}
+	return nil
+}
+
+// Returns true if s matches the LIKE pattern, where % matches any
+// string, _ matches any character and a backslash makes the next
+// character literal. Like the SQL databases' default collations, it
+// ignores case.
+func likeMatch(pattern, s string) bool {
+	p, str := []rune(strings.ToLower(pattern)), []rune(strings.ToLower(s))
+	// matches[j] is true if the pattern so far matches str[:j]
+	matches := make([]bool, len(str)+1)
+	matches[0] = true
+	for i := 0; i < len(p); i++ {
+		next := make([]bool, len(str)+1)
+		switch c := p[i]; {
+		case c == '%':
+			next[0] = matches[0]
+			for j := 1; j <= len(str); j++ {
+				next[j] = next[j-1] || matches[j]
+			}
+		default:
+			anyChar := c == '_'
+			if c == '\\' && i+1 < len(p) {
+				i++
+				c = p[i]
+			}
+			for j := 1; j <= len(str); j++ {
+				next[j] = matches[j-1] && (anyChar || str[j-1] == c)
+			}
+		}
+		matches = next
+	}
+	return matches[len(str)]
+}
+
+// Returns the [offset, offset+limit) window of n items, where a limit
+// of 0 means everything
+func pageBounds(n int, offset, limit uint64) (int, int) {
+	if limit == 0 {
+		return 0, n
+	}
+	if offset >= uint64(n) {
+		return n, n
+	}
+	end := offset + limit
+	if end > uint64(n) {
+		end = uint64(n)
+	}
+	return int(offset), int(end)
+}
+
+func (s *memoryStore) IndexedMovies(paths []string) ([]indexedMovie, error) {
+	s.Lock()
+	defer s.Unlock()
+	movies := make([]indexedMovie, 0)
+	for _, path := range paths {
+		for name, m := range s.state.Movies[path] {
+			movies = append(movies, indexedMovie{movieKey{path, name}, m.movieMeta, m.Fingerprint})
+		}
+	}
+	return movies, nil
+}
+
+func (s *memoryStore) OrphanedMovies(paths []string) ([]indexedMovie, error) {
+	s.Lock()
+	defer s.Unlock()
+	current := make(map[string]bool)
+	for _, path := range paths {
+		current[path] = true
+	}
+	movies := make([]indexedMovie, 0)
+	for path, names := range s.state.Movies {
+		if current[path] {
+			continue
+		}
+		for name, m := range names {
+			if m.Fingerprint != "" {
+				movies = append(movies, indexedMovie{movieKey{path, name}, m.movieMeta, m.Fingerprint})
+			}
+		}
+	}
+	return movies, nil
+}
+
+// Adds the downloads of each day in from to the days in to
+func addDays(to, from map[string]uint64) {
+	for day, downloads := range from {
+		to[day] += downloads
+	}
+}
+
+func (s *memoryStore) UpdateMovies(added, changed []indexedMovie, moved []movedMovie, removed []movieKey) error {
+	s.Lock()
+	defer s.Unlock()
+	// Checks everything first, so that nothing changes if the
+	// update fails
+	for _, m := range added {
+		if _, ok := s.state.Movies[m.Path][m.Name]; ok {
+			return fmt.Errorf("Movie %s in %s is already indexed", m.Name, m.Path)
+		}
+	}
+	for _, m := range moved {
+		if _, ok := s.state.Movies[m.Path][m.Name]; ok {
+			return fmt.Errorf("Movie %s in %s is already indexed", m.Name, m.Path)
+		}
+	}
+	for _, m := range moved {
+		movie, ok := s.state.Movies[m.From.Path][m.From.Name]
+		if ok {
+			delete(s.state.Movies[m.From.Path], m.From.Name)
+		} else {
+			movie = &memoryMovie{}
+		}
+		if s.state.Movies[m.Path] == nil {
+			s.state.Movies[m.Path] = make(map[string]*memoryMovie)
+		}
+		movie.movieMeta, movie.Fingerprint = m.movieMeta, m.Fingerprint
+		s.state.Movies[m.Path][m.Name] = movie
+		if days, ok := s.state.MovieDays[m.From.Path][m.From.Name]; ok {
+			delete(s.state.MovieDays[m.From.Path], m.From.Name)
+			if s.state.MovieDays[m.Path] == nil {
+				s.state.MovieDays[m.Path] = make(map[string]map[string]uint64)
+			}
+			if s.state.MovieDays[m.Path][m.Name] == nil {
+				s.state.MovieDays[m.Path][m.Name] = make(map[string]uint64)
+			}
+			addDays(s.state.MovieDays[m.Path][m.Name], days)
+		}
+	}
+	for _, m := range added {
+		if s.state.Movies[m.Path] == nil {
+			s.state.Movies[m.Path] = make(map[string]*memoryMovie)
+		}
+		s.state.Movies[m.Path][m.Name] = &memoryMovie{movieMeta: m.movieMeta, Fingerprint: m.Fingerprint}
+	}
+	for _, m := range changed {
+		if movie, ok := s.state.Movies[m.Path][m.Name]; ok {
+			movie.movieMeta, movie.Fingerprint = m.movieMeta, m.Fingerprint
+		}
+	}
+	for _, m := range removed {
+		delete(s.state.Movies[m.Path], m.Name)
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) MoveLibraryDownloads(from, to string) error {
+	s.Lock()
+	defer s.Unlock()
+	days, ok := s.state.LibraryDays[from]
+	if !ok || from == to {
+		return nil
+	}
+	delete(s.state.LibraryDays, from)
+	if s.state.LibraryDays[to] == nil {
+		s.state.LibraryDays[to] = make(map[string]uint64)
+	}
+	addDays(s.state.LibraryDays[to], days)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) AddDownload(path, name string, when time.Time) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	movie, ok := s.state.Movies[path][name]
+	if !ok {
+		return false, nil
+	}
+	movie.Downloads++
+	s.addDownloads(path, name, downloadDay(when), 1)
+	s.dirty = true
+	return true, nil
+}
+
+// Adds downloads to the statistics of a movie and its library for a
+// day. The store must be locked.
+func (s *memoryStore) addDownloads(path, name string, day time.Time, downloads uint64) {
+	if s.state.MovieDays[path] == nil {
+		s.state.MovieDays[path] = make(map[string]map[string]uint64)
+	}
+	if s.state.MovieDays[path][name] == nil {
+		s.state.MovieDays[path][name] = make(map[string]uint64)
+	}
+	if s.state.LibraryDays[path] == nil {
+		s.state.LibraryDays[path] = make(map[string]uint64)
+	}
+	s.state.MovieDays[path][name][day.Format(dayFormat)] += downloads
+	s.state.LibraryDays[path][day.Format(dayFormat)] += downloads
+}
+
+func (s *memoryStore) Movies(q movieQuery) (uint64, []movieRow, error) {
+	if q.SortBy != "" && !sortableMovieColumns[q.SortBy] {
+		return 0, nil, fmt.Errorf("Cannot sort by %s", q.SortBy)
+	}
+	s.Lock()
+	movies := make([]movieRow, 0)
+	for name, m := range s.state.Movies[q.Path] {
+		if q.Pattern == "" || likeMatch(q.Pattern, name) {
+			movies = append(movies, movieRow{name, m.Downloads, m.movieMeta})
+		}
+	}
+	s.Unlock()
+
+	// Sorts by name when no column is given, so that pages are
+	// stable
+	sort.Slice(movies, func(i, j int) bool {
+		a, b := movies[i], movies[j]
+		if q.Descending {
+			a, b = b, a
+		}
+		switch {
+		case q.SortBy == "downloads" && a.Downloads != b.Downloads:
+			return a.Downloads < b.Downloads
+		case q.SortBy == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case q.SortBy == "mtime" && !a.Mtime.Equal(b.Mtime):
+			return a.Mtime.Before(b.Mtime)
+		}
+		return a.Name < b.Name
+	})
+	total := uint64(len(movies))
+	offset := q.Offset
+	if offset >= total {
+		offset = 0
+	}
+	start, end := pageBounds(len(movies), offset, q.Limit)
+	return total, movies[start:end], nil
+}
+
+func (s *memoryStore) PasswordHash(user string) (string, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if u, ok := s.state.Users[user]; ok {
+		return u.PasswordHash, true, nil
+	}
+	return "", false, nil
+}
+
+func (s *memoryStore) UpdateLastLogin(user string) error {
+	s.Lock()
+	defer s.Unlock()
+	if u, ok := s.state.Users[user]; ok {
+		u.LastLogin = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *memoryStore) NewUser(user, hash string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.state.Users[user]; ok {
+		return fmt.Errorf("User %s already exists", user)
+	}
+	s.state.Users[user] = &memoryUser{PasswordHash: hash, Created: time.Now().UTC()}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) SetPasswordHash(user, hash string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, ok := s.state.Users[user]
+	if ok {
+		u.PasswordHash = hash
+		s.dirty = true
+	}
+	return ok, nil
+}
+
+func (s *memoryStore) DeleteUser(user string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.state.Users[user]; !ok {
+		return false, nil
+	}
+	delete(s.state.Users, user)
+	groups := s.state.Groups[:0]
+	for _, m := range s.state.Groups {
+		if m.User != user {
+			groups = append(groups, m)
+		}
+	}
+	s.state.Groups = groups
+	grants := s.state.Grants[:0]
+	for _, g := range s.state.Grants {
+		if g.PrincipalType != principalUser || g.Principal != user {
+			grants = append(grants, g)
+		}
+	}
+	s.state.Grants = grants
+	tokens := s.state.Tokens[:0]
+	for _, t := range s.state.Tokens {
+		if t.User != user {
+			tokens = append(tokens, t)
+		}
+	}
+	s.state.Tokens = tokens
+	delete(s.state.Locks, user)
+	for id, session := range s.state.Sessions {
+		if session.User == user {
+			delete(s.state.Sessions, id)
+		}
+	}
+	shares := s.state.Shares[:0]
+	for _, link := range s.state.Shares {
+		if link.Creator != user {
+			shares = append(shares, link)
+		}
+	}
+	s.state.Shares = shares
+	s.dirty = true
+	return true, nil
+}
+
+func (s *memoryStore) Users() ([]userInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	users := make([]userInfo, 0, len(s.state.Users))
+	for name, u := range s.state.Users {
+		info := userInfo{Name: name, Created: u.Created, LastLogin: u.LastLogin}
+		if lockedAt, ok := s.state.Locks[name]; ok {
+			info.LockedAt = sql.NullTime{Time: lockedAt, Valid: true}
+		}
+		users = append(users, info)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func (s *memoryStore) UserLibraries(user string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	groups := make(map[string]bool)
+	for _, m := range s.state.Groups {
+		if m.User == user {
+			groups[m.Group] = true
+		}
+	}
+	seen := make(map[string]bool)
+	libraries := make([]string, 0)
+	for _, g := range s.state.Grants {
+		if (g.PrincipalType == principalUser && g.Principal == user) ||
+			(g.PrincipalType == principalGroup && groups[g.Principal]) {
+			if !seen[g.Library] {
+				seen[g.Library] = true
+				libraries = append(libraries, g.Library)
+			}
+		}
+	}
+	return libraries, nil
+}
+
+func (s *memoryStore) GrantLibrary(principalType, principal, library string) error {
+	s.Lock()
+	defer s.Unlock()
+	grant := libraryGrant{principalType, principal, library}
+	for _, g := range s.state.Grants {
+		if g == grant {
+			return nil
+		}
+	}
+	s.state.Grants = append(s.state.Grants, grant)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) RevokeLibrary(principalType, principal, library string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	grant := libraryGrant{principalType, principal, library}
+	for i, g := range s.state.Grants {
+		if g == grant {
+			s.state.Grants = append(s.state.Grants[:i], s.state.Grants[i+1:]...)
+			s.dirty = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) Grants() ([]libraryGrant, error) {
+	s.Lock()
+	defer s.Unlock()
+	grants := append([]libraryGrant{}, s.state.Grants...)
+	sort.Slice(grants, func(i, j int) bool {
+		a, b := grants[i], grants[j]
+		if a.PrincipalType != b.PrincipalType {
+			return a.PrincipalType < b.PrincipalType
+		}
+		if a.Principal != b.Principal {
+			return a.Principal < b.Principal
+		}
+		return a.Library < b.Library
+	})
+	return grants, nil
+}
+
+func (s *memoryStore) AddGroupMember(group, user string) error {
+	s.Lock()
+	defer s.Unlock()
+	member := groupMember{group, user}
+	for _, m := range s.state.Groups {
+		if m == member {
+			return nil
+		}
+	}
+	s.state.Groups = append(s.state.Groups, member)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) RemoveGroupMember(group, user string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	member := groupMember{group, user}
+	for i, m := range s.state.Groups {
+		if m == member {
+			s.state.Groups = append(s.state.Groups[:i], s.state.Groups[i+1:]...)
+			s.dirty = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) IsGroupMember(group, user string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	member := groupMember{group, user}
+	for _, m := range s.state.Groups {
+		if m == member {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) GroupMembers() ([]groupMember, error) {
+	s.Lock()
+	defer s.Unlock()
+	members := append([]groupMember{}, s.state.Groups...)
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Group != members[j].Group {
+			return members[i].Group < members[j].Group
+		}
+		return members[i].User < members[j].User
+	})
+	return members, nil
+}
+
+func (s *memoryStore) NewToken(user, hash, scope string) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, t := range s.state.Tokens {
+		if t.Hash == hash {
+			return fmt.Errorf("Token already exists")
+		}
+	}
+	s.state.LastTokenID++
+	s.state.Tokens = append(s.state.Tokens, &memoryToken{
+		apiToken: apiToken{ID: s.state.LastTokenID, User: user, Scope: scope, Created: time.Now().UTC()},
+		Hash:     hash,
+	})
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) UseToken(hash string) (string, string, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, t := range s.state.Tokens {
+		if t.Hash == hash {
+			t.LastUsed = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+			s.dirty = true
+			return t.User, t.Scope, nil
+		}
+	}
+	return "", "", nil
+}
+
+func (s *memoryStore) DeleteToken(id uint64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	for i, t := range s.state.Tokens {
+		if t.ID == id {
+			s.state.Tokens = append(s.state.Tokens[:i], s.state.Tokens[i+1:]...)
+			s.dirty = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) Tokens(user string) ([]apiToken, error) {
+	s.Lock()
+	defer s.Unlock()
+	tokens := make([]apiToken, 0)
+	for _, t := range s.state.Tokens {
+		if user == "" || t.User == user {
+			tokens = append(tokens, t.apiToken)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].User != tokens[j].User {
+			return tokens[i].User < tokens[j].User
+		}
+		return tokens[i].ID < tokens[j].ID
+	})
+	return tokens, nil
+}
+
+func (s *memoryStore) IsLocked(user string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.state.Locks[user]
+	return ok, nil
+}
+
+func (s *memoryStore) LockAccount(user string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.state.Users[user]; !ok {
+		return nil
+	}
+	if _, ok := s.state.Locks[user]; !ok {
+		s.state.Locks[user] = time.Now().UTC()
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *memoryStore) UnlockAccount(user string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.state.Locks[user]
+	if ok {
+		delete(s.state.Locks, user)
+		s.dirty = true
+	}
+	return ok, nil
+}
+
+func (s *memoryStore) NewSession(idHash, user string, expires time.Time, ip, userAgent string) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.state.Sessions[idHash]; ok {
+		return fmt.Errorf("Session already exists")
+	}
+	now := time.Now().UTC()
+	s.state.Sessions[idHash] = &memorySession{
+		sessionRow: sessionRow{ID: idHash, User: user, Created: now, LastSeen: now, IP: ip, UserAgent: userAgent},
+		Expires:    expires.UTC(),
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) TouchSession(idHash, user string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now().UTC()
+	session, ok := s.state.Sessions[idHash]
+	if !ok || session.User != user || !session.Expires.After(now) {
+		return false, nil
+	}
+	session.LastSeen = now
+	s.dirty = true
+	return true, nil
+}
+
+func (s *memoryStore) Sessions(user string) ([]sessionRow, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	sessions := make([]sessionRow, 0)
+	for _, session := range s.state.Sessions {
+		if (user == "" || session.User == user) && session.Expires.After(now) {
+			sessions = append(sessions, session.sessionRow)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].User != sessions[j].User {
+			return sessions[i].User < sessions[j].User
+		}
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+func (s *memoryStore) DeleteSession(idHash, user string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.state.Sessions[idHash]
+	if !ok || session.User != user {
+		return false, nil
+	}
+	delete(s.state.Sessions, idHash)
+	s.dirty = true
+	return true, nil
+}
+
+// Deletes the sessions that match, returning how many there were
+func (s *memoryStore) deleteSessions(match func(*memorySession) bool) int64 {
+	s.Lock()
+	defer s.Unlock()
+	var count int64
+	for id, session := range s.state.Sessions {
+		if match(session) {
+			delete(s.state.Sessions, id)
+			count++
+		}
+	}
+	if count > 0 {
+		s.dirty = true
+	}
+	return count
+}
+
+func (s *memoryStore) DeleteUserSessions(user string) (int64, error) {
+	return s.deleteSessions(func(session *memorySession) bool { return session.User == user }), nil
+}
+
+func (s *memoryStore) DeleteExpiredSessions() (int64, error) {
+	now := time.Now()
+	return s.deleteSessions(func(session *memorySession) bool { return !session.Expires.After(now) }), nil
+}
+
+func (s *memoryStore) NewShareLink(link shareLink) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.state.LastShareID++
+	link.ID, link.Expires, link.Downloads = s.state.LastShareID, link.Expires.UTC(), 0
+	s.state.Shares = append(s.state.Shares, &link)
+	s.dirty = true
+	return link.ID, nil
+}
+
+// Returns the share link with the given id. The store must be
+// locked.
+func (s *memoryStore) findShareLink(id uint64) (int, *shareLink) {
+	for i, link := range s.state.Shares {
+		if link.ID == id {
+			return i, link
+		}
+	}
+	return -1, nil
+}
+
+func (s *memoryStore) ShareLink(id uint64) (shareLink, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, link := s.findShareLink(id); link != nil {
+		return *link, true, nil
+	}
+	return shareLink{}, false, nil
+}
+
+func (s *memoryStore) ShareLinks(creator string) ([]shareLink, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	links := make([]shareLink, 0)
+	for _, link := range s.state.Shares {
+		if (creator == "" || link.Creator == creator) && link.Expires.After(now) {
+			links = append(links, *link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].Creator != links[j].Creator {
+			return links[i].Creator < links[j].Creator
+		}
+		return links[i].ID < links[j].ID
+	})
+	return links, nil
+}
+
+func (s *memoryStore) AddShareDownload(id uint64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, link := s.findShareLink(id)
+	if link == nil || !link.Expires.After(time.Now()) ||
+		(link.MaxDownloads.Valid && link.Downloads >= uint64(link.MaxDownloads.Int64)) {
+		return false, nil
+	}
+	link.Downloads++
+	s.dirty = true
+	return true, nil
+}
+
+func (s *memoryStore) DeleteShareLink(id uint64) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	i, link := s.findShareLink(id)
+	if link == nil {
+		return false, nil
+	}
+	s.state.Shares = append(s.state.Shares[:i], s.state.Shares[i+1:]...)
+	s.dirty = true
+	return true, nil
+}
+
+// Returns the sum of the downloads of the days in the query's range
+func sumDays(days map[string]uint64, q downloadStatsQuery) uint64 {
+	since, until := downloadDay(q.Since).Format(dayFormat), downloadDay(q.Until).Format(dayFormat)
+	var sum uint64
+	for day, downloads := range days {
+		if day >= since && day < until {
+			sum += downloads
+		}
+	}
+	return sum
+}
+
+func (s *memoryStore) TopMovies(q downloadStatsQuery) ([]movieDownloads, error) {
+	s.Lock()
+	movies := make([]movieDownloads, 0)
+	for _, path := range q.Paths {
+		for name, days := range s.state.MovieDays[path] {
+			if downloads := sumDays(days, q); downloads > 0 {
+				movies = append(movies, movieDownloads{movieKey{path, name}, downloads})
+			}
+		}
+	}
+	s.Unlock()
+	sort.Slice(movies, func(i, j int) bool {
+		a, b := movies[i], movies[j]
+		if a.Downloads != b.Downloads {
+			return a.Downloads > b.Downloads
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Name < b.Name
+	})
+	_, end := pageBounds(len(movies), 0, q.Limit)
+	return movies[:end], nil
+}
+
+func (s *memoryStore) LibraryDownloads(q downloadStatsQuery) (map[string]uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+	downloads := make(map[string]uint64)
+	for _, path := range q.Paths {
+		if sum := sumDays(s.state.LibraryDays[path], q); sum > 0 {
+			downloads[path] = sum
+		}
+	}
+	return downloads, nil
+}
+
+// Moves the downloads of the days before the given one to the first
+// day of their month, returning true if any moved
+func compactDays(days map[string]uint64, before time.Time) bool {
+	moved := false
+	for day, downloads := range days {
+		t, err := time.Parse(dayFormat, day)
+		if err != nil || !t.Before(before) {
+			continue
+		}
+		if month := downloadMonth(t).Format(dayFormat); month != day {
+			delete(days, day)
+			days[month] += downloads
+			moved = true
+		}
+	}
+	return moved
+}
+
+func (s *memoryStore) CompactDownloadStats(before time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, names := range s.state.MovieDays {
+		for _, days := range names {
+			if compactDays(days, before) {
+				s.dirty = true
+			}
+		}
+	}
+	for _, days := range s.state.LibraryDays {
+		if compactDays(days, before) {
+			s.dirty = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) NewDownloadEvent(event downloadEvent) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.LastEventID++
+	event.ID, event.Started, event.Finished = s.state.LastEventID, event.Started.UTC(), event.Finished.UTC()
+	s.state.Events = append(s.state.Events, event)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) DownloadEvents(q downloadEventQuery) (uint64, []downloadEvent, error) {
+	s.Lock()
+	events := make([]downloadEvent, 0)
+	for _, e := range s.state.Events {
+		if (q.User == "" || e.User == q.User) &&
+			(q.Library == "" || e.Library == q.Library) &&
+			(q.Name == "" || e.Name == q.Name) &&
+			(q.Pattern == "" || likeMatch(q.Pattern, e.Name)) &&
+			(q.Status == 0 || e.Status == q.Status) &&
+			(q.Since.IsZero() || !e.Started.Before(q.Since)) &&
+			(q.Until.IsZero() || e.Started.Before(q.Until)) {
+			events = append(events, e)
+		}
+	}
+	s.Unlock()
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Started.Equal(events[j].Started) {
+			return events[i].Started.After(events[j].Started)
+		}
+		return events[i].ID > events[j].ID
+	})
+	start, end := pageBounds(len(events), q.Offset, q.Limit)
+	return uint64(len(events)), events[start:end], nil
+}
+
+// Returns the sorted keys of a map of downloads by day
+func sortedDays(days map[string]uint64) []string {
+	keys := make([]string, 0, len(days))
+	for day := range days {
+		keys = append(keys, day)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the catalog in the same order as the SQL backends
+func (s *memoryStore) Export() (*catalog, error) {
+	s.Lock()
+	defer s.Unlock()
+	c := newCatalog()
+	for path, names := range s.state.Movies {
+		for name, m := range names {
+			c.Movies = append(c.Movies, catalogMovie{Path: path, Name: name, Downloads: m.Downloads, movieMeta: m.movieMeta,
+				Fingerprint: m.Fingerprint})
+		}
+	}
+	sort.Slice(c.Movies, func(i, j int) bool {
+		if c.Movies[i].Path != c.Movies[j].Path {
+			return c.Movies[i].Path < c.Movies[j].Path
+		}
+		return c.Movies[i].Name < c.Movies[j].Name
+	})
+	for name, u := range s.state.Users {
+		c.Users = append(c.Users, catalogUser{Name: name, PasswordHash: u.PasswordHash, Created: u.Created,
+			LastLogin: timePointer(u.LastLogin)})
+	}
+	sort.Slice(c.Users, func(i, j int) bool { return c.Users[i].Name < c.Users[j].Name })
+	for _, m := range s.state.Groups {
+		c.Groups = append(c.Groups, catalogGroupMember{m.Group, m.User})
+	}
+	sort.Slice(c.Groups, func(i, j int) bool {
+		if c.Groups[i].Group != c.Groups[j].Group {
+			return c.Groups[i].Group < c.Groups[j].Group
+		}
+		return c.Groups[i].User < c.Groups[j].User
+	})
+	for _, g := range s.state.Grants {
+		c.Grants = append(c.Grants, catalogGrant{g.PrincipalType, g.Principal, g.Library})
+	}
+	sort.Slice(c.Grants, func(i, j int) bool {
+		a, b := c.Grants[i], c.Grants[j]
+		if a.PrincipalType != b.PrincipalType {
+			return a.PrincipalType < b.PrincipalType
+		}
+		if a.Principal != b.Principal {
+			return a.Principal < b.Principal
+		}
+		return a.Library < b.Library
+	})
+	for _, t := range s.state.Tokens {
+		c.Tokens = append(c.Tokens, catalogToken{ID: t.ID, User: t.User, Hash: t.Hash, Scope: t.Scope, Created: t.Created,
+			LastUsed: timePointer(t.LastUsed)})
+	}
+	sort.Slice(c.Tokens, func(i, j int) bool { return c.Tokens[i].ID < c.Tokens[j].ID })
+	for user, lockedAt := range s.state.Locks {
+		c.Locks = append(c.Locks, catalogLock{user, lockedAt})
+	}
+	sort.Slice(c.Locks, func(i, j int) bool { return c.Locks[i].User < c.Locks[j].User })
+	for _, link := range s.state.Shares {
+		exported := catalogShareLink{ID: link.ID, Creator: link.Creator, Library: link.Library, Name: link.Name,
+			Expires: link.Expires, Downloads: link.Downloads}
+		if link.MaxDownloads.Valid {
+			maxDownloads := link.MaxDownloads.Int64
+			exported.MaxDownloads = &maxDownloads
+		}
+		c.ShareLinks = append(c.ShareLinks, exported)
+	}
+	sort.Slice(c.ShareLinks, func(i, j int) bool { return c.ShareLinks[i].ID < c.ShareLinks[j].ID })
+	for path, names := range s.state.MovieDays {
+		for name, days := range names {
+			for _, day := range sortedDays(days) {
+				c.MovieDownloadsDaily = append(c.MovieDownloadsDaily, catalogDailyDownloads{path, name, day, days[day]})
+			}
+		}
+	}
+	sort.SliceStable(c.MovieDownloadsDaily, func(i, j int) bool {
+		a, b := c.MovieDownloadsDaily[i], c.MovieDownloadsDaily[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Name < b.Name
+	})
+	for path, days := range s.state.LibraryDays {
+		for _, day := range sortedDays(days) {
+			c.LibraryDownloadsDaily = append(c.LibraryDownloadsDaily, catalogDailyDownloads{Path: path, Day: day, Downloads: days[day]})
+		}
+	}
+	sort.SliceStable(c.LibraryDownloadsDaily, func(i, j int) bool {
+		return c.LibraryDownloadsDaily[i].Path < c.LibraryDownloadsDaily[j].Path
+	})
+	c.DownloadEvents = append(c.DownloadEvents, s.state.Events...)
+	sort.Slice(c.DownloadEvents, func(i, j int) bool { return c.DownloadEvents[i].ID < c.DownloadEvents[j].ID })
+	return c, nil
+}
+
+// Replaces the state with a new one built from the catalog. The last
+// ids given out become the largest ids in the catalog.
+func (s *memoryStore) Import(c *catalog) error {
+	state := memoryState{
+		Version:     memorySnapshotVersion,
+		Movies:      make(map[string]map[string]*memoryMovie),
+		Users:       make(map[string]*memoryUser),
+		Groups:      make([]groupMember, 0, len(c.Groups)),
+		Grants:      make([]libraryGrant, 0, len(c.Grants)),
+		Tokens:      make([]*memoryToken, 0, len(c.Tokens)),
+		Locks:       make(map[string]time.Time),
+		Sessions:    make(map[string]*memorySession),
+		Shares:      make([]*shareLink, 0, len(c.ShareLinks)),
+		Events:      make([]downloadEvent, 0, len(c.DownloadEvents)),
+		MovieDays:   make(map[string]map[string]map[string]uint64),
+		LibraryDays: make(map[string]map[string]uint64),
+	}
+	for _, m := range c.Movies {
+		if state.Movies[m.Path] == nil {
+			state.Movies[m.Path] = make(map[string]*memoryMovie)
+		}
+		meta := m.movieMeta
+		meta.Mtime = meta.Mtime.UTC()
+		state.Movies[m.Path][m.Name] = &memoryMovie{Downloads: m.Downloads, movieMeta: meta, Fingerprint: m.Fingerprint}
+	}
+	for _, u := range c.Users {
+		state.Users[u.Name] = &memoryUser{PasswordHash: u.PasswordHash, Created: u.Created.UTC(), LastLogin: nullTime(u.LastLogin)}
+	}
+	for _, m := range c.Groups {
+		state.Groups = append(state.Groups, groupMember{m.Group, m.User})
+	}
+	for _, g := range c.Grants {
+		state.Grants = append(state.Grants, libraryGrant{g.PrincipalType, g.Principal, g.Library})
+	}
+	for _, t := range c.Tokens {
+		state.Tokens = append(state.Tokens, &memoryToken{
+			apiToken: apiToken{ID: t.ID, User: t.User, Scope: t.Scope, Created: t.Created.UTC(), LastUsed: nullTime(t.LastUsed)},
+			Hash:     t.Hash,
+		})
+		if t.ID > state.LastTokenID {
+			state.LastTokenID = t.ID
+		}
+	}
+	for _, l := range c.Locks {
+		state.Locks[l.User] = l.LockedAt.UTC()
+	}
+	for _, link := range c.ShareLinks {
+		imported := &shareLink{ID: link.ID, Creator: link.Creator, Library: link.Library, Name: link.Name,
+			Expires: link.Expires.UTC(), Downloads: link.Downloads}
+		if link.MaxDownloads != nil {
+			imported.MaxDownloads = sql.NullInt64{Int64: *link.MaxDownloads, Valid: true}
+		}
+		state.Shares = append(state.Shares, imported)
+		if link.ID > state.LastShareID {
+			state.LastShareID = link.ID
+		}
+	}
+	for _, event := range c.DownloadEvents {
+		event.Started, event.Finished = event.Started.UTC(), event.Finished.UTC()
+		state.Events = append(state.Events, event)
+		if event.ID > state.LastEventID {
+			state.LastEventID = event.ID
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.state = state
+	// The days were checked by readCatalog
+	for _, d := range c.MovieDownloadsDaily {
+		day, _ := time.Parse(dayFormat, d.Day)
+		if s.state.MovieDays[d.Path] == nil {
+			s.state.MovieDays[d.Path] = make(map[string]map[string]uint64)
+		}
+		if s.state.MovieDays[d.Path][d.Name] == nil {
+			s.state.MovieDays[d.Path][d.Name] = make(map[string]uint64)
+		}
+		s.state.MovieDays[d.Path][d.Name][day.Format(dayFormat)] += d.Downloads
+	}
+	for _, d := range c.LibraryDownloadsDaily {
+		day, _ := time.Parse(dayFormat, d.Day)
+		if s.state.LibraryDays[d.Path] == nil {
+			s.state.LibraryDays[d.Path] = make(map[string]uint64)
+		}
+		s.state.LibraryDays[d.Path][day.Format(dayFormat)] += d.Downloads
+	}
+	s.dirty = true
+	return nil
+}
+
+// Writes a final snapshot
+func (s *memoryStore) Close() error {
+	return s.saveSnapshot()
+}
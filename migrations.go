@@ -0,0 +1,193 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Versioned schema migrations for the SQL backends. Each backend has
+// a directory under migrations holding numbered files like
+// 0002_add_column.sql, which are compiled into the binary. The
+// schema_version table records which versions a database has, and
+// the missing ones are applied in order when the store is opened.
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"github.com/golang/glog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// A numbered change to the schema
+type migration struct {
+	Version int
+	Name    string
+	// The statements of the migration, in order
+	Statements []string
+}
+
+// A row of the schema_version table
+type appliedMigration struct {
+	Version int
+	Name    string
+	Applied time.Time
+}
+
+// Splits a migration file into statements. A statement ends with a
+// semicolon at the end of a line, and lines starting with -- are
+// comments.
+func splitStatements(contents string) []string {
+	var (
+		statements []string
+		current    []string
+	)
+	for _, line := range strings.Split(contents, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "--") || (trimmed == "" && len(current) == 0) {
+			continue
+		}
+		current = append(current, line)
+		if strings.HasSuffix(trimmed, ";") {
+			stmt := strings.TrimSpace(strings.Join(current, "\n"))
+			statements = append(statements, strings.TrimSuffix(stmt, ";"))
+			current = nil
+		}
+	}
+	if stmt := strings.TrimSpace(strings.Join(current, "\n")); stmt != "" {
+		statements = append(statements, stmt)
+	}
+	return statements
+}
+
+// Returns the migrations in migrations/<dialect>, sorted by version.
+// The versions must count up from 1 without gaps.
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		filename := entry.Name()
+		if !strings.HasSuffix(filename, ".sql") {
+			continue
+		}
+		underscore := strings.Index(filename, "_")
+		if underscore == -1 {
+			return nil, fmt.Errorf("Migration %s is not named [version]_[name].sql", filename)
+		}
+		version, err := strconv.Atoi(filename[:underscore])
+		if err != nil {
+			return nil, fmt.Errorf("Migration %s is not named [version]_[name].sql", filename)
+		}
+		contents, err := migrationFiles.ReadFile(path.Join(dir, filename))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			Version:    version,
+			Name:       strings.TrimSuffix(filename[underscore+1:], ".sql"),
+			Statements: splitStatements(string(contents)),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("The %s migrations skip from version %d to %d", dialect, i, m.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// Returns the rows of the schema_version table, creating the table if
+// it doesn't exist
+func (s *sqlStore) appliedMigrations() ([]appliedMigration, error) {
+	if _, err := s.db.Exec(s.stmt("createSchemaVersion")); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(s.stmt("getSchemaVersions"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make([]appliedMigration, 0)
+	for rows.Next() {
+		var m appliedMigration
+		if err := rows.Scan(&m.Version, &m.Name, &m.Applied); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, rows.Err()
+}
+
+// Applies one migration and records it in the schema_version table,
+// all in one transaction. MySQL commits schema changes implicitly, so
+// if a MySQL migration fails partway, the statements before the
+// failing one stay applied.
+func (s *sqlStore) applyMigration(m migration) error {
+	trans, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range m.Statements {
+		glog.V(vvLevel).Infof("Executing: %s", stmt)
+		if _, err := trans.Exec(stmt); err != nil {
+			trans.Rollback()
+			return fmt.Errorf("Migration %d (%s) failed: %s", m.Version, m.Name, err)
+		}
+	}
+	if _, err := trans.Exec(s.stmt("addSchemaVersion"), m.Version, m.Name); err != nil {
+		trans.Rollback()
+		return err
+	}
+	return trans.Commit()
+}
+
+// Applies every migration the database doesn't have yet, in order.
+// It refuses to touch a database that has a version newer than this
+// binary knows about.
+func (s *sqlStore) migrate() error {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return err
+	}
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	current := 0
+	for _, m := range applied {
+		if m.Version > len(migrations) {
+			return fmt.Errorf("The database has schema version %d, but this server only knows up to version %d", m.Version, len(migrations))
+		}
+		if m.Version > current {
+			current = m.Version
+		}
+	}
+	for _, m := range migrations[current:] {
+		glog.V(vLevel).Infof("Applying migration %d (%s)", m.Version, m.Name)
+		if err := s.applyMigration(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+-- The schema as it was before migrations were introduced. Every
+-- statement is idempotent, so databases created by the old setup.sql
+-- adopt it without changes.
+
+CREATE TABLE IF NOT EXISTS movies(
+        path VARCHAR(767),
+        name VARCHAR(767),
+        downloads BIGINT UNSIGNED DEFAULT 0,
+        PRIMARY KEY (path, name),
+        KEY downloads(downloads)
+        );
+
+CREATE TABLE IF NOT EXISTS users(
+        username VARCHAR(255) NOT NULL,
+        password_hash VARCHAR(255) NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_login TIMESTAMP NULL DEFAULT NULL,
+        PRIMARY KEY (username)
+        );
+
+CREATE TABLE IF NOT EXISTS user_groups(
+        group_name VARCHAR(255) NOT NULL,
+        username VARCHAR(255) NOT NULL,
+        PRIMARY KEY (group_name, username),
+        KEY username(username)
+        );
+
+CREATE TABLE IF NOT EXISTS library_acl(
+        principal_type VARCHAR(5) NOT NULL,
+        principal VARCHAR(255) NOT NULL,
+        library VARCHAR(255) NOT NULL,
+        PRIMARY KEY (principal_type, principal, library)
+        );
+
+CREATE TABLE IF NOT EXISTS api_tokens(
+        id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        username VARCHAR(255) NOT NULL,
+        token_hash CHAR(64) NOT NULL,
+        scope VARCHAR(16) NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_used TIMESTAMP NULL DEFAULT NULL,
+        PRIMARY KEY (id),
+        UNIQUE KEY token_hash(token_hash),
+        KEY username(username)
+        );
+
+CREATE TABLE IF NOT EXISTS account_locks(
+        username VARCHAR(255) NOT NULL,
+        locked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (username)
+        );
+
+CREATE TABLE IF NOT EXISTS sessions(
+        id CHAR(64) NOT NULL,
+        username VARCHAR(255) NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_seen TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        ip VARCHAR(45) NOT NULL,
+        user_agent VARCHAR(512) NOT NULL DEFAULT '',
+        PRIMARY KEY (id),
+        KEY username(username),
+        KEY expires(expires)
+        );
+
+CREATE TABLE IF NOT EXISTS share_links(
+        id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        creator VARCHAR(255) NOT NULL,
+        library VARCHAR(255) NOT NULL,
+        name VARCHAR(767) NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        max_downloads BIGINT UNSIGNED NULL DEFAULT NULL,
+        downloads BIGINT UNSIGNED NOT NULL DEFAULT 0,
+        PRIMARY KEY (id),
+        KEY creator(creator)
+        );
+
+CREATE TABLE IF NOT EXISTS download_events(
+        id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+        username VARCHAR(255) NOT NULL,
+        library VARCHAR(255) NOT NULL,
+        name VARCHAR(767) NOT NULL,
+        started TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+        finished TIMESTAMP(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+        bytes BIGINT UNSIGNED NOT NULL DEFAULT 0,
+        status SMALLINT UNSIGNED NOT NULL,
+        range_header VARCHAR(255) NULL DEFAULT NULL,
+        ip VARCHAR(45) NOT NULL,
+        PRIMARY KEY (id),
+        KEY started(started),
+        KEY username(username, started),
+        KEY library(library, started)
+        );
@@ -0,0 +1,12 @@
+-- The size, modification time, type and directory flag of each movie.
+-- The indexer fills them in for existing movies on its next run. The
+-- modification time is a DATETIME, since files can be older than the
+-- TIMESTAMP range.
+
+ALTER TABLE movies
+        ADD COLUMN size BIGINT UNSIGNED NOT NULL DEFAULT 0,
+        ADD COLUMN mtime DATETIME NULL DEFAULT NULL,
+        ADD COLUMN is_dir BOOLEAN NOT NULL DEFAULT FALSE,
+        ADD COLUMN mime VARCHAR(255) NOT NULL DEFAULT '',
+        ADD KEY size(size),
+        ADD KEY mtime(mtime);
@@ -0,0 +1,20 @@
+-- Download counts per day, of each movie and of each library. Days
+-- older than -stats-day-retention are compacted into the first day of
+-- their month.
+
+CREATE TABLE movie_downloads_daily(
+        path VARCHAR(767) NOT NULL,
+        name VARCHAR(767) NOT NULL,
+        day DATE NOT NULL,
+        downloads BIGINT UNSIGNED NOT NULL DEFAULT 0,
+        PRIMARY KEY (path, name, day),
+        KEY day(day)
+        );
+
+CREATE TABLE library_downloads_daily(
+        path VARCHAR(767) NOT NULL,
+        day DATE NOT NULL,
+        downloads BIGINT UNSIGNED NOT NULL DEFAULT 0,
+        PRIMARY KEY (path, day),
+        KEY day(day)
+        );
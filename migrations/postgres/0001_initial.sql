@@ -0,0 +1,96 @@
+-- The initial schema. Timestamps are stored with their time zone, so
+-- that comparisons with CURRENT_TIMESTAMP don't depend on the
+-- session's.
+
+CREATE TABLE movies(
+        path TEXT NOT NULL,
+        name TEXT NOT NULL,
+        downloads BIGINT NOT NULL DEFAULT 0,
+        PRIMARY KEY (path, name)
+        );
+
+CREATE INDEX movies_downloads ON movies(downloads);
+
+CREATE TABLE users(
+        username TEXT NOT NULL PRIMARY KEY,
+        password_hash TEXT NOT NULL,
+        created TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_login TIMESTAMPTZ NULL DEFAULT NULL
+        );
+
+CREATE TABLE user_groups(
+        group_name TEXT NOT NULL,
+        username TEXT NOT NULL,
+        PRIMARY KEY (group_name, username)
+        );
+
+CREATE INDEX user_groups_username ON user_groups(username);
+
+CREATE TABLE library_acl(
+        principal_type TEXT NOT NULL,
+        principal TEXT NOT NULL,
+        library TEXT NOT NULL,
+        PRIMARY KEY (principal_type, principal, library)
+        );
+
+CREATE TABLE api_tokens(
+        id BIGSERIAL PRIMARY KEY,
+        username TEXT NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        scope TEXT NOT NULL,
+        created TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_used TIMESTAMPTZ NULL DEFAULT NULL
+        );
+
+CREATE INDEX api_tokens_username ON api_tokens(username);
+
+CREATE TABLE account_locks(
+        username TEXT NOT NULL PRIMARY KEY,
+        locked_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+
+CREATE TABLE sessions(
+        id TEXT NOT NULL PRIMARY KEY,
+        username TEXT NOT NULL,
+        created TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_seen TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        ip TEXT NOT NULL,
+        user_agent TEXT NOT NULL DEFAULT ''
+        );
+
+CREATE INDEX sessions_username ON sessions(username);
+
+CREATE INDEX sessions_expires ON sessions(expires);
+
+CREATE TABLE share_links(
+        id BIGSERIAL PRIMARY KEY,
+        creator TEXT NOT NULL,
+        library TEXT NOT NULL,
+        name TEXT NOT NULL,
+        created TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        max_downloads BIGINT NULL DEFAULT NULL,
+        downloads BIGINT NOT NULL DEFAULT 0
+        );
+
+CREATE INDEX share_links_creator ON share_links(creator);
+
+CREATE TABLE download_events(
+        id BIGSERIAL PRIMARY KEY,
+        username TEXT NOT NULL,
+        library TEXT NOT NULL,
+        name TEXT NOT NULL,
+        started TIMESTAMPTZ(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        finished TIMESTAMPTZ(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        bytes BIGINT NOT NULL DEFAULT 0,
+        status SMALLINT NOT NULL,
+        range_header TEXT NULL DEFAULT NULL,
+        ip TEXT NOT NULL
+        );
+
+CREATE INDEX download_events_started ON download_events(started);
+
+CREATE INDEX download_events_username ON download_events(username, started);
+
+CREATE INDEX download_events_library ON download_events(library, started);
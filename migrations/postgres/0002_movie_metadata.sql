@@ -0,0 +1,12 @@
+-- The size, modification time, type and directory flag of each movie.
+-- The indexer fills them in for existing movies on its next run.
+
+ALTER TABLE movies
+        ADD COLUMN size BIGINT NOT NULL DEFAULT 0,
+        ADD COLUMN mtime TIMESTAMPTZ NULL DEFAULT NULL,
+        ADD COLUMN is_dir BOOLEAN NOT NULL DEFAULT FALSE,
+        ADD COLUMN mime TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX movies_size ON movies(size);
+
+CREATE INDEX movies_mtime ON movies(mtime);
@@ -0,0 +1,7 @@
+-- A fingerprint of each movie's contents, which lets the indexer tell
+-- a renamed or moved movie from a new one. The indexer fills it in for
+-- existing movies on its next run.
+
+ALTER TABLE movies ADD COLUMN fingerprint TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX movies_fingerprint ON movies(fingerprint);
@@ -0,0 +1,96 @@
+-- The schema as it was before migrations were introduced. Every
+-- statement is idempotent, so databases created by the old
+-- setup_sqlite.sql adopt it without changes.
+
+CREATE TABLE IF NOT EXISTS movies(
+        path TEXT NOT NULL,
+        name TEXT NOT NULL,
+        downloads INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (path, name)
+        );
+
+CREATE INDEX IF NOT EXISTS movies_downloads ON movies(downloads);
+
+CREATE TABLE IF NOT EXISTS users(
+        username TEXT NOT NULL PRIMARY KEY,
+        password_hash TEXT NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_login TIMESTAMP NULL DEFAULT NULL
+        );
+
+CREATE TABLE IF NOT EXISTS user_groups(
+        group_name TEXT NOT NULL,
+        username TEXT NOT NULL,
+        PRIMARY KEY (group_name, username)
+        );
+
+CREATE INDEX IF NOT EXISTS user_groups_username ON user_groups(username);
+
+CREATE TABLE IF NOT EXISTS library_acl(
+        principal_type TEXT NOT NULL,
+        principal TEXT NOT NULL,
+        library TEXT NOT NULL,
+        PRIMARY KEY (principal_type, principal, library)
+        );
+
+CREATE TABLE IF NOT EXISTS api_tokens(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        username TEXT NOT NULL,
+        token_hash TEXT NOT NULL UNIQUE,
+        scope TEXT NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_used TIMESTAMP NULL DEFAULT NULL
+        );
+
+CREATE INDEX IF NOT EXISTS api_tokens_username ON api_tokens(username);
+
+CREATE TABLE IF NOT EXISTS account_locks(
+        username TEXT NOT NULL PRIMARY KEY,
+        locked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        );
+
+CREATE TABLE IF NOT EXISTS sessions(
+        id TEXT NOT NULL PRIMARY KEY,
+        username TEXT NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_seen TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        ip TEXT NOT NULL,
+        user_agent TEXT NOT NULL DEFAULT ''
+        );
+
+CREATE INDEX IF NOT EXISTS sessions_username ON sessions(username);
+
+CREATE INDEX IF NOT EXISTS sessions_expires ON sessions(expires);
+
+CREATE TABLE IF NOT EXISTS share_links(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        creator TEXT NOT NULL,
+        library TEXT NOT NULL,
+        name TEXT NOT NULL,
+        created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        expires TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        max_downloads INTEGER NULL DEFAULT NULL,
+        downloads INTEGER NOT NULL DEFAULT 0
+        );
+
+CREATE INDEX IF NOT EXISTS share_links_creator ON share_links(creator);
+
+CREATE TABLE IF NOT EXISTS download_events(
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        username TEXT NOT NULL,
+        library TEXT NOT NULL,
+        name TEXT NOT NULL,
+        started TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        finished TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        bytes INTEGER NOT NULL DEFAULT 0,
+        status INTEGER NOT NULL,
+        range_header TEXT NULL DEFAULT NULL,
+        ip TEXT NOT NULL
+        );
+
+CREATE INDEX IF NOT EXISTS download_events_started ON download_events(started);
+
+CREATE INDEX IF NOT EXISTS download_events_username ON download_events(username, started);
+
+CREATE INDEX IF NOT EXISTS download_events_library ON download_events(library, started);
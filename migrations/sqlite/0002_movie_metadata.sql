@@ -0,0 +1,14 @@
+-- The size, modification time, type and directory flag of each movie.
+-- The indexer fills them in for existing movies on its next run.
+
+ALTER TABLE movies ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE movies ADD COLUMN mtime TIMESTAMP NULL DEFAULT NULL;
+
+ALTER TABLE movies ADD COLUMN is_dir BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE movies ADD COLUMN mime TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX movies_size ON movies(size);
+
+CREATE INDEX movies_mtime ON movies(mtime);
@@ -0,0 +1,22 @@
+-- Download counts per day, of each movie and of each library. Days
+-- older than -stats-day-retention are compacted into the first day of
+-- their month.
+
+CREATE TABLE movie_downloads_daily(
+        path TEXT NOT NULL,
+        name TEXT NOT NULL,
+        day DATE NOT NULL,
+        downloads INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (path, name, day)
+        );
+
+CREATE INDEX movie_downloads_daily_day ON movie_downloads_daily(day);
+
+CREATE TABLE library_downloads_daily(
+        path TEXT NOT NULL,
+        day DATE NOT NULL,
+        downloads INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (path, day)
+        );
+
+CREATE INDEX library_downloads_daily_day ON library_downloads_daily(day);
@@ -0,0 +1,114 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of the schema migrations
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements(`-- A comment
+CREATE TABLE a(
+        x INT
+        );
+
+-- Another comment
+ALTER TABLE a ADD COLUMN y INT;
+DROP TABLE b`)
+	expect(t, "statements", statements, []string{
+		"CREATE TABLE a(\n        x INT\n        )",
+		"ALTER TABLE a ADD COLUMN y INT",
+		"DROP TABLE b",
+	})
+}
+
+func TestLoadMigrations(t *testing.T) {
+	for _, dialect := range []string{mysqlBackend, postgresBackend, sqliteBackend} {
+		migrations, err := loadMigrations(dialect)
+		check(t, err)
+		if len(migrations) == 0 || migrations[0].Name != "initial" {
+			t.Errorf("%s migrations: got %v, want an initial migration first", dialect, migrations)
+		}
+		for _, m := range migrations {
+			if len(m.Statements) == 0 {
+				t.Errorf("%s migration %d (%s) has no statements", dialect, m.Version, m.Name)
+			}
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "movieserver.db")
+	s, err := openSQLiteStore(filename, false)
+	check(t, err)
+	applied, err := s.appliedMigrations()
+	check(t, err)
+	expect(t, "versions before migrating", len(applied), 0)
+	check(t, s.migrate())
+	check(t, s.NewUser("bob", "hash"))
+	check(t, s.Close())
+
+	// Migrating again changes nothing
+	s, err = openSQLiteStore(filename, true)
+	check(t, err)
+	defer s.Close()
+	migrations, err := loadMigrations(sqliteBackend)
+	check(t, err)
+	applied, err = s.appliedMigrations()
+	check(t, err)
+	if len(applied) != len(migrations) {
+		t.Fatalf("applied migrations: got %v, want %d", applied, len(migrations))
+	}
+	for i, m := range migrations {
+		expect(t, "applied version", []interface{}{applied[i].Version, applied[i].Name}, []interface{}{m.Version, m.Name})
+	}
+	_, ok, err := s.PasswordHash("bob")
+	check(t, err)
+	expect(t, "user kept", ok, true)
+
+	// Databases from a newer server are left alone
+	_, err = s.db.Exec(s.stmt("addSchemaVersion"), len(migrations)+1, "from_the_future")
+	check(t, err)
+	if err := s.migrate(); err == nil {
+		t.Error("Migrating a newer database succeeded")
+	}
+}
+
+func TestLoginPasswords(t *testing.T) {
+	s, err := openSQLiteStore(filepath.Join(t.TempDir(), "movieserver.db"), true)
+	check(t, err)
+	defer s.Close()
+	_, err = s.db.Exec("CREATE TABLE login(user VARCHAR(50), password VARCHAR(50), PRIMARY KEY (user, password))")
+	check(t, err)
+	_, err = s.db.Exec("INSERT INTO login VALUES ('bob', 'b'), ('alice', 'a1'), ('carol', 'c'), ('alice', 'a2')")
+	check(t, err)
+	if _, _, err := s.loginPasswords(); err == nil || !strings.Contains(err.Error(), "alice") || strings.Contains(err.Error(), "bob") {
+		t.Errorf("Expected an error naming only alice, got %v", err)
+	}
+
+	_, err = s.db.Exec("DELETE FROM login WHERE user = 'alice' AND password = 'a2'")
+	check(t, err)
+	users, passwords, err := s.loginPasswords()
+	check(t, err)
+	sort.Strings(users)
+	expect(t, "login users", users, []string{"alice", "bob", "carol"})
+	expect(t, "login passwords", passwords, map[string]string{"alice": "a1", "bob": "b", "carol": "c"})
+}
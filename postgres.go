@@ -0,0 +1,106 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// The PostgreSQL backend. It runs the same statements as the MySQL
+// backend, with numbered placeholders and Postgres's spelling of the
+// few things MySQL does its own way.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
+	"time"
+)
+
+// Returns the statements of buildSQLMap, changed where Postgres's
+// dialect differs from MySQL's
+func buildPostgresMap() map[string]string {
+	sqlStatements := buildSQLMap()
+	for _, name := range []string{"grantLibrary", "addGroupMember", "lockAccount"} {
+		sqlStatements[name] = "INSERT" + sqlStatements[name][len("INSERT IGNORE"):] + " ON CONFLICT DO NOTHING"
+	}
+	useOnConflictUpserts(sqlStatements)
+	// Postgres has no LastInsertId, so the new id is returned
+	// by the insert itself
+	sqlStatements["newShareLink"] += " RETURNING id"
+	sqlStatements["createSchemaVersion"] = `CREATE TABLE IF NOT EXISTS schema_version(version INT NOT NULL PRIMARY KEY,
+name TEXT NOT NULL, applied TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP)`
+	// Moves the id sequence of the first table past the largest id
+	// in the second (the same table), after an import
+	sqlStatements["resetIDSequence"] = "SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s"
+	return sqlStatements
+}
+
+// Returns timestamps in UTC, like the other backends, rather than in
+// the server's local time zone
+func scanTimesInUTC(ctx context.Context, conn *pgx.Conn) error {
+	conn.TypeMap().RegisterType(&pgtype.Type{
+		Name:  "timestamptz",
+		OID:   pgtype.TimestamptzOID,
+		Codec: &pgtype.TimestamptzCodec{ScanLocation: time.UTC},
+	})
+	return nil
+}
+
+// Connects to the Postgres database described by dsn, which can be a
+// URL or a list of key=value settings as understood by libpq. Unlike
+// the MySQL backend, it doesn't create the database, which has to
+// exist already.
+func connectPostgres(dsn string) (*sql.DB, error) {
+	cfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := stdlib.OpenDB(*cfg, stdlib.OptionAfterConnect(scanTimesInUTC))
+	db.SetMaxOpenConns(*dbMaxOpenConns)
+	db.SetMaxIdleConns(*dbMaxIdleConns)
+	db.SetConnMaxLifetime(*dbConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Opens the Postgres database described by dsn, applying any pending
+// schema migrations if migrate is true. Postgres reads at read
+// committed by default, so the reads that have to agree with each
+// other are run at repeatable read, which is what MySQL defaults to.
+func openPostgresStore(dsn string, migrate bool) (*sqlStore, error) {
+	db, err := connectPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{
+		db:             db,
+		stmts:          buildPostgresMap(),
+		nameLike:       "name ILIKE ?",
+		dialect:        postgresBackend,
+		numberedParams: true,
+		returningIDs:   true,
+		readTxOptions:  &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+	}
+	if migrate {
+		if err := s.migrate(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
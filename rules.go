@@ -0,0 +1,291 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Per-library rules for which files the indexer indexes and directory
+// downloads archive, given with the library-rule flag
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The rules of a library. The zero value indexes every file except
+// dotfiles.
+type fileRules struct {
+	// Lowercase extensions, with the dot. If there are any, files
+	// with other extensions are skipped.
+	Include map[string]bool
+	// Glob patterns, as in filepath.Match, of files and directories
+	// to skip. They are matched against the base name and the path
+	// relative to the library.
+	Exclude []string
+	// Files smaller than this are skipped
+	MinSize int64
+	// Whether dotfiles are included
+	Hidden bool
+	// Which symlinks are followed. The others are skipped.
+	Symlinks symlinkPolicy
+}
+
+// The names of the symlink policies in rules
+var symlinkPolicies = map[string]symlinkPolicy{
+	"deny":   symlinksDeny,
+	"within": symlinksWithin,
+	"allow":  symlinksAllow,
+}
+
+// Maps library keys to their rules
+type fileRulesMap map[string]*fileRules
+
+func (m *fileRulesMap) String() string {
+	keys := make([]string, 0, len(*m))
+	for key := range *m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var rules []string
+	for _, key := range keys {
+		r := (*m)[key]
+		var include []string
+		for ext := range r.Include {
+			include = append(include, ext)
+		}
+		sort.Strings(include)
+		var symlinks string
+		for name, policy := range symlinkPolicies {
+			if policy == r.Symlinks {
+				symlinks = name
+			}
+		}
+		rules = append(rules, fmt.Sprintf("%s:{include=%s exclude=%s min-size=%d hidden=%t symlinks=%s}",
+			key, strings.Join(include, ","), strings.Join(r.Exclude, ","), r.MinSize, r.Hidden, symlinks))
+	}
+	return strings.Join(rules, " ")
+}
+
+// Adds a rule given as [name]:[rule]=[value], where the rule is
+// include (comma-separated extensions), exclude (a glob pattern),
+// min-size (bytes, with an optional K, M, G or T suffix), hidden (a
+// boolean) or symlinks (deny, within or allow). include and exclude
+// add to the rules before them.
+func (m *fileRulesMap) Set(s string) error {
+	eq := strings.Index(s, "=")
+	if eq == -1 {
+		return fmt.Errorf("Rule is not of the form [name]:[rule]=[value]")
+	}
+	colon := strings.LastIndex(s[:eq], ":")
+	if colon == -1 {
+		return fmt.Errorf("Rule is not of the form [name]:[rule]=[value]")
+	}
+	key, rule, value := s[:colon], s[colon+1:eq], s[eq+1:]
+	if strings.Index(key, "/") != -1 {
+		return fmt.Errorf("Key cannot include a slash")
+	}
+	r, ok := (*m)[key]
+	if !ok {
+		r = &fileRules{Include: make(map[string]bool)}
+	}
+	switch rule {
+	case "include":
+		for _, ext := range strings.Split(value, ",") {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" {
+				continue
+			}
+			if ext[0] != '.' {
+				ext = "." + ext
+			}
+			r.Include[ext] = true
+		}
+	case "exclude":
+		if _, err := filepath.Match(value, ""); err != nil {
+			return fmt.Errorf("Invalid exclude pattern %s: %s", value, err)
+		}
+		r.Exclude = append(r.Exclude, value)
+	case "min-size":
+		size, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		r.MinSize = size
+	case "hidden":
+		hidden, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid hidden setting: %s", value)
+		}
+		r.Hidden = hidden
+	case "symlinks":
+		policy, ok := symlinkPolicies[value]
+		if !ok {
+			return fmt.Errorf("Invalid symlinks setting %s (\"deny\", \"within\" or \"allow\")", value)
+		}
+		r.Symlinks = policy
+	default:
+		return fmt.Errorf("Unknown rule %s", rule)
+	}
+	(*m)[key] = r
+	return nil
+}
+
+// The suffixes parseSize understands
+var sizeSuffixes = map[string]int64{"": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40}
+
+// Parses a number of bytes with an optional K, M, G or T suffix (as
+// powers of 1024), which can be followed by B or iB
+func parseSize(s string) (int64, error) {
+	lower := strings.ToLower(strings.TrimSpace(s))
+	lower = strings.TrimSuffix(strings.TrimSuffix(lower, "b"), "i")
+	i := len(lower)
+	for i > 0 && (lower[i-1] < '0' || lower[i-1] > '9') {
+		i--
+	}
+	multiplier, ok := sizeSuffixes[lower[i:]]
+	n, err := strconv.ParseInt(lower[:i], 10, 64)
+	if !ok || err != nil || n < 0 || n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("Invalid size: %s", s)
+	}
+	return n * multiplier, nil
+}
+
+// Checks that every library with rules is being served
+func checkLibraryRules() error {
+	for key := range libraryRules {
+		if _, ok := moviePaths[key]; !ok {
+			return fmt.Errorf("There are rules for %s, which isn't a path being served", key)
+		}
+	}
+	return nil
+}
+
+// Returns an error unless every symlink on the way from the library at
+// moviePath to a path in it may be followed, so that the handlers
+// serve what the indexer follows. The library itself may be a
+// symlink. Components that don't exist end the check.
+func (r *fileRules) checkLinks(moviePath, path string) error {
+	relpath, err := filepath.Rel(moviePath, path)
+	if err != nil || relpath == ".." || strings.HasPrefix(relpath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", path, moviePath)
+	}
+	if relpath == "." {
+		return nil
+	}
+	var realRoot string
+	dir := moviePath
+	for _, part := range strings.Split(relpath, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if r.Symlinks == symlinksDeny {
+			return fmt.Errorf("%s is a symlink", dir)
+		}
+		if r.Symlinks == symlinksWithin {
+			target, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				return err
+			}
+			if realRoot == "" {
+				if realRoot, err = filepath.EvalSymlinks(moviePath); err != nil {
+					return err
+				}
+			}
+			if target != realRoot && !strings.HasPrefix(target, realRoot+string(filepath.Separator)) {
+				return fmt.Errorf("%s points outside %s", dir, moviePath)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns true if a walk of the library at moviePath with the filter
+// would reach a path in it, because the path and every directory
+// above it pass the filter. Symlinks on the way are followed, so the
+// links should be checked with checkLinks first.
+func reachable(moviePath, path string, filter filterFunc) bool {
+	relpath, err := filepath.Rel(moviePath, path)
+	if err != nil || relpath == ".." || strings.HasPrefix(relpath, ".."+string(filepath.Separator)) {
+		return false
+	}
+	dir := moviePath
+	parts := []string{"."}
+	if relpath != "." {
+		parts = append(parts, strings.Split(relpath, string(filepath.Separator))...)
+	}
+	for _, part := range parts {
+		dir = filepath.Join(dir, part)
+		info, err := os.Stat(dir)
+		if err != nil || !filter(filePair{dir, info}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the rules of the library at a path, which are the zero
+// value if it has none
+func rulesForPath(moviePath string) *fileRules {
+	for key, path := range moviePaths {
+		if r, ok := libraryRules[key]; ok && path == moviePath {
+			return r
+		}
+	}
+	return &fileRules{}
+}
+
+// Returns true if a file or directory in the library at moviePath
+// passes the rules. Symlinks never do, so walks that follow them pass
+// what they point to instead. Otherwise the library itself always
+// does. Include and min-size only apply to files.
+func (r *fileRules) allows(moviePath string, fp filePair) bool {
+	if fp.fi.Mode()&os.ModeSymlink > 0 {
+		return false
+	}
+	if fp.path == moviePath {
+		return true
+	}
+	name := filepath.Base(fp.path)
+	if name[0] == '.' && !r.Hidden {
+		return false
+	}
+	relpath, err := filepath.Rel(moviePath, fp.path)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range r.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern, relpath); ok {
+			return false
+		}
+	}
+	if fp.fi.IsDir() {
+		return true
+	}
+	if len(r.Include) > 0 && !r.Include[strings.ToLower(filepath.Ext(name))] {
+		return false
+	}
+	return fp.fi.Size() >= r.MinSize
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of the per-library file rules
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"0": 0, "100": 100, "100B": 100, "4k": 4 << 10, "50M": 50 << 20, "50MB": 50 << 20, "2GiB": 2 << 30, "1T": 1 << 40,
+	} {
+		size, err := parseSize(s)
+		check(t, err)
+		expect(t, s, size, want)
+	}
+	for _, s := range []string{"", "M", "-1", "1.5G", "10X", "9999999999T"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("Parsed invalid size %q", s)
+		}
+	}
+}
+
+func TestFileRulesMap(t *testing.T) {
+	m := make(fileRulesMap)
+	for _, rule := range []string{
+		"a:include=mkv, .MP4", "a:include=.srt", "a:exclude=*sample*", "a:exclude=Extras/*",
+		"a:min-size=1K", "a:hidden=true", "a:symlinks=within", "tv:shows:exclude=*.nfo",
+	} {
+		check(t, m.Set(rule))
+	}
+	expect(t, "includes", m["a"].Include, map[string]bool{".mkv": true, ".mp4": true, ".srt": true})
+	expect(t, "excludes", m["a"].Exclude, []string{"*sample*", "Extras/*"})
+	expect(t, "min size", m["a"].MinSize, int64(1<<10))
+	expect(t, "hidden", m["a"].Hidden, true)
+	expect(t, "symlinks", m["a"].Symlinks, symlinksWithin)
+	expect(t, "default symlinks", m["tv:shows"].Symlinks, symlinksDeny)
+	expect(t, "key with a colon", m["tv:shows"].Exclude, []string{"*.nfo"})
+	for _, rule := range []string{"a", "a=b", "a:bogus=1", "a:exclude=[", "a:min-size=big", "a:hidden=maybe", "a:symlinks=sometimes", "a/b:hidden=true"} {
+		if err := m.Set(rule); err == nil {
+			t.Errorf("Set invalid rule %q", rule)
+		}
+	}
+}
+
+// Returns the names of the files a tar of a directory in the library
+// has
+func tarNames(t *testing.T, dir string) []string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	check(t, tarDir(moviePaths["a"], filepath.Join(moviePaths["a"], dir), tw))
+	check(t, tw.Close())
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		check(t, err)
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLibraryRules(t *testing.T) {
+	oldRules := libraryRules
+	libraryRules = make(fileRulesMap)
+	defer func() { libraryRules = oldRules }()
+	files := map[string]string{
+		"Alien/Alien.mkv":          "alien, the movie",
+		"Alien/Alien.nfo":          "info about alien",
+		"Alien/Alien.srt":          "subtitles",
+		"Alien/alien-sample.mkv":   "a sample of alien",
+		"Alien/.thumbs/poster.mkv": "not a movie at all",
+		"Alien/Extras/trailer.mkv": "a trailer of alien",
+		"Brazil.mkv":               "brazil",
+	}
+	setupTestLibrary(t, files)
+	expect(t, "default index", len(libraryCounts(t)), 9)
+
+	for _, rule := range []string{"a:include=.mkv,.srt", "a:exclude=*sample*", "a:exclude=Alien/Extras", "a:min-size=8", "a:hidden=true"} {
+		check(t, libraryRules.Set(rule))
+	}
+	check(t, checkLibraryRules())
+	check(t, indexMovies("Test Indexer"))
+	expect(t, "index with rules", movieNames(libraryCounts(t)), []string{
+		".", "Alien", "Alien/.thumbs", "Alien/.thumbs/poster.mkv", "Alien/Alien.mkv", "Alien/Alien.srt",
+	})
+	expect(t, "tar with rules", tarNames(t, "Alien"), []string{"Alien/.thumbs/poster.mkv", "Alien/Alien.mkv", "Alien/Alien.srt"})
+	expect(t, "library size", movieMap[moviePaths["a"]]["."].Size,
+		uint64(len(files["Alien/Alien.mkv"])+len(files["Alien/Alien.srt"])+len(files["Alien/.thumbs/poster.mkv"])))
+
+	// Files the rules skip aren't served either, while files that
+	// aren't indexed yet are
+	for name, code := range map[string]int{
+		"Alien/Alien.mkv": http.StatusOK, "Alien/Alien.nfo": http.StatusNotFound,
+		"Alien/alien-sample.mkv": http.StatusNotFound, "Alien/Extras/trailer.mkv": http.StatusNotFound,
+		"Alien/Extras": http.StatusNotFound, "Brazil.mkv": http.StatusNotFound,
+	} {
+		expect(t, name+" status", serveAs(movieHandler, "bob", movieURL+"a/"+name).Code, code)
+	}
+	check(t, ioutil.WriteFile(filepath.Join(moviePaths["a"], "Casablanca.mkv"), []byte("casablanca"), 0644))
+	expect(t, "unindexed file status", serveAs(movieHandler, "bob", movieURL+"a/Casablanca.mkv").Code, http.StatusOK)
+
+	check(t, libraryRules.Set("b:hidden=true"))
+	if err := checkLibraryRules(); err == nil {
+		t.Error("Rules for a library that isn't served were accepted")
+	}
+}
+
+func TestLibrarySymlinks(t *testing.T) {
+	oldRules := libraryRules
+	libraryRules = make(fileRulesMap)
+	defer func() { libraryRules = oldRules }()
+	setupTestLibrary(t, map[string]string{
+		"Alien/Alien.mkv": "alien",
+		"Brazil.mkv":      "brazil",
+	})
+	dir, outside := moviePaths["a"], t.TempDir()
+	check(t, ioutil.WriteFile(filepath.Join(outside, "Casablanca.mkv"), []byte("casablanca"), 0644))
+	for link, target := range map[string]string{
+		"Aliens":          "Alien",
+		"Alien/loop":      "..",
+		"Brazil-link.mkv": "Brazil.mkv",
+		"broken.mkv":      "missing.mkv",
+		"Outside":         outside,
+	} {
+		check(t, os.Symlink(target, filepath.Join(dir, link)))
+	}
+
+	// By default, symlinks are neither indexed nor served
+	check(t, indexMovies("Test Indexer"))
+	expect(t, "index without symlinks", movieNames(libraryCounts(t)), []string{".", "Alien", "Alien/Alien.mkv", "Brazil.mkv"})
+	w := serveAs(movieHandler, "bob", movieURL+"a/Aliens/Alien.mkv")
+	expect(t, "symlink status without symlinks", w.Code, http.StatusNotFound)
+
+	// Links inside the library are followed with within, except for
+	// the ones that loop back to a directory they're in
+	check(t, libraryRules.Set("a:symlinks=within"))
+	check(t, indexMovies("Test Indexer"))
+	expect(t, "index with symlinks within", movieNames(libraryCounts(t)), []string{
+		".", "Alien", "Alien/Alien.mkv", "Aliens", "Aliens/Alien.mkv", "Brazil-link.mkv", "Brazil.mkv",
+	})
+	expect(t, "tar with symlinks within", tarNames(t, "Aliens"), []string{"Aliens/Alien.mkv"})
+	w = serveAs(movieHandler, "bob", movieURL+"a/Aliens/Alien.mkv")
+	expect(t, "symlink status with symlinks within", w.Code, http.StatusOK)
+	expect(t, "symlink body", w.Body.String(), "alien")
+	w = serveAs(movieHandler, "bob", movieURL+"a/Outside/Casablanca.mkv")
+	expect(t, "outside symlink status with symlinks within", w.Code, http.StatusNotFound)
+
+	// And links outside it with allow
+	check(t, libraryRules.Set("a:symlinks=allow"))
+	check(t, indexMovies("Test Indexer"))
+	expect(t, "index with symlinks allowed", movieNames(libraryCounts(t)), []string{
+		".", "Alien", "Alien/Alien.mkv", "Aliens", "Aliens/Alien.mkv", "Brazil-link.mkv", "Brazil.mkv",
+		"Outside", "Outside/Casablanca.mkv",
+	})
+	expect(t, "library size", movieMap[dir]["."].Size, uint64(len("alien")*2+len("brazil")*2+len("casablanca")))
+	w = serveAs(movieHandler, "bob", movieURL+"a/Outside/Casablanca.mkv")
+	expect(t, "outside symlink status with symlinks allowed", w.Code, http.StatusOK)
+}
@@ -26,6 +26,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
 const (
@@ -33,8 +34,7 @@ const (
 	// be printed
 	vLevel = 1
 	// The info level for extra verbose statements
-	vvLevel      = 2
-	databaseName = "movieserver"
+	vvLevel = 2
 )
 
 // Looks through all the gopaths to find a possible location for the
@@ -88,11 +88,44 @@ func (p *moviePathMap) Set(s string) error {
 }
 
 var (
-	srcPath       = flag.String("src-path", srcdir(), "The path of the movieserver source directory")
-	moviePaths    = make(moviePathMap)
-	port          = flag.Uint64("port", 8080, "The port to listen on")
-	mysqlPort     = flag.Uint64("mysql-port", 3306, "The port to connect to MySQL on")
-	refreshSchema = flag.Bool("refresh-schema", false, "If true, the server will drop and recreate the database schema")
+	srcPath              = flag.String("src-path", srcdir(), "The path of the movieserver source directory")
+	moviePaths           = make(moviePathMap)
+	libraryRules         = make(fileRulesMap)
+	port                 = flag.Uint64("port", 8080, "The port to listen on")
+	dbBackend            = flag.String("db-backend", mysqlBackend, "The database to store movies and users in (\"mysql\", \"postgres\", \"sqlite\" or \"memory\")")
+	sqliteFile           = flag.String("sqlite-file", "movieserver.db", "The file the sqlite db-backend keeps its database in")
+	memorySnapshot       = flag.String("memory-snapshot", "", "The JSON file the memory db-backend is snapshotted to and loaded from. If empty, everything is lost when the server exits")
+	snapshotInterval     = flag.Duration("memory-snapshot-interval", time.Minute, "How often the memory db-backend is snapshotted, if it changed")
+	mysqlHost            = flag.String("mysql-host", "127.0.0.1", "The host to connect to MySQL on")
+	mysqlPort            = flag.Uint64("mysql-port", 3306, "The port to connect to MySQL on")
+	mysqlSocket          = flag.String("mysql-socket", "", "The unix socket to connect to MySQL on. If set, mysql-host and mysql-port are ignored")
+	mysqlUser            = flag.String("mysql-user", "root", "The MySQL user to connect as")
+	mysqlPasswordFile    = flag.String("mysql-password-file", "", "A file containing the MySQL user's password. If empty, the password is read from the MOVIESERVER_MYSQL_PASSWORD environment variable")
+	mysqlDatabase        = flag.String("mysql-database", "movieserver", "The MySQL database to keep everything in. It is created if it doesn't exist and the user is allowed to")
+	mysqlTLS             = flag.String("mysql-tls", "false", "Whether to connect to MySQL over TLS (\"false\", \"true\", \"skip-verify\" or \"preferred\")")
+	mysqlTLSCA           = flag.String("mysql-tls-ca", "", "A PEM file of the CA certificates to verify the MySQL server with, instead of the system's")
+	mysqlTLSCert         = flag.String("mysql-tls-cert", "", "A PEM file of the client certificate to present to the MySQL server")
+	mysqlTLSKey          = flag.String("mysql-tls-key", "", "A PEM file of the key of mysql-tls-cert")
+	postgresDSN          = flag.String("postgres-dsn", "dbname=movieserver", "The PostgreSQL database to keep everything in, as a URL or libpq key=value settings. The database must already exist")
+	dbMaxOpenConns       = flag.Int("db-max-open-conns", 0, "The most connections to open to the database server (0 is unlimited)")
+	dbMaxIdleConns       = flag.Int("db-max-idle-conns", 2, "The most idle connections to keep open to the database server")
+	dbConnMaxLifetime    = flag.Duration("db-conn-max-lifetime", 0, "How long a connection to the database server is reused before it is closed (0 is forever)")
+	sessionKeyFile       = flag.String("session-key-file", "", "A file containing the secret (at least 32 bytes) used to sign session cookies. If empty, a random key is generated on startup")
+	sessionTimeout       = flag.Duration("session-timeout", 24*time.Hour, "How long a login session lasts before the user has to log in again")
+	loginMaxFailures     = flag.Int("login-max-failures", 5, "The number of failed logins within login-failure-window that locks an account (0 never locks)")
+	loginFailureWindow   = flag.Duration("login-failure-window", 15*time.Minute, "The window over which failed logins are counted")
+	loginBackoff         = flag.Duration("login-backoff", time.Second, "How long an IP or username must wait after a failed login. The wait doubles with every failure within login-failure-window")
+	loginMaxBackoff      = flag.Duration("login-max-backoff", time.Minute, "The longest an IP or username must wait after a failed login")
+	basicAuth            = flag.Bool("basic-auth", false, "If true, the table and movie handlers also accept HTTP Basic credentials, for media players and download managers. Basic credentials are sent in the clear unless the server is behind TLS")
+	shareExpiry          = flag.Duration("share-expiry", 24*time.Hour, "How long share links last by default")
+	shareMaxExpiry       = flag.Duration("share-max-expiry", 30*24*time.Hour, "The longest a share link can last")
+	statsDayRetention    = flag.Duration("stats-day-retention", 90*24*time.Hour, "How long download statistics are kept per day. After that, they're compacted into one count per month")
+	defaultLibraryAccess = flag.String("default-library-access", "all", "The libraries a user can access if they haven't been granted any (\"all\" or \"none\")")
+	watchLibraries       = flag.Bool("watch-libraries", true, "If true, the indexer watches the libraries for changes (only on Linux, with inotify) and only indexes what changed, instead of walking every library every few seconds")
+	rescanInterval       = flag.Duration("rescan-interval", time.Hour, "How often the indexer walks every library in full while it watches them, in case the watcher missed anything")
+	indexBatchSize       = flag.Int("index-batch-size", 100, "The most movies the indexer inserts or deletes in one statement (0 is unlimited). SQLite builds older than 3.32 can't take more than 142")
+	indexCommitSize      = flag.Int("index-commit-size", 0, "If positive, the indexer commits its database writes every this many movies instead of in one transaction, so that indexing a huge library doesn't hold a transaction open the whole time")
+	walkWorkers          = flag.Int("walk-workers", 8, "How many directories of each library the indexer lists at once. Raise it for libraries on network mounts, where every listing waits on the server")
 )
 
 // Sets everything up and listens on the given port
@@ -106,6 +139,10 @@ func startupServer() {
 	for k, _ := range moviePaths {
 		moviePaths[k] = filepath.Clean(moviePaths[k])
 	}
+	if err := checkLibraryRules(); err != nil {
+		glog.Error(err)
+		return
+	}
 
 	glog.V(vLevel).Info("Setting up SQL schema")
 	if err := startupDB(); err != nil {
@@ -119,7 +156,13 @@ func startupServer() {
 	}
 
 	glog.V(vLevel).Info("Fetching html templates")
-	if err := fetchTemplates("login"); err != nil {
+	if err := fetchTemplates("login", "sessions"); err != nil {
+		glog.Error(err)
+		return
+	}
+
+	glog.V(vLevel).Info("Setting up the session key")
+	if err := setupSessionKey(); err != nil {
 		glog.Error(err)
 		return
 	}
@@ -137,26 +180,63 @@ func startupServer() {
 // Calls all the cleanup functions and flushes the log
 func cleanupServer() {
 	cleanupHeartbeat()
+	if dbStore != nil {
+		cleanupDB()
+	}
 	glog.Flush()
 }
 
 func main() {
 	// Adds moviePaths as an argument
 	flag.Var(&moviePaths, "path", "Add a path to serve (Specify as a key-value pair [name]=[path])")
+	flag.Var(&libraryRules, "library-rule", "Add a rule for which files of a path are indexed and archived, as [name]:[rule]=[value]. The rules are include (comma-separated extensions), exclude (a glob pattern), min-size (bytes, with an optional K, M, G or T suffix) and hidden (whether to include dotfiles)")
 	// Sets some defaults and parses the flags
 	flag.Lookup("v").Value.Set("1")
 	flag.Lookup("v").DefValue = "1"
 	flag.Lookup("alsologtostderr").Value.Set("true")
 	flag.Lookup("alsologtostderr").DefValue = "true"
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		printCommandUsage()
+	}
 	flag.Parse()
 
+	// If there are arguments left over, they name a command to
+	// run instead of the server. Commands only log errors unless
+	// a verbosity was requested.
+	if flag.NArg() > 0 {
+		verbositySet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "v" {
+				verbositySet = true
+			}
+		})
+		if !verbositySet {
+			flag.Lookup("v").Value.Set("0")
+		}
+		err := runCommand(flag.Args())
+		if err != nil {
+			glog.Error(err)
+		}
+		glog.Flush()
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// moviePaths must hove at least one value
 	if len(moviePaths) == 0 {
 		flag.PrintDefaults()
 		glog.Error("There must be at least one path argument")
 		return
 	}
+	if *defaultLibraryAccess != "all" && *defaultLibraryAccess != "none" {
+		glog.Errorf("Invalid default-library-access %q: must be \"all\" or \"none\"", *defaultLibraryAccess)
+		return
+	}
 
 	// Makes it utilize multiple cores
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -0,0 +1,472 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Login sessions and the authentication middleware that guards the
+// handlers. A session is a row in the sessions table, named by a
+// signed cookie, so deleting the row revokes the session.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "movieserver-session"
+	// The minimum number of bytes in a session signing key
+	sessionKeyLen = 32
+)
+
+// The key used to sign session cookies. It is set by
+// setupSessionKey.
+var sessionKey []byte
+
+// Reads the session signing key from sessionKeyFile. If no file was
+// given, it generates a random key, which means sessions won't
+// survive a server restart.
+func setupSessionKey() error {
+	if *sessionKeyFile == "" {
+		glog.Warning("No session key file given: generating a random key, so sessions will not survive a restart")
+		sessionKey = make([]byte, sessionKeyLen)
+		_, err := rand.Read(sessionKey)
+		return err
+	}
+	keyBytes, err := ioutil.ReadFile(*sessionKeyFile)
+	if err != nil {
+		return err
+	}
+	keyBytes = bytes.TrimSpace(keyBytes)
+	if len(keyBytes) < sessionKeyLen {
+		return fmt.Errorf("Session key in %s must be at least %d bytes long", *sessionKeyFile, sessionKeyLen)
+	}
+	sessionKey = keyBytes
+	return nil
+}
+
+// The contents of a session cookie. The ID is a random string that
+// names the session's row in the sessions table, where it is stored
+// hashed.
+type session struct {
+	ID      string `json:"id"`
+	User    string `json:"user"`
+	Expires int64  `json:"expires"`
+}
+
+// Returns the HMAC of the given payload under sessionKey
+func signPayload(payload []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Serializes the session into a cookie value of the form
+// [base64 payload].[base64 signature]
+func encodeSession(s session) (string, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signPayload(payload)), nil
+}
+
+// Parses a cookie value created by encodeSession, returning an error
+// if the signature doesn't match or the session has expired
+func decodeSession(value string) (session, error) {
+	var s session
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 {
+		return s, fmt.Errorf("Malformed session cookie")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return s, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return s, err
+	}
+	if !hmac.Equal(sig, signPayload(payload)) {
+		return s, fmt.Errorf("Invalid session cookie signature")
+	}
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return s, err
+	}
+	if time.Now().Unix() >= s.Expires {
+		return s, fmt.Errorf("Session for %s has expired", s.User)
+	}
+	return s, nil
+}
+
+// The longest user agent stored in the sessions table
+const maxUserAgentLen = 512
+
+// Records a new session for the given user in the sessions table and
+// sets its cookie on the response
+func startSession(w http.ResponseWriter, r *http.Request, user string) error {
+	randbuf := make([]byte, sessionKeyLen)
+	if _, err := rand.Read(randbuf); err != nil {
+		return err
+	}
+	id := base64.RawURLEncoding.EncodeToString(randbuf)
+	expires := time.Now().Add(*sessionTimeout)
+	value, err := encodeSession(session{ID: id, User: user, Expires: expires.Unix()})
+	if err != nil {
+		return err
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLen {
+		userAgent = userAgent[:maxUserAgentLen]
+	}
+	if err := dbStore.NewSession(hashToken(id), user, expires, remoteIP(r), userAgent); err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Clears the session cookie on the client
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the user named by the request's session cookie and the
+// hashed ID of the session, recording that the session was seen. If
+// there is no valid cookie, or the session was revoked, the user is
+// empty.
+func sessionUser(r *http.Request) (string, string, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", "", nil
+	}
+	s, err := decodeSession(cookie.Value)
+	if err != nil {
+		glog.V(vvLevel).Infof("Rejecting session from %s: %s", r.RemoteAddr, err)
+		return "", "", nil
+	}
+	idHash := hashToken(s.ID)
+	if ok, err := dbStore.TouchSession(idHash, s.User); err != nil {
+		return "", "", err
+	} else if !ok {
+		glog.V(vvLevel).Infof("Rejecting revoked session for %s from %s", s.User, r.RemoteAddr)
+		return "", "", nil
+	}
+	return s.User, idHash, nil
+}
+
+// A heartbeat task that deletes expired sessions from the sessions
+// table
+func pruneSessions(name string) error {
+	rowcount, err := dbStore.DeleteExpiredSessions()
+	if err != nil {
+		return err
+	}
+	if rowcount > 0 {
+		glog.V(vvLevel).Infof("%s: deleted %d expired sessions", name, rowcount)
+	}
+	return nil
+}
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	sessionContextKey
+	// The id of the share link whose download a request counts as
+	shareContextKey
+)
+
+// Returns the authenticated user that authHandler attached to the
+// request, or an empty string for anonymous requests
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey).(string)
+	return user
+}
+
+// Returns the hashed ID of the session that authHandler attached to
+// the request, or an empty string if the request wasn't authenticated
+// by a session
+func requestSession(r *http.Request) string {
+	id, _ := r.Context().Value(sessionContextKey).(string)
+	return id
+}
+
+// Describes what authHandler does with a request that has no valid
+// credentials
+type anonymousPolicy int
+
+const (
+	// The request is passed through to the handler
+	allowAnonymous anonymousPolicy = iota
+	// The client is redirected to the login page
+	redirectAnonymous
+	// The client gets a 401
+	rejectAnonymous
+)
+
+// Describes how authHandler authenticates the requests for a handler.
+// Session cookies are always accepted.
+type authOptions struct {
+	// What happens to requests without valid credentials
+	anonymous anonymousPolicy
+	// If non-empty, API tokens with at least this scope are
+	// accepted
+	tokenScope string
+	// If true, HTTP Basic credentials are accepted when the
+	// basic-auth flag is set
+	basic bool
+	// If true, share links are accepted
+	share bool
+}
+
+const basicRealm = `Basic realm="movieserver", charset="UTF-8"`
+
+// How long verified Basic credentials are accepted without checking
+// the password again
+const basicCacheTTL = time.Minute
+
+// Basic credentials that were verified, and the password hash they
+// were verified against
+type basicCacheEntry struct {
+	hash    string
+	expires time.Time
+}
+
+// Caches verified Basic credentials, keyed by the user and an HMAC of
+// the password, so that players sending them with every range request
+// don't pay for bcrypt every time. It is safe for concurrent use.
+type basicCredentialCache struct {
+	sync.Mutex
+	entries map[string]basicCacheEntry
+}
+
+var basicCache = basicCredentialCache{entries: make(map[string]basicCacheEntry)}
+
+// Returns the key of a user's credentials, which starts with the user
+func basicCacheKey(user, password string) string {
+	return user + "\x00" + string(signPayload([]byte("basic\x00"+user+"\x00"+password)))
+}
+
+// Returns the hash the credentials were verified against, if they
+// were verified within basicCacheTTL
+func (c *basicCredentialCache) lookup(user, password string, now time.Time) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[basicCacheKey(user, password)]
+	if !ok || now.After(entry.expires) {
+		return "", false
+	}
+	return entry.hash, true
+}
+
+// Records credentials that were verified against a hash, dropping the
+// entries that have expired
+func (c *basicCredentialCache) add(user, password, hash string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[basicCacheKey(user, password)] = basicCacheEntry{hash, now.Add(basicCacheTTL)}
+}
+
+// Drops every cached credential of a user
+func (c *basicCredentialCache) forget(user string) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, user+"\x00") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Returns true if the user's credentials were verified recently
+// against the password hash the user still has, and the account
+// isn't locked. The commands that change passwords, lock accounts
+// and remove users run in processes of their own, so the cache is
+// checked against the users table instead of being told. Credentials
+// that fail the check are dropped.
+func checkBasicCache(user, password string) (bool, error) {
+	cached, ok := basicCache.lookup(user, password, time.Now())
+	if !ok {
+		return false, nil
+	}
+	hash, exists, err := dbStore.PasswordHash(user)
+	if err != nil {
+		return false, err
+	}
+	locked, err := dbStore.IsLocked(user)
+	if err != nil {
+		return false, err
+	}
+	if !exists || hash != cached || locked {
+		basicCache.forget(user)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Checks the HTTP Basic credentials of a request against the users
+// table, subject to the same throttling and lockout as the login
+// page. Credentials verified within basicCacheTTL are accepted
+// without checking the password or updating the last login time. It
+// writes an error response and returns an empty user if the
+// credentials aren't valid.
+func basicUser(w http.ResponseWriter, r *http.Request, user, password string) string {
+	if ok, err := checkBasicCache(user, password); err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return ""
+	} else if ok {
+		return user
+	}
+	// The hash is read before the password is checked, so that a
+	// password changed meanwhile isn't cached against the new hash
+	hash, _, err := dbStore.PasswordHash(user)
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return ""
+	}
+	result, wait, err := attemptLogin(r, user, password)
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to check password", http.StatusInternalServerError)
+		return ""
+	}
+	switch result {
+	case loginOK:
+		if current, _, err := dbStore.PasswordHash(user); err == nil && current == hash {
+			basicCache.add(user, password, hash, time.Now())
+		}
+		return user
+	case loginThrottled:
+		throttledError(w, wait)
+	case loginLocked:
+		http.Error(w, "This account is locked", http.StatusForbidden)
+	default:
+		w.Header().Set("WWW-Authenticate", basicRealm)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+	}
+	return ""
+}
+
+// Wraps a handler so that it authenticates the request before
+// running. A request with a bearer token is authenticated by the
+// token alone, if the handler accepts tokens. Likewise, a request
+// with Basic credentials or a share link is authenticated by them
+// alone, if the handler accepts them. Otherwise, the request is
+// authenticated by its session cookie. Authenticated users are
+// attached to the request (retrievable with requestUser), and
+// requests without valid credentials are handled according to
+// opts.anonymous.
+func authHandler(opts authOptions, handler http.HandlerFunc) http.HandlerFunc {
+	allowBasic := opts.basic && *basicAuth
+	return func(w http.ResponseWriter, r *http.Request) {
+		var user, sessionID string
+		basicName, basicPassword, hasBasic := r.BasicAuth()
+		if token, ok := bearerToken(r); ok && opts.tokenScope != "" {
+			tokenUser, scope, err := checkToken(token)
+			if err != nil {
+				glog.Error(err)
+				http.Error(w, "Failed to check token", http.StatusInternalServerError)
+				return
+			}
+			if tokenUser == "" {
+				glog.V(vLevel).Infof("Rejecting invalid token from %s", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="movieserver", error="invalid_token"`)
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			if !scopeAllows(scope, opts.tokenScope) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="movieserver", error="insufficient_scope"`)
+				http.Error(w, fmt.Sprintf("This token needs the %s scope", opts.tokenScope), http.StatusForbidden)
+				return
+			}
+			user = tokenUser
+		} else if hasBasic && allowBasic {
+			if user = basicUser(w, r, basicName, basicPassword); user == "" {
+				return
+			}
+		} else if r.URL.Query().Get("share") != "" && opts.share {
+			if user, r = shareUser(w, r); user == "" {
+				return
+			}
+		} else {
+			var err error
+			if user, sessionID, err = sessionUser(r); err != nil {
+				glog.Error(err)
+				http.Error(w, "Failed to check session", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if user == "" {
+			switch opts.anonymous {
+			case redirectAnonymous:
+				http.Redirect(w, r, loginURL, http.StatusFound)
+				return
+			case rejectAnonymous:
+				// Challenges clients like media players to
+				// send Basic credentials. Requests from
+				// the frontend's javascript aren't
+				// challenged, since that would make the
+				// browser pop up a login dialog.
+				if allowBasic && r.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+					w.Header().Set("WWW-Authenticate", basicRealm)
+				}
+				http.Error(w, "You must log in to access this page", http.StatusUnauthorized)
+				return
+			}
+		} else {
+			ctx := context.WithValue(r.Context(), userContextKey, user)
+			if sessionID != "" {
+				ctx = context.WithValue(ctx, sessionContextKey, sessionID)
+			}
+			r = r.WithContext(ctx)
+		}
+		handler(w, r)
+	}
+}
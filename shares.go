@@ -0,0 +1,297 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Share links, which let someone without an account download one
+// movie or directory. A share link is a movieURL with the id of a row
+// in the share_links table, an expiry time and an HMAC signature over
+// both and the shared path. Downloads through a link are attributed
+// to the user that created it.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A row of the share_links table
+type shareLink struct {
+	ID           uint64
+	Creator      string
+	Library      string
+	Name         string
+	Expires      time.Time
+	MaxDownloads sql.NullInt64
+	Downloads    uint64
+}
+
+// Returns the signature of a share link. The fields are separated by
+// NUL bytes, which can't appear in paths, and the "share" prefix keeps
+// the signature from being confused with a session cookie signature.
+func signShare(id uint64, library, name string, expires int64) string {
+	payload := fmt.Sprintf("share\x00%d\x00%s\x00%s\x00%d", id, library, name, expires)
+	return base64.RawURLEncoding.EncodeToString(signPayload([]byte(payload)))
+}
+
+// Returns the path and query of the URL for a share link
+func shareURLPath(link shareLink) string {
+	expires := link.Expires.Unix()
+	query := url.Values{}
+	query.Set("share", strconv.FormatUint(link.ID, 10))
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", signShare(link.ID, link.Library, link.Name, expires))
+	// A link to the whole library names the library without a
+	// trailing slash, as splitMovieURL expects
+	path := movieURL + url.PathEscape(link.Library)
+	if link.Name != "." {
+		path += "/" + (&url.URL{Path: filepath.ToSlash(link.Name)}).EscapedPath()
+	}
+	return path + "?" + query.Encode()
+}
+
+// Returns true if the link shares the file with the given name. A
+// link to a directory shares everything inside the directory as well.
+func (link shareLink) covers(library, name string) bool {
+	if library != link.Library {
+		return false
+	}
+	return link.Name == "." || name == link.Name || strings.HasPrefix(name, link.Name+string(filepath.Separator))
+}
+
+// Returns true if the request should count as a download of the
+// link. Players fetching a movie in pieces with range requests only
+// count once, when they fetch the beginning. The header is parsed the
+// way http.ServeContent parses it, and anything it would serve whole,
+// or that isn't a valid range, counts.
+func countsAsShareDownload(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	// Movies are served without an ETag or modification time, so
+	// ServeContent ignores the ranges of any request with If-Range
+	if rangeHeader == "" || r.Header.Get("If-Range") != "" || !strings.HasPrefix(rangeHeader, "bytes=") {
+		return true
+	}
+	ranges := 0
+	for _, ra := range strings.Split(rangeHeader[len("bytes="):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		ranges++
+		dash := strings.Index(ra, "-")
+		if dash == -1 {
+			return true
+		}
+		// A suffix range covers the beginning of any file no
+		// longer than it
+		start := strings.TrimSpace(ra[:dash])
+		if start == "" {
+			return true
+		}
+		if offset, err := strconv.ParseInt(start, 10, 64); err != nil || offset <= 0 {
+			return true
+		}
+	}
+	// Without any ranges, the whole file is served
+	return ranges == 0
+}
+
+// Authenticates a movieURL request carrying a share link, returning
+// the link's creator. It checks the signature and expiry, that the
+// requested file is covered by the link, and that the link has
+// downloads left. If the request counts as a download, the returned
+// request carries the link for countShareDownload, which movieHandler
+// calls once it knows it can serve the file. If the link isn't valid,
+// it writes an error response and returns an empty user.
+func shareUser(w http.ResponseWriter, r *http.Request) (string, *http.Request) {
+	httpError := func(err error, code int) {
+		glog.Warningf("Rejecting share link from %s: %s", r.RemoteAddr, err)
+		http.Error(w, "This share link is not valid", code)
+	}
+
+	query := r.URL.Query()
+	id, err := strconv.ParseUint(query.Get("share"), 10, 64)
+	if err != nil {
+		httpError(err, http.StatusBadRequest)
+		return "", r
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		httpError(err, http.StatusBadRequest)
+		return "", r
+	}
+
+	link, ok, err := dbStore.ShareLink(id)
+	if err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to check share link", http.StatusInternalServerError)
+		return "", r
+	} else if !ok {
+		httpError(fmt.Errorf("Share link %d does not exist", id), http.StatusNotFound)
+		return "", r
+	}
+	expected := signShare(link.ID, link.Library, link.Name, link.Expires.Unix())
+	if expires != link.Expires.Unix() || !hmac.Equal([]byte(query.Get("sig")), []byte(expected)) {
+		httpError(fmt.Errorf("Invalid signature for share link %d", id), http.StatusForbidden)
+		return "", r
+	}
+	if time.Now().After(link.Expires) {
+		httpError(fmt.Errorf("Share link %d has expired", id), http.StatusGone)
+		return "", r
+	}
+	if library, name := splitMovieURL(r.URL.Path); !link.covers(library, name) {
+		httpError(fmt.Errorf("Share link %d does not cover %s", id, r.URL.Path), http.StatusForbidden)
+		return "", r
+	}
+
+	if countsAsShareDownload(r) {
+		if link.MaxDownloads.Valid && link.Downloads >= uint64(link.MaxDownloads.Int64) {
+			httpError(fmt.Errorf("Share link %d has no downloads left", id), http.StatusGone)
+			return "", r
+		}
+		r = r.WithContext(context.WithValue(r.Context(), shareContextKey, link.ID))
+	}
+	glog.V(vLevel).Infof("Share link %d of %s used from %s", link.ID, link.Creator, r.RemoteAddr)
+	return link.Creator, r
+}
+
+// Counts a download of the share link that authenticated the request,
+// if the request counts as one. It returns false if the link has run
+// out of downloads meanwhile, after writing an error response.
+func countShareDownload(w http.ResponseWriter, r *http.Request) bool {
+	id, ok := r.Context().Value(shareContextKey).(uint64)
+	if !ok {
+		return true
+	}
+	if ok, err := dbStore.AddShareDownload(id); err != nil {
+		glog.Error(err)
+		http.Error(w, "Failed to check share link", http.StatusInternalServerError)
+		return false
+	} else if !ok {
+		glog.Warningf("Rejecting share link from %s: Share link %d has no downloads left", r.RemoteAddr, id)
+		http.Error(w, "This share link is not valid", http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// Creates a share link for the library and name form values, which
+// lasts for the duration in the expires form value (share-expiry by
+// default) and can be downloaded max_downloads times (unlimited by
+// default). It responds with the link as json.
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	httpError := func(err error, code int) {
+		glog.Errorf("Error in share handler: %s", err)
+		http.Error(w, fmt.Sprintf("Could not create share link: %s", err), code)
+	}
+	if r.Method != "POST" {
+		httpError(fmt.Errorf("Share links can only be created with a POST"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, library := requestUser(r), r.FormValue("library")
+	name := filepath.Clean(r.FormValue("name"))
+	moviePath, ok := moviePaths[library]
+	if !ok {
+		httpError(fmt.Errorf("Invalid key name: %s", library), http.StatusBadRequest)
+		return
+	}
+	if ok, err := canAccessLibrary(user, library); err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	} else if !ok {
+		httpError(fmt.Errorf("%s cannot access %s", user, library), http.StatusForbidden)
+		return
+	}
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		httpError(fmt.Errorf("Invalid name: %s", name), http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(filepath.Join(moviePath, name)); err != nil {
+		httpError(fmt.Errorf("No such movie: %s", name), http.StatusNotFound)
+		return
+	}
+
+	lifetime := *shareExpiry
+	if expiresValue := r.FormValue("expires"); expiresValue != "" {
+		var err error
+		if lifetime, err = time.ParseDuration(expiresValue); err != nil {
+			httpError(err, http.StatusBadRequest)
+			return
+		}
+	}
+	if lifetime <= 0 || lifetime > *shareMaxExpiry {
+		httpError(fmt.Errorf("Share links must expire within %s", *shareMaxExpiry), http.StatusBadRequest)
+		return
+	}
+	var maxDownloads sql.NullInt64
+	if maxValue := r.FormValue("max_downloads"); maxValue != "" {
+		max, err := strconv.ParseInt(maxValue, 10, 64)
+		if err != nil || max <= 0 {
+			httpError(fmt.Errorf("Invalid max_downloads: %s", maxValue), http.StatusBadRequest)
+			return
+		}
+		maxDownloads = sql.NullInt64{Int64: max, Valid: true}
+	}
+
+	// The expiry is truncated to seconds, since that's all the
+	// database and the URL keep
+	link := shareLink{
+		Creator:      user,
+		Library:      library,
+		Name:         name,
+		Expires:      time.Now().Add(lifetime).Truncate(time.Second),
+		MaxDownloads: maxDownloads,
+	}
+	id, err := dbStore.NewShareLink(link)
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+	link.ID = id
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	path := shareURLPath(link)
+	jsonResponse := map[string]interface{}{
+		"id":      link.ID,
+		"path":    path,
+		"url":     fmt.Sprintf("%s://%s%s", scheme, r.Host, path),
+		"expires": link.Expires.Unix(),
+	}
+	if maxDownloads.Valid {
+		jsonResponse["max_downloads"] = maxDownloads.Int64
+	}
+	jsonData, err := json.Marshal(jsonResponse)
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(jsonData))
+}
@@ -13,133 +13,1676 @@ CONDITIONS OF ANY KIND, either express or implied.  See the License for the
 specific language governing permissions and limitations under the License.
 */
 
-// Utilitiy functions to setup and operate the mysql interface to the
-// movieserver
+// The SQL implementation of the store, along with the functions that
+// set up its MySQL database. Other SQL databases reuse sqlStore with
+// their own statements.
 
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/golang/glog"
 	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var (
-	dbHandle      *sql.DB
-	sqlStatements = make(map[string]string)
-)
+// A store backed by a SQL database
+type sqlStore struct {
+	db *sql.DB
+	// The statements the store runs, as built by buildSQLMap and
+	// adjusted for the database's dialect
+	stmts map[string]string
+	// The condition that matches names against a LIKE pattern
+	// with backslash escapes
+	nameLike string
+	// The directory under migrations holding the database's schema
+	dialect string
+	// Whether the database numbers its placeholders ($1, $2, ...)
+	// instead of using ?
+	numberedParams bool
+	// Whether the ids of inserted rows are returned with
+	// RETURNING rather than by LastInsertId
+	returningIDs bool
+	// The options of transactions that read several results that
+	// must be consistent, or nil if the defaults do that
+	readTxOptions *sql.TxOptions
+}
+
+// The environment variable the MySQL password is read from when no
+// mysql-password-file is given
+const mysqlPasswordEnv = "MOVIESERVER_MYSQL_PASSWORD"
+
+// The name the custom TLS config is registered with the driver under
+const mysqlTLSName = "movieserver"
+
+// The error MySQL returns when connecting to a database that doesn't
+// exist
+const errBadDB = 1049
+
+// Returns the password for the MySQL user, read from the
+// mysql-password-file flag's file or else from mysqlPasswordEnv
+func mysqlPassword() (string, error) {
+	if *mysqlPasswordFile == "" {
+		return os.Getenv(mysqlPasswordEnv), nil
+	}
+	password, err := ioutil.ReadFile(*mysqlPasswordFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// Returns the driver's TLS setting for the mysql-tls flags. If a CA
+// or client certificate is given, it registers a custom TLS config
+// with the driver and returns its name.
+func mysqlTLSSetting() (string, error) {
+	switch *mysqlTLS {
+	case "false", "true", "skip-verify", "preferred":
+	default:
+		return "", fmt.Errorf("Invalid mysql-tls %q: must be \"false\", \"true\", \"skip-verify\" or \"preferred\"", *mysqlTLS)
+	}
+	if *mysqlTLSCA == "" && *mysqlTLSCert == "" && *mysqlTLSKey == "" {
+		return *mysqlTLS, nil
+	}
+	if *mysqlTLS != "true" && *mysqlTLS != "skip-verify" {
+		return "", fmt.Errorf("mysql-tls-ca, mysql-tls-cert and mysql-tls-key need mysql-tls to be \"true\" or \"skip-verify\"")
+	}
+	config := &tls.Config{InsecureSkipVerify: *mysqlTLS == "skip-verify"}
+	if *mysqlTLSCA != "" {
+		pem, err := ioutil.ReadFile(*mysqlTLSCA)
+		if err != nil {
+			return "", err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("No certificates found in %s", *mysqlTLSCA)
+		}
+	}
+	if *mysqlTLSCert != "" || *mysqlTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(*mysqlTLSCert, *mysqlTLSKey)
+		if err != nil {
+			return "", err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if err := mysql.RegisterTLSConfig(mysqlTLSName, config); err != nil {
+		return "", err
+	}
+	return mysqlTLSName, nil
+}
 
-// Creates a *DB handle with user root to the given database. It sets
-// the transaction level to REPEATABLE-READ, so that reads within the
-// same transaction return consistent results.
-func connectRoot(dbName string) error {
+// Builds the driver config for connecting to the given database (or
+// to none if it's empty) from the mysql flags. It sets the
+// transaction level to REPEATABLE-READ, so that reads within the same
+// transaction return consistent results. Timestamps are exchanged in
+// UTC and parsed into time.Time values. UPDATE statements report the
+// number of rows they matched rather than the number they changed,
+// so an update that doesn't change anything still counts its rows.
+func mysqlConfig(dbName string) (*mysql.Config, error) {
+	cfg := mysql.NewConfig()
+	cfg.User, cfg.DBName = *mysqlUser, dbName
+	if *mysqlSocket != "" {
+		cfg.Net, cfg.Addr = "unix", *mysqlSocket
+	} else {
+		cfg.Net, cfg.Addr = "tcp", net.JoinHostPort(*mysqlHost, strconv.FormatUint(*mysqlPort, 10))
+	}
 	var err error
-	dbHandle, err = sql.Open("mysql", fmt.Sprintf("root@tcp(127.0.0.1:%d)/%s?tx_isolation='REPEATABLE-READ'", *mysqlPort, dbName))
+	if cfg.Passwd, err = mysqlPassword(); err != nil {
+		return nil, err
+	}
+	if cfg.TLSConfig, err = mysqlTLSSetting(); err != nil {
+		return nil, err
+	}
+	cfg.ParseTime, cfg.ClientFoundRows = true, true
+	cfg.Params = map[string]string{
+		"tx_isolation": "'REPEATABLE-READ'",
+		"time_zone":    "'+00:00'",
+	}
+	return cfg, nil
+}
+
+// Creates a *DB handle to the given database, limiting its connection
+// pool as the db pool flags say
+func connectMySQL(dbName string) (*sql.DB, error) {
+	cfg, err := mysqlConfig(dbName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = dbHandle.Ping()
-	return err
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(*dbMaxOpenConns)
+	db.SetMaxIdleConns(*dbMaxIdleConns)
+	db.SetConnMaxLifetime(*dbConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-const (
-	stmtSep       = "----------"
-	refreshPrefix = "--#"
-)
+// Returns a handle to the mysql-database database, creating it first
+// if it doesn't exist. Creating it takes a connection to no database,
+// but an account that can't create databases can still use one that
+// already exists.
+func connectDatabase() (*sql.DB, error) {
+	db, err := connectMySQL(*mysqlDatabase)
+	if mysqlErr, ok := err.(*mysql.MySQLError); !ok || mysqlErr.Number != errBadDB {
+		return db, err
+	}
+	glog.V(vLevel).Infof("Creating the %s database", *mysqlDatabase)
+	if db, err = connectMySQL(""); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", strings.Replace(*mysqlDatabase, "`", "``", -1))); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+	return connectMySQL(*mysqlDatabase)
+}
 
-// Runs the conf/setup.sql file. In the file, statements are separated
-// by the stmtSep string. If the refreshSchema flag is true, we
-// execute statements prefixed by refreshPrefix, otherwise we skip
-// them. First it connects to no database to run the setup.sql
-// statements, since they should create the movieserver database if
-// that doesn't exist. Then it reconnects to the movieserver database
-// (it can't rely on the USE database statement to use the database
-// for subsequent statements run concurrently due to a bug in the
-// mysql driver)
-func setupSchema() error {
-	if err := connectRoot(""); err != nil {
-		return err
+// Connects to the database and builds the query map. If migrate is
+// true, it applies any pending schema migrations and migrates any
+// plaintext logins to the users table.
+func openMySQLStore(migrate bool) (*sqlStore, error) {
+	db, err := connectDatabase()
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db, stmts: buildSQLMap(), nameLike: "name LIKE ?", dialect: mysqlBackend}
+	if !migrate {
+		return s, nil
+	}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
 	}
-	setupBytes, err := ioutil.ReadFile(*srcPath + "/conf/setup.sql")
+	if err := s.migrateLoginTable(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Changes the statements that add to the download statistics from
+// MySQL's ON DUPLICATE KEY UPDATE to the ON CONFLICT clause of SQLite
+// and Postgres
+func useOnConflictUpserts(sqlStatements map[string]string) {
+	sqlStatements["addMovieDownloads"] = `INSERT INTO movie_downloads_daily(path, name, day, downloads) VALUES (?, ?, ?, ?)
+ON CONFLICT (path, name, day) DO UPDATE SET downloads = movie_downloads_daily.downloads + excluded.downloads`
+	sqlStatements["addLibraryDownloads"] = `INSERT INTO library_downloads_daily(path, day, downloads) VALUES (?, ?, ?)
+ON CONFLICT (path, day) DO UPDATE SET downloads = library_downloads_daily.downloads + excluded.downloads`
+}
+
+// Returns the MySQL statements that sqlStore runs. Other dialects
+// override the ones that differ.
+func buildSQLMap() map[string]string {
+	sqlStatements := make(map[string]string)
+
+	// newMovies adds movies and their metadata to the movies table.
+	// The values are a newMovieRow for each movie. If a movie is
+	// already there, it will throw a dup key error
+	sqlStatements["newMovies"] = "INSERT INTO movies(path, name, size, mtime, is_dir, mime, fingerprint) VALUES %s"
+
+	// updateMovie sets the metadata and fingerprint of a movie
+	sqlStatements["updateMovie"] = "UPDATE movies SET size=?, mtime=?, is_dir=?, mime=?, fingerprint=? WHERE path=? AND name=?"
+
+	// moveMovie gives a movie a new path and name along with its
+	// new metadata and fingerprint, keeping its downloads
+	sqlStatements["moveMovie"] = "UPDATE movies SET path=?, name=?, size=?, mtime=?, is_dir=?, mime=?, fingerprint=? WHERE path=? AND name=?"
+
+	// deleteMovies deletes the movies with the given names in a
+	// path from the table. Names that aren't there are ignored
+	sqlStatements["deleteMovies"] = "DELETE FROM movies WHERE path=? AND name IN (%s)"
+
+	// addDownload increments the number of downloads for an
+	// existing movie. If the movie isn't there, it won't throw an
+	// error, but it will say that 0 rows were affected.
+	sqlStatements["addDownload"] = "UPDATE movies SET downloads=downloads+1 WHERE path=? AND name=?"
+
+	// addMovieDownloads adds the given number of downloads to a
+	// movie's statistics for a day, inserting the day if it isn't
+	// there
+	sqlStatements["addMovieDownloads"] = `INSERT INTO movie_downloads_daily(path, name, day, downloads) VALUES (?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE downloads = downloads + VALUES(downloads)`
+
+	// addLibraryDownloads is addMovieDownloads for a library
+	sqlStatements["addLibraryDownloads"] = `INSERT INTO library_downloads_daily(path, day, downloads) VALUES (?, ?, ?)
+ON DUPLICATE KEY UPDATE downloads = downloads + VALUES(downloads)`
+
+	// getTopMovies selects the movies with the most downloads on a
+	// range of days. The %s is meant for the placeholders of the
+	// paths.
+	sqlStatements["getTopMovies"] = `SELECT path, name, SUM(downloads) AS total FROM movie_downloads_daily
+WHERE path IN (%s) AND day >= ? AND day < ? GROUP BY path, name ORDER BY total DESC, path, name LIMIT ?`
+
+	// getLibraryDownloads selects the downloads of each library on
+	// a range of days. The %s is meant for the placeholders of the
+	// paths.
+	sqlStatements["getLibraryDownloads"] = `SELECT path, SUM(downloads) FROM library_downloads_daily
+WHERE path IN (%s) AND day >= ? AND day < ? GROUP BY path`
+
+	// getOldMovieDownloads selects the movie statistics of the days
+	// before the given one
+	sqlStatements["getOldMovieDownloads"] = "SELECT path, name, day, downloads FROM movie_downloads_daily WHERE day < ?"
+
+	// deleteMovieDownloads deletes a movie's statistics for a range
+	// of days
+	sqlStatements["deleteMovieDownloads"] = "DELETE FROM movie_downloads_daily WHERE path = ? AND name = ? AND day >= ? AND day < ?"
+
+	// getOldLibraryDownloads is getOldMovieDownloads for libraries
+	sqlStatements["getOldLibraryDownloads"] = "SELECT path, '', day, downloads FROM library_downloads_daily WHERE day < ?"
+
+	// deleteLibraryDownloads is deleteMovieDownloads for libraries
+	sqlStatements["deleteLibraryDownloads"] = "DELETE FROM library_downloads_daily WHERE path = ? AND day >= ? AND day < ?"
+
+	// getMovieDays selects every day of a movie's statistics
+	sqlStatements["getMovieDays"] = "SELECT day, downloads FROM movie_downloads_daily WHERE path = ? AND name = ?"
+
+	// clearMovieDays deletes every day of a movie's statistics
+	sqlStatements["clearMovieDays"] = "DELETE FROM movie_downloads_daily WHERE path = ? AND name = ?"
+
+	// getLibraryDays is getMovieDays for libraries
+	sqlStatements["getLibraryDays"] = "SELECT day, downloads FROM library_downloads_daily WHERE path = ?"
+
+	// clearLibraryDays is clearMovieDays for libraries
+	sqlStatements["clearLibraryDays"] = "DELETE FROM library_downloads_daily WHERE path = ?"
+
+	// getIndexedMovies selects every movie in the given paths and
+	// its metadata. The %s is meant for the placeholders of the
+	// paths.
+	sqlStatements["getIndexedMovies"] = "SELECT path, name, size, mtime, is_dir, mime, fingerprint FROM movies WHERE path IN (%s)"
+
+	// getOrphanedMovies selects the movies with fingerprints and
+	// their metadata. The %s is meant for a condition excluding
+	// the current paths.
+	sqlStatements["getOrphanedMovies"] = "SELECT path, name, size, mtime, is_dir, mime, fingerprint FROM movies WHERE fingerprint <> '' %s"
+
+	// getMovies selects all the movie names, downloads and
+	// metadata from the movies table that are in moviePaths
+	// paths. The three %s's are meant for WHERE clauses, ORDER BY,
+	// and LIMIT
+	sqlStatements["getMovies"] = "SELECT name, downloads, size, mtime, is_dir, mime FROM movies WHERE %s %s %s"
+
+	// getMovieNum is the same as getMovies except it's a COUNT(*)
+	// query. We don't need ORDER BY and LIMIT, though.
+	sqlStatements["getMovieNum"] = "SELECT COUNT(*) FROM movies WHERE %s"
+
+	// getPasswordHash selects the password hash of the given
+	// user
+	sqlStatements["getPasswordHash"] = "SELECT password_hash FROM users WHERE username = ?"
+
+	// updateLastLogin sets the last login time of the given user
+	// to now
+	sqlStatements["updateLastLogin"] = "UPDATE users SET last_login = CURRENT_TIMESTAMP WHERE username = ?"
+
+	// newUser adds a user with the given password hash. If the
+	// user already exists, it will throw a dup key error
+	sqlStatements["newUser"] = "INSERT INTO users(username, password_hash) VALUES (?, ?)"
+
+	// deleteUser deletes a user. If there is no such user, it
+	// will say that 0 rows were affected
+	sqlStatements["deleteUser"] = "DELETE FROM users WHERE username = ?"
+
+	// setPasswordHash changes the password hash of a user
+	sqlStatements["setPasswordHash"] = "UPDATE users SET password_hash = ? WHERE username = ?"
+
+	// getUsers selects every user's name, creation time, last
+	// login time and the time their account was locked
+	sqlStatements["getUsers"] = `SELECT u.username, u.created, u.last_login, l.locked_at
+FROM users u LEFT JOIN account_locks l ON u.username = l.username ORDER BY u.username`
+
+	// deleteUserGroups removes a user from every group
+	sqlStatements["deleteUserGroups"] = "DELETE FROM user_groups WHERE username = ?"
+
+	// deleteUserGrants revokes every library granted directly to
+	// a user
+	sqlStatements["deleteUserGrants"] = "DELETE FROM library_acl WHERE principal_type = 'user' AND principal = ?"
+
+	// getUserLibraries selects the libraries granted to a user,
+	// either directly or through the user's groups. Both
+	// parameters are the username.
+	sqlStatements["getUserLibraries"] = `SELECT library FROM library_acl WHERE principal_type = 'user' AND principal = ?
+UNION SELECT a.library FROM library_acl a JOIN user_groups g ON a.principal = g.group_name
+WHERE a.principal_type = 'group' AND g.username = ?`
+
+	// grantLibrary grants a library to a principal. Granting a
+	// library twice doesn't do anything.
+	sqlStatements["grantLibrary"] = "INSERT IGNORE INTO library_acl(principal_type, principal, library) VALUES (?, ?, ?)"
+
+	// revokeLibrary revokes a library from a principal. If it
+	// wasn't granted, it will say that 0 rows were affected
+	sqlStatements["revokeLibrary"] = "DELETE FROM library_acl WHERE principal_type = ? AND principal = ? AND library = ?"
+
+	// getGrants selects every row of the access control list
+	sqlStatements["getGrants"] = "SELECT principal_type, principal, library FROM library_acl ORDER BY principal_type, principal, library"
+
+	// addGroupMember adds a user to a group. Adding a user twice
+	// doesn't do anything.
+	sqlStatements["addGroupMember"] = "INSERT IGNORE INTO user_groups(group_name, username) VALUES (?, ?)"
+
+	// removeGroupMember removes a user from a group. If the user
+	// wasn't a member, it will say that 0 rows were affected
+	sqlStatements["removeGroupMember"] = "DELETE FROM user_groups WHERE group_name = ? AND username = ?"
+
+	// countGroupMember returns 1 if the given user is a member of
+	// the given group, and 0 otherwise
+	sqlStatements["countGroupMember"] = "SELECT COUNT(*) FROM user_groups WHERE group_name = ? AND username = ?"
+
+	// getGroupMembers selects every group and its members
+	sqlStatements["getGroupMembers"] = "SELECT group_name, username FROM user_groups ORDER BY group_name, username"
+
+	// newToken adds an API token with the given user, token hash
+	// and scope
+	sqlStatements["newToken"] = "INSERT INTO api_tokens(username, token_hash, scope) VALUES (?, ?, ?)"
+
+	// getToken selects the user and scope of the token with the
+	// given hash
+	sqlStatements["getToken"] = "SELECT username, scope FROM api_tokens WHERE token_hash = ?"
+
+	// updateTokenLastUsed sets the last use time of the token with
+	// the given hash to now
+	sqlStatements["updateTokenLastUsed"] = "UPDATE api_tokens SET last_used = CURRENT_TIMESTAMP WHERE token_hash = ?"
+
+	// deleteToken revokes the token with the given id. If there is
+	// no such token, it will say that 0 rows were affected
+	sqlStatements["deleteToken"] = "DELETE FROM api_tokens WHERE id = ?"
+
+	// deleteUserTokens revokes every token of a user
+	sqlStatements["deleteUserTokens"] = "DELETE FROM api_tokens WHERE username = ?"
+
+	// getTokens selects every token's id, user, scope, creation
+	// time and last use time. The %s is meant for a WHERE clause.
+	sqlStatements["getTokens"] = "SELECT id, username, scope, created, last_used FROM api_tokens %s ORDER BY username, id"
+
+	// countAccountLocks returns 1 if the given user's account is
+	// locked, and 0 otherwise
+	sqlStatements["countAccountLocks"] = "SELECT COUNT(*) FROM account_locks WHERE username = ?"
+
+	// lockAccount locks the given user's account. Locking an
+	// account twice, or a user that doesn't exist, doesn't do
+	// anything.
+	sqlStatements["lockAccount"] = "INSERT IGNORE INTO account_locks(username) SELECT username FROM users WHERE username = ?"
+
+	// unlockAccount unlocks the given user's account. If it wasn't
+	// locked, it will say that 0 rows were affected
+	sqlStatements["unlockAccount"] = "DELETE FROM account_locks WHERE username = ?"
+
+	// newSession adds a session with the given hashed id, user,
+	// expiry time, IP and user agent
+	sqlStatements["newSession"] = "INSERT INTO sessions(id, username, expires, ip, user_agent) VALUES (?, ?, ?, ?, ?)"
+
+	// touchSession sets the last seen time of the session with the
+	// given hashed id and user to now. If the session doesn't
+	// exist or has expired, it will say that 0 rows were affected
+	sqlStatements["touchSession"] = "UPDATE sessions SET last_seen = CURRENT_TIMESTAMP WHERE id = ? AND username = ? AND expires > CURRENT_TIMESTAMP"
+
+	// getUserSessions selects the sessions of the given user that
+	// haven't expired, most recently seen first
+	sqlStatements["getUserSessions"] = `SELECT id, username, created, last_seen, ip, user_agent FROM sessions
+WHERE username = ? AND expires > CURRENT_TIMESTAMP ORDER BY last_seen DESC`
+
+	// getSessions selects every session that hasn't expired
+	sqlStatements["getSessions"] = `SELECT id, username, created, last_seen, ip, user_agent FROM sessions
+WHERE expires > CURRENT_TIMESTAMP ORDER BY username, last_seen DESC`
+
+	// deleteSession revokes the session with the given hashed id,
+	// if it belongs to the given user. If there is no such
+	// session, it will say that 0 rows were affected
+	sqlStatements["deleteSession"] = "DELETE FROM sessions WHERE id = ? AND username = ?"
+
+	// deleteUserSessions revokes every session of a user
+	sqlStatements["deleteUserSessions"] = "DELETE FROM sessions WHERE username = ?"
+
+	// deleteExpiredSessions deletes every expired session
+	sqlStatements["deleteExpiredSessions"] = "DELETE FROM sessions WHERE expires <= CURRENT_TIMESTAMP"
+
+	// newShareLink adds a share link with the given creator,
+	// library, name, expiry time and maximum number of downloads
+	// (NULL for unlimited)
+	sqlStatements["newShareLink"] = "INSERT INTO share_links(creator, library, name, expires, max_downloads) VALUES (?, ?, ?, ?, ?)"
+
+	// getShareLink selects the share link with the given id
+	sqlStatements["getShareLink"] = "SELECT id, creator, library, name, expires, max_downloads, downloads FROM share_links WHERE id = ?"
+
+	// getShareLinks selects every share link that hasn't expired.
+	// The %s is meant for a WHERE clause condition.
+	sqlStatements["getShareLinks"] = `SELECT id, creator, library, name, expires, max_downloads, downloads FROM share_links
+WHERE expires > CURRENT_TIMESTAMP %s ORDER BY creator, id`
+
+	// addShareDownload counts a download of the share link with
+	// the given id. If the link has expired or has no downloads
+	// left, it will say that 0 rows were affected
+	sqlStatements["addShareDownload"] = `UPDATE share_links SET downloads = downloads + 1
+WHERE id = ? AND expires > CURRENT_TIMESTAMP AND (max_downloads IS NULL OR downloads < max_downloads)`
+
+	// deleteShareLink revokes the share link with the given id.
+	// If there is no such link, it will say that 0 rows were
+	// affected
+	sqlStatements["deleteShareLink"] = "DELETE FROM share_links WHERE id = ?"
+
+	// deleteUserShareLinks revokes every share link created by a
+	// user
+	sqlStatements["deleteUserShareLinks"] = "DELETE FROM share_links WHERE creator = ?"
+
+	// newDownloadEvent records a request to the movie handler in
+	// the download audit log
+	sqlStatements["newDownloadEvent"] = `INSERT INTO download_events(username, library, name, started, finished, bytes, status, range_header, ip)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	// countDownloadEvents counts the events in the download audit
+	// log. The %s is meant for a WHERE clause.
+	sqlStatements["countDownloadEvents"] = "SELECT COUNT(*) FROM download_events%s"
+
+	// getDownloadEvents selects events from the download audit
+	// log, newest first. The two %s's are meant for a WHERE clause
+	// and LIMIT.
+	sqlStatements["getDownloadEvents"] = `SELECT id, username, library, name, started, finished, bytes, status, range_header, ip
+FROM download_events%s ORDER BY started DESC, id DESC %s`
+
+	// The export statements select every row of a table, for the
+	// catalog
+	sqlStatements["exportMovies"] = "SELECT path, name, downloads, size, mtime, is_dir, mime, fingerprint FROM movies ORDER BY path, name"
+	sqlStatements["exportUsers"] = "SELECT username, password_hash, created, last_login FROM users ORDER BY username"
+	sqlStatements["exportTokens"] = "SELECT id, username, token_hash, scope, created, last_used FROM api_tokens ORDER BY id"
+	sqlStatements["exportLocks"] = "SELECT username, locked_at FROM account_locks ORDER BY username"
+	sqlStatements["exportShareLinks"] = "SELECT id, creator, library, name, expires, max_downloads, downloads FROM share_links ORDER BY id"
+	sqlStatements["exportMovieDownloads"] = "SELECT path, name, day, downloads FROM movie_downloads_daily ORDER BY path, name, day"
+	sqlStatements["exportLibraryDownloads"] = "SELECT path, '', day, downloads FROM library_downloads_daily ORDER BY path, day"
+	sqlStatements["exportDownloadEvents"] = `SELECT id, username, library, name, started, finished, bytes, status, range_header, ip
+FROM download_events ORDER BY id`
+
+	// clearTable deletes every row of the table given by the %s,
+	// before a catalog is imported
+	sqlStatements["clearTable"] = "DELETE FROM %s"
+
+	// The import statements add the rows of a catalog, keeping
+	// their ids and timestamps
+	sqlStatements["importMovie"] = `INSERT INTO movies(path, name, downloads, size, mtime, is_dir, mime, fingerprint)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	sqlStatements["importUser"] = "INSERT INTO users(username, password_hash, created, last_login) VALUES (?, ?, ?, ?)"
+	sqlStatements["importToken"] = "INSERT INTO api_tokens(id, username, token_hash, scope, created, last_used) VALUES (?, ?, ?, ?, ?, ?)"
+	sqlStatements["importLock"] = "INSERT INTO account_locks(username, locked_at) VALUES (?, ?)"
+	sqlStatements["importShareLink"] = `INSERT INTO share_links(id, creator, library, name, expires, max_downloads, downloads)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+	sqlStatements["importDownloadEvent"] = `INSERT INTO download_events(id, username, library, name, started, finished, bytes, status, range_header, ip)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	// countLoginTable returns 1 if the old plaintext login table
+	// exists in the given database, and 0 otherwise
+	sqlStatements["countLoginTable"] = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND table_name = 'login'"
+
+	// getLogins selects every row of the old login table
+	sqlStatements["getLogins"] = "SELECT user, password FROM login"
+
+	// migrateUser adds a user from the old login table, unless
+	// the user already exists
+	sqlStatements["migrateUser"] = "INSERT IGNORE INTO users(username, password_hash) VALUES (?, ?)"
+
+	// dropLoginTable drops the old login table once it has been
+	// migrated
+	sqlStatements["dropLoginTable"] = "DROP TABLE login"
+
+	// createSchemaVersion creates the table that records which
+	// schema migrations have been applied
+	sqlStatements["createSchemaVersion"] = `CREATE TABLE IF NOT EXISTS schema_version(version INT NOT NULL PRIMARY KEY,
+name VARCHAR(255) NOT NULL, applied TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`
+
+	// getSchemaVersions selects every applied migration
+	sqlStatements["getSchemaVersions"] = "SELECT version, name, applied FROM schema_version ORDER BY version"
+
+	// addSchemaVersion records that a migration was applied
+	sqlStatements["addSchemaVersion"] = "INSERT INTO schema_version(version, name) VALUES (?, ?)"
+	return sqlStatements
+}
+
+// Returns the named statement, formatted with the given parts if
+// there are any, with its placeholders in the database's style
+func (s *sqlStore) stmt(name string, parts ...interface{}) string {
+	query := s.stmts[name]
+	if len(parts) > 0 {
+		query = fmt.Sprintf(query, parts...)
+	}
+	if s.numberedParams {
+		query = numberParams(query)
+	}
+	return query
+}
+
+// Replaces the ? placeholders in a query with $1, $2 and so on,
+// leaving question marks in string literals alone
+func numberParams(query string) string {
+	var (
+		result strings.Builder
+		n      int
+		quoted bool
+	)
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			fmt.Fprintf(&result, "$%d", n)
+			continue
+		}
+		result.WriteRune(c)
+	}
+	return result.String()
+}
+
+// Runs the named statement, returning the number of rows it affected
+func (s *sqlStore) exec(name string, args ...interface{}) (int64, error) {
+	res, err := s.db.Exec(s.stmt(name), args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Runs the named statement, returning true if it affected any rows
+func (s *sqlStore) execAny(name string, args ...interface{}) (bool, error) {
+	rowcount, err := s.exec(name, args...)
+	return rowcount > 0, err
+}
+
+// Scans rows selected by getIndexedMovies or getOrphanedMovies
+func scanIndexedMovies(rows *sql.Rows) ([]indexedMovie, error) {
+	defer rows.Close()
+	movies := make([]indexedMovie, 0)
+	for rows.Next() {
+		var (
+			m     indexedMovie
+			mtime sql.NullTime
+		)
+		if err := rows.Scan(&m.Path, &m.Name, &m.Size, &mtime, &m.IsDir, &m.MIME, &m.Fingerprint); err != nil {
+			return nil, err
+		}
+		m.Mtime = mtime.Time.UTC()
+		movies = append(movies, m)
+	}
+	return movies, rows.Err()
+}
+
+// Returns the placeholders and arguments of a list of paths or names
+func pathArgs(paths []string) (string, []interface{}) {
+	args := make([]interface{}, 0, len(paths))
+	for _, path := range paths {
+		args = append(args, path)
+	}
+	return strings.Repeat("?, ", len(paths)-1) + "?", args
+}
+
+func (s *sqlStore) IndexedMovies(paths []string) ([]indexedMovie, error) {
+	if len(paths) == 0 {
+		return make([]indexedMovie, 0), nil
+	}
+	placeholders, args := pathArgs(paths)
+	rows, err := s.db.Query(s.stmt("getIndexedMovies", placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanIndexedMovies(rows)
+}
+
+func (s *sqlStore) OrphanedMovies(paths []string) ([]indexedMovie, error) {
+	where, args := "", []interface{}{}
+	if len(paths) > 0 {
+		var placeholders string
+		placeholders, args = pathArgs(paths)
+		where = "AND path NOT IN (" + placeholders + ")"
+	}
+	rows, err := s.db.Query(s.stmt("getOrphanedMovies", where), args...)
 	if err != nil {
+		return nil, err
+	}
+	return scanIndexedMovies(rows)
+}
+
+// Moves the daily statistics selected by getStmt (as day and
+// downloads) with the from arguments to the to arguments in a
+// transaction, adding them to any that the to arguments already have
+func (s *sqlStore) moveDays(trans *sql.Tx, getStmt, clearStmt, addStmt string, from, to []interface{}) error {
+	type dayDownloads struct {
+		day       time.Time
+		downloads uint64
+	}
+	var days []dayDownloads
+	rows, err := trans.Query(s.stmt(getStmt), from...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var d dayDownloads
+		if err := rows.Scan(&d.day, &d.downloads); err != nil {
+			rows.Close()
+			return err
+		}
+		days = append(days, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return err
 	}
-	statements := strings.Split(string(setupBytes), stmtSep)
-	for _, stmt := range statements {
-		stmt = strings.TrimSpace(stmt)
-		execstmt := ""
-		if strings.HasPrefix(stmt, refreshPrefix) {
-			if *refreshSchema {
-				execstmt = stmt[len(refreshPrefix):]
+	if _, err := trans.Exec(s.stmt(clearStmt), from...); err != nil {
+		return err
+	}
+	for _, d := range days {
+		if _, err := trans.Exec(s.stmt(addStmt), append(append([]interface{}{}, to...), downloadDay(d.day), d.downloads)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The placeholders of a movie in newMovies
+const newMovieRow = "(?, ?, ?, ?, ?, ?, ?)"
+
+// Returns the size of the next batch of at most size items from a
+// list of length items, or all of them if size isn't positive
+func batchSize(size, length int) int {
+	if size <= 0 {
+		return length
+	}
+	return minInt(size, length)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Runs the statements of UpdateMovies in a transaction. Added and
+// removed movies are written index-batch-size at a time.
+func (s *sqlStore) updateMovies(trans *sql.Tx, added, changed []indexedMovie, moved []movedMovie, removed []movieKey) error {
+	for _, m := range moved {
+		res, err := trans.Exec(s.stmt("moveMovie"), m.Path, m.Name, m.Size, m.Mtime.UTC(), m.IsDir, m.MIME, m.Fingerprint,
+			m.From.Path, m.From.Name)
+		if err != nil {
+			return err
+		}
+		// If the old row is gone, the movie is added instead
+		if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			if _, err := trans.Exec(s.stmt("newMovies", newMovieRow),
+				m.Path, m.Name, m.Size, m.Mtime.UTC(), m.IsDir, m.MIME, m.Fingerprint); err != nil {
+				return err
 			}
-		} else {
-			execstmt = stmt
 		}
-		if len(execstmt) > 0 {
-			glog.V(vLevel).Infof("Executing: %s", execstmt)
-			_, err := dbHandle.Exec(execstmt)
-			if err != nil {
+		if err := s.moveDays(trans, "getMovieDays", "clearMovieDays", "addMovieDownloads",
+			[]interface{}{m.From.Path, m.From.Name}, []interface{}{m.Path, m.Name}); err != nil {
+			return err
+		}
+	}
+	for len(added) > 0 {
+		n := batchSize(*indexBatchSize, len(added))
+		args := make([]interface{}, 0, 7*n)
+		for _, m := range added[:n] {
+			args = append(args, m.Path, m.Name, m.Size, m.Mtime.UTC(), m.IsDir, m.MIME, m.Fingerprint)
+		}
+		values := strings.Repeat(newMovieRow+", ", n-1) + newMovieRow
+		if _, err := trans.Exec(s.stmt("newMovies", values), args...); err != nil {
+			return err
+		}
+		added = added[n:]
+	}
+	for _, m := range changed {
+		if _, err := trans.Exec(s.stmt("updateMovie"), m.Size, m.Mtime.UTC(), m.IsDir, m.MIME, m.Fingerprint, m.Path, m.Name); err != nil {
+			return err
+		}
+	}
+	// Deletes each path's movies together
+	var paths []string
+	names := make(map[string][]string)
+	for _, m := range removed {
+		if _, ok := names[m.Path]; !ok {
+			paths = append(paths, m.Path)
+		}
+		names[m.Path] = append(names[m.Path], m.Name)
+	}
+	for _, path := range paths {
+		for left := names[path]; len(left) > 0; {
+			n := batchSize(*indexBatchSize, len(left))
+			placeholders, args := pathArgs(left[:n])
+			if _, err := trans.Exec(s.stmt("deleteMovies", placeholders), append([]interface{}{path}, args...)...); err != nil {
 				return err
 			}
+			left = left[n:]
+		}
+	}
+	return nil
+}
+
+// Runs updateMovies in one transaction, or if index-commit-size is
+// positive, in a transaction for every index-commit-size movies, so
+// that indexing a huge library doesn't hold one open the whole time.
+// Moves go first, then additions, changes and removals. If a chunk
+// fails, the ones before it stay committed.
+func (s *sqlStore) UpdateMovies(added, changed []indexedMovie, moved []movedMovie, removed []movieKey) error {
+	for {
+		var (
+			n            = batchSize(*indexCommitSize, len(moved)+len(added)+len(changed)+len(removed))
+			chunkMoved   []movedMovie
+			chunkAdded   []indexedMovie
+			chunkChanged []indexedMovie
+			chunkRemoved []movieKey
+		)
+		k := minInt(n, len(moved))
+		chunkMoved, moved, n = moved[:k], moved[k:], n-k
+		k = minInt(n, len(added))
+		chunkAdded, added, n = added[:k], added[k:], n-k
+		k = minInt(n, len(changed))
+		chunkChanged, changed, n = changed[:k], changed[k:], n-k
+		k = minInt(n, len(removed))
+		chunkRemoved, removed = removed[:k], removed[k:]
+
+		trans, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := s.updateMovies(trans, chunkAdded, chunkChanged, chunkMoved, chunkRemoved); err != nil {
+			trans.Rollback()
+			return err
+		}
+		if err := trans.Commit(); err != nil {
+			return err
+		}
+		if len(moved)+len(added)+len(changed)+len(removed) == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *sqlStore) MoveLibraryDownloads(from, to string) error {
+	trans, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.moveDays(trans, "getLibraryDays", "clearLibraryDays", "addLibraryDownloads",
+		[]interface{}{from}, []interface{}{to}); err != nil {
+		trans.Rollback()
+		return err
+	}
+	return trans.Commit()
+}
+
+func (s *sqlStore) AddDownload(path, name string, when time.Time) (bool, error) {
+	trans, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	res, err := trans.Exec(s.stmt("addDownload"), path, name)
+	if err != nil {
+		trans.Rollback()
+		return false, err
+	}
+	if rowcount, err := res.RowsAffected(); err != nil {
+		trans.Rollback()
+		return false, err
+	} else if rowcount == 0 {
+		trans.Rollback()
+		return false, nil
+	}
+	day := downloadDay(when)
+	if _, err := trans.Exec(s.stmt("addMovieDownloads"), path, name, day, 1); err != nil {
+		trans.Rollback()
+		return false, err
+	}
+	if _, err := trans.Exec(s.stmt("addLibraryDownloads"), path, day, 1); err != nil {
+		trans.Rollback()
+		return false, err
+	}
+	return true, trans.Commit()
+}
+
+func (s *sqlStore) Movies(q movieQuery) (uint64, []movieRow, error) {
+	where, whereArgs := "path = ?", []interface{}{q.Path}
+	if q.Pattern != "" {
+		where += " AND " + s.nameLike
+		whereArgs = append(whereArgs, q.Pattern)
+	}
+	order := ""
+	if q.SortBy != "" {
+		if !sortableMovieColumns[q.SortBy] {
+			return 0, nil, fmt.Errorf("Cannot sort by %s", q.SortBy)
+		}
+		order = "ORDER BY " + q.SortBy
+		if q.Descending {
+			order += " DESC"
+		}
+	}
+
+	// Performs the select queries under a repeatable-read
+	// transaction, so their results remain consistent
+	trans, err := s.db.BeginTx(context.Background(), s.readTxOptions)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer trans.Rollback()
+
+	// We need to first get the number of entries the query will
+	// return. Sometimes, if the number of file entries decreased
+	// since the client accessed a page, they could be accessing
+	// an invalid page, so if that's the case, we use a limit
+	// offset of 0
+	var total uint64
+	if err := trans.QueryRow(s.stmt("getMovieNum", where), whereArgs...).Scan(&total); err != nil {
+		return 0, nil, err
+	}
+	limit, limitArgs := "", []interface{}{}
+	if q.Limit > 0 {
+		offset := q.Offset
+		if offset >= total {
+			offset = 0
+		}
+		limit, limitArgs = "LIMIT ? OFFSET ?", []interface{}{q.Limit, offset}
+	}
+
+	rows, err := trans.Query(s.stmt("getMovies", where, order, limit), append(whereArgs, limitArgs...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	movies := make([]movieRow, 0)
+	for rows.Next() {
+		var (
+			r     movieRow
+			mtime sql.NullTime
+		)
+		if err := rows.Scan(&r.Name, &r.Downloads, &r.Size, &mtime, &r.IsDir, &r.MIME); err != nil {
+			return 0, nil, err
+		}
+		r.Mtime = mtime.Time.UTC()
+		movies = append(movies, r)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	return total, movies, trans.Commit()
+}
+
+func (s *sqlStore) PasswordHash(user string) (string, bool, error) {
+	var hash string
+	if err := s.db.QueryRow(s.stmt("getPasswordHash"), user).Scan(&hash); err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return hash, true, nil
+}
+
+func (s *sqlStore) UpdateLastLogin(user string) error {
+	_, err := s.exec("updateLastLogin", user)
+	return err
+}
+
+func (s *sqlStore) NewUser(user, hash string) error {
+	_, err := s.exec("newUser", user, hash)
+	return err
+}
+
+func (s *sqlStore) SetPasswordHash(user, hash string) (bool, error) {
+	return s.execAny("setPasswordHash", hash, user)
+}
+
+func (s *sqlStore) DeleteUser(user string) (bool, error) {
+	trans, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	res, err := trans.Exec(s.stmt("deleteUser"), user)
+	if err != nil {
+		trans.Rollback()
+		return false, err
+	}
+	if rowcount, err := res.RowsAffected(); err != nil {
+		trans.Rollback()
+		return false, err
+	} else if rowcount == 0 {
+		trans.Rollback()
+		return false, nil
+	}
+	for _, stmt := range []string{"deleteUserGroups", "deleteUserGrants", "deleteUserTokens", "unlockAccount", "deleteUserSessions", "deleteUserShareLinks"} {
+		if _, err := trans.Exec(s.stmt(stmt), user); err != nil {
+			trans.Rollback()
+			return false, err
+		}
+	}
+	return true, trans.Commit()
+}
+
+func (s *sqlStore) Users() ([]userInfo, error) {
+	rows, err := s.db.Query(s.stmt("getUsers"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make([]userInfo, 0)
+	for rows.Next() {
+		var u userInfo
+		if err := rows.Scan(&u.Name, &u.Created, &u.LastLogin, &u.LockedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (s *sqlStore) UserLibraries(user string) ([]string, error) {
+	rows, err := s.db.Query(s.stmt("getUserLibraries"), user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	libraries := make([]string, 0)
+	for rows.Next() {
+		var library string
+		if err := rows.Scan(&library); err != nil {
+			return nil, err
+		}
+		libraries = append(libraries, library)
+	}
+	return libraries, rows.Err()
+}
+
+func (s *sqlStore) GrantLibrary(principalType, principal, library string) error {
+	_, err := s.exec("grantLibrary", principalType, principal, library)
+	return err
+}
+
+func (s *sqlStore) RevokeLibrary(principalType, principal, library string) (bool, error) {
+	return s.execAny("revokeLibrary", principalType, principal, library)
+}
+
+func (s *sqlStore) Grants() ([]libraryGrant, error) {
+	rows, err := s.db.Query(s.stmt("getGrants"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	grants := make([]libraryGrant, 0)
+	for rows.Next() {
+		var g libraryGrant
+		if err := rows.Scan(&g.PrincipalType, &g.Principal, &g.Library); err != nil {
+			return nil, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+func (s *sqlStore) AddGroupMember(group, user string) error {
+	_, err := s.exec("addGroupMember", group, user)
+	return err
+}
+
+func (s *sqlStore) RemoveGroupMember(group, user string) (bool, error) {
+	return s.execAny("removeGroupMember", group, user)
+}
+
+func (s *sqlStore) IsGroupMember(group, user string) (bool, error) {
+	var count int
+	if err := s.db.QueryRow(s.stmt("countGroupMember"), group, user).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *sqlStore) GroupMembers() ([]groupMember, error) {
+	rows, err := s.db.Query(s.stmt("getGroupMembers"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]groupMember, 0)
+	for rows.Next() {
+		var m groupMember
+		if err := rows.Scan(&m.Group, &m.User); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *sqlStore) NewToken(user, hash, scope string) error {
+	_, err := s.exec("newToken", user, hash, scope)
+	return err
+}
+
+func (s *sqlStore) UseToken(hash string) (string, string, error) {
+	var user, scope string
+	if err := s.db.QueryRow(s.stmt("getToken"), hash).Scan(&user, &scope); err == sql.ErrNoRows {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	if _, err := s.exec("updateTokenLastUsed", hash); err != nil {
+		return "", "", err
+	}
+	return user, scope, nil
+}
+
+func (s *sqlStore) DeleteToken(id uint64) (bool, error) {
+	return s.execAny("deleteToken", id)
+}
+
+func (s *sqlStore) Tokens(user string) ([]apiToken, error) {
+	where, whereArgs := "", []interface{}{}
+	if user != "" {
+		where, whereArgs = "WHERE username = ?", []interface{}{user}
+	}
+	rows, err := s.db.Query(s.stmt("getTokens", where), whereArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := make([]apiToken, 0)
+	for rows.Next() {
+		var t apiToken
+		if err := rows.Scan(&t.ID, &t.User, &t.Scope, &t.Created, &t.LastUsed); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *sqlStore) IsLocked(user string) (bool, error) {
+	var count int
+	if err := s.db.QueryRow(s.stmt("countAccountLocks"), user).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *sqlStore) LockAccount(user string) error {
+	_, err := s.exec("lockAccount", user)
+	return err
+}
+
+func (s *sqlStore) UnlockAccount(user string) (bool, error) {
+	return s.execAny("unlockAccount", user)
+}
+
+func (s *sqlStore) NewSession(idHash, user string, expires time.Time, ip, userAgent string) error {
+	_, err := s.exec("newSession", idHash, user, expires.UTC(), ip, userAgent)
+	return err
+}
+
+func (s *sqlStore) TouchSession(idHash, user string) (bool, error) {
+	return s.execAny("touchSession", idHash, user)
+}
+
+func (s *sqlStore) Sessions(user string) ([]sessionRow, error) {
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if user != "" {
+		rows, err = s.db.Query(s.stmt("getUserSessions"), user)
+	} else {
+		rows, err = s.db.Query(s.stmt("getSessions"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := make([]sessionRow, 0)
+	for rows.Next() {
+		var r sessionRow
+		if err := rows.Scan(&r.ID, &r.User, &r.Created, &r.LastSeen, &r.IP, &r.UserAgent); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, r)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqlStore) DeleteSession(idHash, user string) (bool, error) {
+	return s.execAny("deleteSession", idHash, user)
+}
+
+func (s *sqlStore) DeleteUserSessions(user string) (int64, error) {
+	return s.exec("deleteUserSessions", user)
+}
+
+func (s *sqlStore) DeleteExpiredSessions() (int64, error) {
+	return s.exec("deleteExpiredSessions")
+}
+
+func (s *sqlStore) NewShareLink(link shareLink) (uint64, error) {
+	args := []interface{}{link.Creator, link.Library, link.Name, link.Expires.UTC(), link.MaxDownloads}
+	if s.returningIDs {
+		var id uint64
+		err := s.db.QueryRow(s.stmt("newShareLink"), args...).Scan(&id)
+		return id, err
+	}
+	res, err := s.db.Exec(s.stmt("newShareLink"), args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return uint64(id), err
+}
+
+// Scans a row selected by getShareLink or getShareLinks
+func scanShareLink(row interface {
+	Scan(...interface{}) error
+}) (shareLink, error) {
+	var link shareLink
+	err := row.Scan(&link.ID, &link.Creator, &link.Library, &link.Name, &link.Expires, &link.MaxDownloads, &link.Downloads)
+	return link, err
+}
+
+func (s *sqlStore) ShareLink(id uint64) (shareLink, bool, error) {
+	link, err := scanShareLink(s.db.QueryRow(s.stmt("getShareLink"), id))
+	if err == sql.ErrNoRows {
+		return link, false, nil
+	}
+	return link, err == nil, err
+}
+
+func (s *sqlStore) ShareLinks(creator string) ([]shareLink, error) {
+	where, whereArgs := "", []interface{}{}
+	if creator != "" {
+		where, whereArgs = "AND creator = ?", []interface{}{creator}
+	}
+	rows, err := s.db.Query(s.stmt("getShareLinks", where), whereArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := make([]shareLink, 0)
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
 		}
+		links = append(links, link)
 	}
+	return links, rows.Err()
+}
 
-	// Reconnects to the movieserver database
-	if err := dbHandle.Close(); err != nil {
+func (s *sqlStore) AddShareDownload(id uint64) (bool, error) {
+	return s.execAny("addShareDownload", id)
+}
+
+func (s *sqlStore) DeleteShareLink(id uint64) (bool, error) {
+	return s.execAny("deleteShareLink", id)
+}
+
+// Returns the arguments of a statement with the placeholders of the
+// query's paths filled in by the %s, followed by its range of days
+func statsQueryArgs(q downloadStatsQuery) (string, []interface{}) {
+	placeholders, args := pathArgs(q.Paths)
+	return placeholders, append(args, downloadDay(q.Since), downloadDay(q.Until))
+}
+
+func (s *sqlStore) TopMovies(q downloadStatsQuery) ([]movieDownloads, error) {
+	movies := make([]movieDownloads, 0)
+	if len(q.Paths) == 0 {
+		return movies, nil
+	}
+	placeholders, args := statsQueryArgs(q)
+	rows, err := s.db.Query(s.stmt("getTopMovies", placeholders), append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m movieDownloads
+		if err := rows.Scan(&m.Path, &m.Name, &m.Downloads); err != nil {
+			return nil, err
+		}
+		movies = append(movies, m)
+	}
+	return movies, rows.Err()
+}
+
+func (s *sqlStore) LibraryDownloads(q downloadStatsQuery) (map[string]uint64, error) {
+	downloads := make(map[string]uint64)
+	if len(q.Paths) == 0 {
+		return downloads, nil
+	}
+	placeholders, args := statsQueryArgs(q)
+	rows, err := s.db.Query(s.stmt("getLibraryDownloads", placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			path  string
+			count uint64
+		)
+		if err := rows.Scan(&path, &count); err != nil {
+			return nil, err
+		}
+		downloads[path] = count
+	}
+	return downloads, rows.Err()
+}
+
+// Compacts the movie or library statistics of the days before the
+// given one in a transaction. The get statement selects the rows as
+// path, name, day and downloads, and keyArgs returns the arguments
+// that pick out a movie or library in the delete and add statements.
+func (s *sqlStore) compactStats(trans *sql.Tx, before time.Time, getStmt, deleteStmt, addStmt string,
+	keyArgs func(movieKey) []interface{}) error {
+	type month struct {
+		key   movieKey
+		start time.Time
+	}
+	var (
+		sums = make(map[month]uint64)
+		// Months with any day besides their first, which need
+		// compacting
+		uncompacted = make(map[month]bool)
+	)
+	rows, err := trans.Query(s.stmt(getStmt), before)
+	if err != nil {
 		return err
 	}
-	if err := connectRoot(databaseName); err != nil {
+	for rows.Next() {
+		var (
+			key       movieKey
+			day       time.Time
+			downloads uint64
+		)
+		if err := rows.Scan(&key.Path, &key.Name, &day, &downloads); err != nil {
+			rows.Close()
+			return err
+		}
+		m := month{key, downloadMonth(day)}
+		sums[m] += downloads
+		if !day.Equal(m.start) {
+			uncompacted[m] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		return err
 	}
+	for m := range uncompacted {
+		if _, err := trans.Exec(s.stmt(deleteStmt), append(keyArgs(m.key), m.start, m.start.AddDate(0, 1, 0))...); err != nil {
+			return err
+		}
+		if _, err := trans.Exec(s.stmt(addStmt), append(keyArgs(m.key), m.start, sums[m])...); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Adds some predefined SQL statements to a map
-func buildSQLMap() {
-	// newMovie adds a movie to the movies table. If the movie is
-	// already there, it will throw a dup key error
-	sqlStatements["newMovie"] = "INSERT INTO movies(path, name) VALUES (?, ?)"
+func (s *sqlStore) CompactDownloadStats(before time.Time) error {
+	trans, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.compactStats(trans, before, "getOldMovieDownloads", "deleteMovieDownloads", "addMovieDownloads",
+		func(key movieKey) []interface{} { return []interface{}{key.Path, key.Name} }); err != nil {
+		trans.Rollback()
+		return err
+	}
+	if err := s.compactStats(trans, before, "getOldLibraryDownloads", "deleteLibraryDownloads", "addLibraryDownloads",
+		func(key movieKey) []interface{} { return []interface{}{key.Path} }); err != nil {
+		trans.Rollback()
+		return err
+	}
+	return trans.Commit()
+}
+
+func (s *sqlStore) NewDownloadEvent(event downloadEvent) error {
+	var rangeHeader sql.NullString
+	if event.Range != "" {
+		rangeHeader = sql.NullString{String: event.Range, Valid: true}
+	}
+	_, err := s.exec("newDownloadEvent", event.User, event.Library, event.Name,
+		event.Started.UTC(), event.Finished.UTC(), event.Bytes, event.Status, rangeHeader, event.IP)
+	return err
+}
 
-	// deleteMovie deletes a movie from the table. If there is no
-	// movie, it won't do anything, but it will say that 0 rows
-	// were affected
-	sqlStatements["deleteMovie"] = "DELETE FROM movies where path=? and name=?"
+func (s *sqlStore) DownloadEvents(q downloadEventQuery) (uint64, []downloadEvent, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	for _, filter := range []struct{ cond, value string }{
+		{"username = ?", q.User}, {"library = ?", q.Library}, {"name = ?", q.Name}, {s.nameLike, q.Pattern},
+	} {
+		if filter.value != "" {
+			conds = append(conds, filter.cond)
+			args = append(args, filter.value)
+		}
+	}
+	if q.Status != 0 {
+		conds = append(conds, "status = ?")
+		args = append(args, q.Status)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "started >= ?")
+		args = append(args, q.Since.UTC())
+	}
+	if !q.Until.IsZero() {
+		conds = append(conds, "started < ?")
+		args = append(args, q.Until.UTC())
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
 
-	// addDownload increments the number of downloads for an
-	// existing movie. If the movie isn't there, it won't throw an
-	// error, but it will say that 0 rows were affected.
-	sqlStatements["addDownload"] = "UPDATE movies SET downloads=downloads+1 WHERE path=? AND name=?"
+	var total uint64
+	if err := s.db.QueryRow(s.stmt("countDownloadEvents", where), args...).Scan(&total); err != nil {
+		return 0, nil, err
+	}
+	limit := ""
+	if q.Limit > 0 {
+		limit, args = "LIMIT ? OFFSET ?", append(args, q.Limit, q.Offset)
+	}
+	rows, err := s.db.Query(s.stmt("getDownloadEvents", where, limit), args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	events := make([]downloadEvent, 0)
+	for rows.Next() {
+		var (
+			event       downloadEvent
+			rangeHeader sql.NullString
+		)
+		if err := rows.Scan(&event.ID, &event.User, &event.Library, &event.Name, &event.Started, &event.Finished,
+			&event.Bytes, &event.Status, &rangeHeader, &event.IP); err != nil {
+			return 0, nil, err
+		}
+		event.Range = rangeHeader.String
+		events = append(events, event)
+	}
+	return total, events, rows.Err()
+}
 
-	// getMovies selects all the movie names and downloads from
-	// the movies table that are in moviePaths paths. The three
-	// %s's are meant for WHERE clauses, ORDER BY, and LIMIT
-	sqlStatements["getMovies"] = "SELECT name, downloads FROM movies WHERE %s %s %s"
+// The tables a catalog import replaces the rows of
+var catalogTables = []string{
+	"movies", "users", "user_groups", "library_acl", "api_tokens", "account_locks", "sessions", "share_links",
+	"movie_downloads_daily", "library_downloads_daily", "download_events",
+}
 
-	// getMovieNum is the same as getMovies except it's a COUNT(*)
-	// query. We don't need ORDER BY and LIMIT, though.
-	sqlStatements["getMovieNum"] = "SELECT COUNT(*) FROM movies WHERE %s"
+// The tables whose ids count up by themselves, which Postgres has to
+// be told about after rows are added with explicit ids
+var catalogIDTables = []string{"api_tokens", "share_links", "download_events"}
 
-	// getUserAndPassword selects the row that matches a given
-	// username-password combination
-	sqlStatements["getUserAndPassword"] = "SELECT user from login WHERE user = ? AND password = ?"
+// Runs the named export statement in the transaction, calling scan
+// with each row
+func exportRows(trans *sql.Tx, query string, scan func(*sql.Rows) error) error {
+	rows, err := trans.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
 
-// Sets up the schema and builds the query map
-func startupDB() error {
-	if err := setupSchema(); err != nil {
+// Selects a table's daily statistics, as path, name, day and
+// downloads, into days
+func (s *sqlStore) exportDays(trans *sql.Tx, stmt string, days *[]catalogDailyDownloads) error {
+	return exportRows(trans, s.stmt(stmt), func(rows *sql.Rows) error {
+		var (
+			d   catalogDailyDownloads
+			day time.Time
+		)
+		if err := rows.Scan(&d.Path, &d.Name, &day, &d.Downloads); err != nil {
+			return err
+		}
+		d.Day = day.UTC().Format(dayFormat)
+		*days = append(*days, d)
+		return nil
+	})
+}
+
+// Reads every table in one read-only transaction, so that the catalog
+// is consistent
+func (s *sqlStore) Export() (*catalog, error) {
+	trans, err := s.db.BeginTx(context.Background(), s.readTxOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer trans.Rollback()
+	c := newCatalog()
+	if err := exportRows(trans, s.stmt("exportMovies"), func(rows *sql.Rows) error {
+		var (
+			m     catalogMovie
+			mtime sql.NullTime
+		)
+		if err := rows.Scan(&m.Path, &m.Name, &m.Downloads, &m.Size, &mtime, &m.IsDir, &m.MIME, &m.Fingerprint); err != nil {
+			return err
+		}
+		m.Mtime = mtime.Time.UTC()
+		c.Movies = append(c.Movies, m)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := exportRows(trans, s.stmt("exportUsers"), func(rows *sql.Rows) error {
+		var (
+			u         catalogUser
+			lastLogin sql.NullTime
+		)
+		if err := rows.Scan(&u.Name, &u.PasswordHash, &u.Created, &lastLogin); err != nil {
+			return err
+		}
+		u.Created, u.LastLogin = u.Created.UTC(), timePointer(lastLogin)
+		c.Users = append(c.Users, u)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := exportRows(trans, s.stmt("getGroupMembers"), func(rows *sql.Rows) error {
+		var m catalogGroupMember
+		if err := rows.Scan(&m.Group, &m.User); err != nil {
+			return err
+		}
+		c.Groups = append(c.Groups, m)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := exportRows(trans, s.stmt("getGrants"), func(rows *sql.Rows) error {
+		var g catalogGrant
+		if err := rows.Scan(&g.PrincipalType, &g.Principal, &g.Library); err != nil {
+			return err
+		}
+		c.Grants = append(c.Grants, g)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := exportRows(trans, s.stmt("exportTokens"), func(rows *sql.Rows) error {
+		var (
+			t        catalogToken
+			lastUsed sql.NullTime
+		)
+		if err := rows.Scan(&t.ID, &t.User, &t.Hash, &t.Scope, &t.Created, &lastUsed); err != nil {
+			return err
+		}
+		t.Created, t.LastUsed = t.Created.UTC(), timePointer(lastUsed)
+		c.Tokens = append(c.Tokens, t)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := exportRows(trans, s.stmt("exportLocks"), func(rows *sql.Rows) error {
+		var l catalogLock
+		if err := rows.Scan(&l.User, &l.LockedAt); err != nil {
+			return err
+		}
+		l.LockedAt = l.LockedAt.UTC()
+		c.Locks = append(c.Locks, l)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := exportRows(trans, s.stmt("exportShareLinks"), func(rows *sql.Rows) error {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return err
+		}
+		c.ShareLinks = append(c.ShareLinks, catalogShareLink{
+			ID: link.ID, Creator: link.Creator, Library: link.Library, Name: link.Name,
+			Expires: link.Expires.UTC(), Downloads: link.Downloads,
+		})
+		if link.MaxDownloads.Valid {
+			c.ShareLinks[len(c.ShareLinks)-1].MaxDownloads = &link.MaxDownloads.Int64
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := s.exportDays(trans, "exportMovieDownloads", &c.MovieDownloadsDaily); err != nil {
+		return nil, err
+	}
+	if err := s.exportDays(trans, "exportLibraryDownloads", &c.LibraryDownloadsDaily); err != nil {
+		return nil, err
+	}
+	if err := exportRows(trans, s.stmt("exportDownloadEvents"), func(rows *sql.Rows) error {
+		var (
+			event       downloadEvent
+			rangeHeader sql.NullString
+		)
+		if err := rows.Scan(&event.ID, &event.User, &event.Library, &event.Name, &event.Started, &event.Finished,
+			&event.Bytes, &event.Status, &rangeHeader, &event.IP); err != nil {
+			return err
+		}
+		event.Started, event.Finished, event.Range = event.Started.UTC(), event.Finished.UTC(), rangeHeader.String
+		c.DownloadEvents = append(c.DownloadEvents, event)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Adds the rows of a catalog to the emptied tables in the transaction
+func (s *sqlStore) importRows(trans *sql.Tx, c *catalog) error {
+	insert := func(stmt string, args ...interface{}) error {
+		_, err := trans.Exec(s.stmt(stmt), args...)
 		return err
 	}
-	buildSQLMap()
+	for _, m := range c.Movies {
+		if err := insert("importMovie", m.Path, m.Name, m.Downloads, m.Size, m.Mtime.UTC(), m.IsDir, m.MIME, m.Fingerprint); err != nil {
+			return err
+		}
+	}
+	for _, u := range c.Users {
+		if err := insert("importUser", u.Name, u.PasswordHash, u.Created.UTC(), nullTime(u.LastLogin)); err != nil {
+			return err
+		}
+	}
+	for _, m := range c.Groups {
+		if err := insert("addGroupMember", m.Group, m.User); err != nil {
+			return err
+		}
+	}
+	for _, g := range c.Grants {
+		if err := insert("grantLibrary", g.PrincipalType, g.Principal, g.Library); err != nil {
+			return err
+		}
+	}
+	for _, t := range c.Tokens {
+		if err := insert("importToken", t.ID, t.User, t.Hash, t.Scope, t.Created.UTC(), nullTime(t.LastUsed)); err != nil {
+			return err
+		}
+	}
+	for _, l := range c.Locks {
+		if err := insert("importLock", l.User, l.LockedAt.UTC()); err != nil {
+			return err
+		}
+	}
+	for _, link := range c.ShareLinks {
+		var maxDownloads sql.NullInt64
+		if link.MaxDownloads != nil {
+			maxDownloads = sql.NullInt64{Int64: *link.MaxDownloads, Valid: true}
+		}
+		if err := insert("importShareLink", link.ID, link.Creator, link.Library, link.Name, link.Expires.UTC(),
+			maxDownloads, link.Downloads); err != nil {
+			return err
+		}
+	}
+	// The days were checked by readCatalog
+	for _, d := range c.MovieDownloadsDaily {
+		day, _ := time.Parse(dayFormat, d.Day)
+		if err := insert("addMovieDownloads", d.Path, d.Name, day, d.Downloads); err != nil {
+			return err
+		}
+	}
+	for _, d := range c.LibraryDownloadsDaily {
+		day, _ := time.Parse(dayFormat, d.Day)
+		if err := insert("addLibraryDownloads", d.Path, day, d.Downloads); err != nil {
+			return err
+		}
+	}
+	for _, event := range c.DownloadEvents {
+		var rangeHeader sql.NullString
+		if event.Range != "" {
+			rangeHeader = sql.NullString{String: event.Range, Valid: true}
+		}
+		if err := insert("importDownloadEvent", event.ID, event.User, event.Library, event.Name, event.Started.UTC(),
+			event.Finished.UTC(), event.Bytes, event.Status, rangeHeader, event.IP); err != nil {
+			return err
+		}
+	}
+	// Only Postgres has a statement for this, since the other
+	// databases move their counters past explicit ids themselves
+	if _, ok := s.stmts["resetIDSequence"]; ok {
+		for _, table := range catalogIDTables {
+			if _, err := trans.Exec(s.stmt("resetIDSequence", table, table)); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// Closes the dbHandle
-func cleanupDB() {
-	glog.V(vLevel).Info("Cleaning up DB connection")
-	if err := dbHandle.Close(); err != nil {
-		glog.Errorf("Error during DB cleanup: %s", err)
+func (s *sqlStore) Import(c *catalog) error {
+	trans, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, table := range catalogTables {
+		if _, err := trans.Exec(s.stmt("clearTable", table)); err != nil {
+			trans.Rollback()
+			return err
+		}
 	}
+	if err := s.importRows(trans, c); err != nil {
+		trans.Rollback()
+		return err
+	}
+	return trans.Commit()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
 }
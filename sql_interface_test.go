@@ -0,0 +1,106 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of the SQL statements and the MySQL connection settings
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Sets a flag for the rest of the test
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	check(t, flag.Set(name, value))
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+func TestMySQLConfig(t *testing.T) {
+	t.Setenv(mysqlPasswordEnv, "")
+	cfg, err := mysqlConfig("movieserver")
+	check(t, err)
+	expect(t, "default address", []string{cfg.Net, cfg.Addr}, []string{"tcp", "127.0.0.1:3306"})
+	expect(t, "default user", []string{cfg.User, cfg.Passwd}, []string{"root", ""})
+	expect(t, "database", cfg.DBName, "movieserver")
+	expect(t, "default TLS", cfg.TLSConfig, "false")
+	expect(t, "parse time", cfg.ParseTime, true)
+	expect(t, "client found rows", cfg.ClientFoundRows, true)
+	expect(t, "time zone", cfg.Params["time_zone"], "'+00:00'")
+
+	setFlag(t, "mysql-host", "::1")
+	setFlag(t, "mysql-port", "3307")
+	setFlag(t, "mysql-user", "movieserver")
+	t.Setenv(mysqlPasswordEnv, "from the environment")
+	cfg, err = mysqlConfig("")
+	check(t, err)
+	expect(t, "host and port", cfg.Addr, "[::1]:3307")
+	expect(t, "user", []string{cfg.User, cfg.Passwd}, []string{"movieserver", "from the environment"})
+
+	// Password files win over the environment
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	check(t, ioutil.WriteFile(passwordFile, []byte("from a file\n"), 0600))
+	setFlag(t, "mysql-password-file", passwordFile)
+	setFlag(t, "mysql-socket", "/run/mysqld/mysqld.sock")
+	cfg, err = mysqlConfig("")
+	check(t, err)
+	expect(t, "socket", []string{cfg.Net, cfg.Addr}, []string{"unix", "/run/mysqld/mysqld.sock"})
+	expect(t, "password from a file", cfg.Passwd, "from a file")
+
+	setFlag(t, "mysql-tls", "skip-verify")
+	cfg, err = mysqlConfig("")
+	check(t, err)
+	expect(t, "TLS", cfg.TLSConfig, "skip-verify")
+}
+
+func TestMySQLTLSErrors(t *testing.T) {
+	setFlag(t, "mysql-tls", "maybe")
+	if _, err := mysqlTLSSetting(); err == nil {
+		t.Error("An invalid mysql-tls was accepted")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	check(t, ioutil.WriteFile(caFile, []byte("not a certificate"), 0600))
+	setFlag(t, "mysql-tls", "false")
+	setFlag(t, "mysql-tls-ca", caFile)
+	if _, err := mysqlTLSSetting(); err == nil {
+		t.Error("A CA was accepted without TLS")
+	}
+	setFlag(t, "mysql-tls", "true")
+	if _, err := mysqlTLSSetting(); err == nil {
+		t.Error("A CA file without certificates was accepted")
+	}
+}
+
+func TestNumberParams(t *testing.T) {
+	for query, want := range map[string]string{
+		"SELECT 1":                         "SELECT 1",
+		"name = ? AND path = ?":            "name = $1 AND path = $2",
+		"principal_type = 'a?b' AND x = ?": "principal_type = 'a?b' AND x = $1",
+		"'it''s?' = ? LIMIT ? OFFSET ?":    "'it''s?' = $1 LIMIT $2 OFFSET $3",
+	} {
+		expect(t, query, numberParams(query), want)
+	}
+
+	s := &sqlStore{stmts: buildPostgresMap(), numberedParams: true}
+	expect(t, "formatted statement", s.stmt("getMovies", "path = ?", "ORDER BY name", "LIMIT ? OFFSET ?"),
+		"SELECT name, downloads, size, mtime, is_dir, mime FROM movies WHERE path = $1 ORDER BY name LIMIT $2 OFFSET $3")
+	expect(t, "insert ignore", s.stmt("lockAccount"),
+		"INSERT INTO account_locks(username) SELECT username FROM users WHERE username = $1 ON CONFLICT DO NOTHING")
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// The SQLite backend, which keeps everything in a single file so the
+// server can run without a database server. It uses a pure Go driver,
+// so the binary doesn't need cgo.
+
+package main
+
+import (
+	"database/sql"
+	_ "modernc.org/sqlite"
+	"net/url"
+)
+
+// Returns the statements of buildSQLMap, changed where SQLite's
+// dialect differs from MySQL's
+func buildSQLiteMap() map[string]string {
+	sqlStatements := buildSQLMap()
+	for _, name := range []string{"grantLibrary", "addGroupMember", "lockAccount"} {
+		sqlStatements[name] = "INSERT OR IGNORE" + sqlStatements[name][len("INSERT IGNORE"):]
+	}
+	useOnConflictUpserts(sqlStatements)
+	return sqlStatements
+}
+
+// Opens the SQLite database in the given file, creating it if
+// necessary, and applies any pending schema migrations if migrate is
+// true. Waits on a locked database instead of failing right away, and
+// uses write-ahead logging so that readers don't block the indexer.
+// SQLite only allows one writer at a time anyway, so the store uses a
+// single connection, which also keeps a transaction from waiting on a
+// statement in another connection.
+func openSQLiteStore(filename string, migrate bool) (*sqlStore, error) {
+	dsn := "file:" + filename + "?" + url.Values{
+		"_pragma": {"busy_timeout(10000)", "journal_mode(WAL)"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// SQLite's LIKE has no escape character unless it's given
+	s := &sqlStore{db: db, stmts: buildSQLiteMap(), nameLike: `name LIKE ? ESCAPE '\'`, dialect: sqliteBackend}
+	if migrate {
+		if err := s.migrate(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
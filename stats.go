@@ -0,0 +1,172 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Download statistics. Besides its total, every download of a movie is
+// counted in the movie's and its library's statistics for the day (in
+// UTC). Users can fetch the most downloaded movies of a range of days
+// through topURL. Days older than the stats-day-retention flag are
+// compacted into one count per month by a heartbeat task.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// The format of days in the statistics
+	dayFormat = "2006-01-02"
+	// The number of days the top handler covers when the request
+	// doesn't give a since day
+	defaultTopDays = 30
+	// The number of movies the top handler returns when the
+	// request doesn't say
+	defaultTopMovies = 10
+	// The most movies the top handler returns
+	maxTopMovies = 100
+)
+
+// Returns the day of a time, as midnight UTC
+func downloadDay(t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Returns the first day of the month of a time, as midnight UTC
+func downloadMonth(t time.Time) time.Time {
+	year, month, _ := t.UTC().Date()
+	return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// A heartbeat task that compacts the statistics of the months that
+// ended before stats-day-retention ago
+func compactDownloadStats(name string) error {
+	return dbStore.CompactDownloadStats(downloadMonth(time.Now().Add(-*statsDayRetention)))
+}
+
+// Parses a day given as YYYY-MM-DD or an RFC 3339 time
+func parseDay(value string) (time.Time, error) {
+	if t, err := time.Parse(dayFormat, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%s is neither YYYY-MM-DD nor an RFC 3339 time", value)
+	}
+	return downloadDay(t), nil
+}
+
+// A movie in the top handler's response
+type topMovie struct {
+	Library   string `json:"library"`
+	Name      string `json:"name"`
+	Downloads uint64 `json:"downloads"`
+}
+
+// Serves the most downloaded movies of the libraries the user can
+// access, along with each library's downloads, as a JSON object. The
+// request can narrow it down to one library, and give the range of
+// days with since and until (YYYY-MM-DD, until not included) and the
+// number of movies with limit. It covers the last defaultTopDays days
+// by default.
+func topHandler(w http.ResponseWriter, r *http.Request) {
+	httpError := func(err error, code int) {
+		glog.Errorf("Error in top handler: %s", err)
+		http.Error(w, fmt.Sprintf("Failed to fetch download statistics: %s", err), code)
+	}
+
+	allowed, err := allowedLibraries(requestUser(r))
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	if library := query.Get("library"); library != "" {
+		if _, ok := moviePaths[library]; !ok {
+			httpError(fmt.Errorf("Invalid key name: %s", library), http.StatusBadRequest)
+			return
+		}
+		if !allowed[library] {
+			httpError(fmt.Errorf("%s cannot access %s", requestUser(r), library), http.StatusForbidden)
+			return
+		}
+		allowed = map[string]bool{library: true}
+	}
+
+	q := downloadStatsQuery{Until: downloadDay(time.Now()).AddDate(0, 0, 1), Limit: defaultTopMovies}
+	if value := query.Get("until"); value != "" {
+		if q.Until, err = parseDay(value); err != nil {
+			httpError(fmt.Errorf("Invalid until: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	q.Since = q.Until.AddDate(0, 0, -defaultTopDays)
+	if value := query.Get("since"); value != "" {
+		if q.Since, err = parseDay(value); err != nil {
+			httpError(fmt.Errorf("Invalid since: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if q.Limit, err = strconv.ParseUint(value, 10, 64); err != nil || q.Limit == 0 || q.Limit > maxTopMovies {
+			httpError(fmt.Errorf("limit must be between 1 and %d", maxTopMovies), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The statistics are kept by path, so they're mapped back to
+	// library keys
+	libraryKeys := make(map[string]string)
+	for library := range allowed {
+		q.Paths = append(q.Paths, moviePaths[library])
+		libraryKeys[moviePaths[library]] = library
+	}
+	movies, err := dbStore.TopMovies(q)
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+	libraryDownloads, err := dbStore.LibraryDownloads(q)
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+	libraries := make(map[string]uint64)
+	for library := range allowed {
+		libraries[library] = libraryDownloads[moviePaths[library]]
+	}
+	topMovies := make([]topMovie, len(movies))
+	for i, m := range movies {
+		topMovies[i] = topMovie{libraryKeys[m.Path], m.Name, m.Downloads}
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"since":     q.Since.Format(dayFormat),
+		"until":     q.Until.Format(dayFormat),
+		"libraries": libraries,
+		"movies":    topMovies,
+	})
+	if err != nil {
+		httpError(err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(jsonData))
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// The storage interface that the rest of the server persists movies,
+// users and everything else through, so that the database behind it
+// can be chosen with the db-backend flag
+
+package main
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"time"
+)
+
+const (
+	mysqlBackend    = "mysql"
+	postgresBackend = "postgres"
+	sqliteBackend   = "sqlite"
+	memoryBackend   = "memory"
+)
+
+// The store the server uses. It is set by startupDB.
+var dbStore store
+
+// A movie in the index, named by the library path it's in and its
+// path relative to that
+type movieKey struct {
+	Path string
+	Name string
+}
+
+// What the indexer records about a movie's file or directory
+type movieMeta struct {
+	// The size of a file, or the total size of the files in a
+	// directory
+	Size uint64 `json:"size"`
+	// The modification time, to the second
+	Mtime time.Time `json:"mtime"`
+	IsDir bool      `json:"is_dir"`
+	MIME  string    `json:"mime"`
+}
+
+// Returns true if the metadata is the same, whatever the time zones of
+// the modification times
+func (m movieMeta) equal(other movieMeta) bool {
+	return m.Size == other.Size && m.Mtime.Equal(other.Mtime) && m.IsDir == other.IsDir && m.MIME == other.MIME
+}
+
+// An indexed movie, its metadata and its fingerprint
+type indexedMovie struct {
+	movieKey
+	movieMeta
+	// Identifies the movie's contents wherever it is, so that the
+	// indexer can tell a renamed or moved movie from a new one. It
+	// is empty for empty files and directories, which can't be told
+	// apart, and for movies indexed before there were fingerprints.
+	Fingerprint string
+}
+
+// A movie the indexer found under a new key, which keeps its
+// downloads and statistics
+type movedMovie struct {
+	From movieKey
+	indexedMovie
+}
+
+// The columns of the movie table that clients can sort by
+var sortableMovieColumns = map[string]bool{
+	"name":      true,
+	"downloads": true,
+	"size":      true,
+	"mtime":     true,
+}
+
+// A query of the movies in one library path
+type movieQuery struct {
+	Path string
+	// If non-empty, only names matching this LIKE pattern (with
+	// backslash escapes) are returned
+	Pattern string
+	// If non-empty, one of sortableMovieColumns
+	SortBy     string
+	Descending bool
+	// If Limit is 0, every matching movie is returned
+	Offset, Limit uint64
+}
+
+// A query of the daily download statistics
+type downloadStatsQuery struct {
+	Paths []string
+	// Downloads on the days from Since up to but not including
+	// Until
+	Since, Until time.Time
+	// The most movies to return
+	Limit uint64
+}
+
+// The downloads of a movie over a range of days
+type movieDownloads struct {
+	movieKey
+	Downloads uint64
+}
+
+// A query of the download audit log. Empty fields don't filter
+// anything.
+type downloadEventQuery struct {
+	User, Library, Name string
+	// A LIKE pattern (with backslash escapes) that names must
+	// match
+	Pattern string
+	Status  int
+	// Events started at or after Since and before Until
+	Since, Until time.Time
+	// If Limit is 0, every matching event is returned
+	Offset, Limit uint64
+}
+
+// Persists everything the server keeps. Methods returning a bool
+// along with an error report whether the thing they looked up or
+// changed existed.
+type store interface {
+	// Returns every indexed movie in the given library paths, with
+	// its metadata
+	IndexedMovies(paths []string) ([]indexedMovie, error)
+	// Returns the movies with fingerprints in library paths other
+	// than the given ones, which the indexer can move into them
+	OrphanedMovies(paths []string) ([]indexedMovie, error)
+	// Adds movies to the index, updates the metadata of changed
+	// ones, moves movies to new keys along with their statistics
+	// and removes movies from it, all at once. A moved movie whose
+	// old key isn't indexed anymore is added.
+	UpdateMovies(added, changed []indexedMovie, moved []movedMovie, removed []movieKey) error
+	// Adds the daily statistics of one library path to another's,
+	// for when a library moves
+	MoveLibraryDownloads(from, to string) error
+	// Counts a download of an indexed movie, in its total and in
+	// the statistics of the movie and its library for the day of
+	// when
+	AddDownload(path, name string, when time.Time) (bool, error)
+	// Returns the number of movies matching the query and a page of
+	// them. If the offset is past the last movie, it returns the
+	// first page instead.
+	Movies(q movieQuery) (uint64, []movieRow, error)
+
+	PasswordHash(user string) (string, bool, error)
+	// Sets the user's last login time to now
+	UpdateLastLogin(user string) error
+	// Adds a user, failing if the user already exists
+	NewUser(user, hash string) error
+	SetPasswordHash(user, hash string) (bool, error)
+	// Deletes a user along with their group memberships, library
+	// grants, API tokens, lock, sessions and share links, so that
+	// a new user with the same name doesn't inherit them
+	DeleteUser(user string) (bool, error)
+	// Returns every user, sorted by name
+	Users() ([]userInfo, error)
+
+	// Returns the libraries granted to a user, directly or through
+	// the user's groups
+	UserLibraries(user string) ([]string, error)
+	GrantLibrary(principalType, principal, library string) error
+	RevokeLibrary(principalType, principal, library string) (bool, error)
+	Grants() ([]libraryGrant, error)
+	AddGroupMember(group, user string) error
+	RemoveGroupMember(group, user string) (bool, error)
+	IsGroupMember(group, user string) (bool, error)
+	GroupMembers() ([]groupMember, error)
+
+	NewToken(user, hash, scope string) error
+	// Returns the user and scope of the token with the given hash,
+	// recording that it was used. The user is empty if there is
+	// no such token.
+	UseToken(hash string) (string, string, error)
+	DeleteToken(id uint64) (bool, error)
+	// Returns the tokens of the given user, or of every user if
+	// the user is empty
+	Tokens(user string) ([]apiToken, error)
+
+	IsLocked(user string) (bool, error)
+	LockAccount(user string) error
+	UnlockAccount(user string) (bool, error)
+
+	NewSession(idHash, user string, expires time.Time, ip, userAgent string) error
+	// Sets the last seen time of an unexpired session to now
+	TouchSession(idHash, user string) (bool, error)
+	// Returns the unexpired sessions of the given user, or of every
+	// user if the user is empty, most recently seen first
+	Sessions(user string) ([]sessionRow, error)
+	DeleteSession(idHash, user string) (bool, error)
+	// These return the number of sessions deleted
+	DeleteUserSessions(user string) (int64, error)
+	DeleteExpiredSessions() (int64, error)
+
+	// Adds a share link, returning its id
+	NewShareLink(link shareLink) (uint64, error)
+	ShareLink(id uint64) (shareLink, bool, error)
+	// Returns the unexpired share links created by the given user,
+	// or by every user if the creator is empty
+	ShareLinks(creator string) ([]shareLink, error)
+	// Counts a download of an unexpired share link that has
+	// downloads left
+	AddShareDownload(id uint64) (bool, error)
+	DeleteShareLink(id uint64) (bool, error)
+
+	// Returns the movies with the most downloads on the query's
+	// days, most downloaded first
+	TopMovies(q downloadStatsQuery) ([]movieDownloads, error)
+	// Returns the downloads of each of the query's paths on its
+	// days
+	LibraryDownloads(q downloadStatsQuery) (map[string]uint64, error)
+	// Merges the daily statistics of the days before the given
+	// one, which must be the first day of a month, into one count
+	// per month, on the month's first day
+	CompactDownloadStats(before time.Time) error
+
+	NewDownloadEvent(event downloadEvent) error
+	// Returns the number of events matching the query and a page
+	// of them, newest first
+	DownloadEvents(q downloadEventQuery) (uint64, []downloadEvent, error)
+
+	// Returns everything the store keeps except sessions
+	Export() (*catalog, error)
+	// Replaces everything the store keeps with the catalog, all at
+	// once, deleting every session
+	Import(c *catalog) error
+
+	Close() error
+}
+
+// Opens the store named by the db-backend flag, applying any pending
+// schema migrations
+func startupDB() error {
+	return openDB(true)
+}
+
+// Opens the store named by the db-backend flag. If migrate is false,
+// the schema is left as it is.
+func openDB(migrate bool) error {
+	var (
+		s   store
+		err error
+	)
+	switch *dbBackend {
+	case mysqlBackend:
+		s, err = openMySQLStore(migrate)
+	case sqliteBackend:
+		s, err = openSQLiteStore(*sqliteFile, migrate)
+	case postgresBackend:
+		s, err = openPostgresStore(*postgresDSN, migrate)
+	case memoryBackend:
+		s, err = openMemoryStore(*memorySnapshot)
+	default:
+		err = fmt.Errorf("Unknown db-backend %q", *dbBackend)
+	}
+	if err != nil {
+		return err
+	}
+	dbStore = s
+	return nil
+}
+
+// Closes the store
+func cleanupDB() {
+	glog.V(vLevel).Info("Cleaning up DB connection")
+	if err := dbStore.Close(); err != nil {
+		glog.Errorf("Error during DB cleanup: %s", err)
+	}
+}
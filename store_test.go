@@ -0,0 +1,913 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Behavior tests that every store backend must pass. Each test runs
+// against every backend in testBackends.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Opens an empty store of each backend
+var testBackends = map[string]func(t *testing.T) (store, error){
+	memoryBackend: func(t *testing.T) (store, error) {
+		return openMemoryStore("")
+	},
+	sqliteBackend: func(t *testing.T) (store, error) {
+		return openSQLiteStore(filepath.Join(t.TempDir(), "movieserver.db"), true)
+	},
+}
+
+// The environment variables that add the database server backends to
+// testBackends. Each test gets a database or schema of its own, which
+// is dropped when it finishes.
+const (
+	// The DSN of a Postgres database to create schemas in
+	testPostgresEnv = "MOVIESERVER_TEST_POSTGRES_DSN"
+	// If set, MySQL is connected to with the mysql flags, which can
+	// be given after go test's -args
+	testMySQLEnv = "MOVIESERVER_TEST_MYSQL"
+)
+
+func init() {
+	if dsn := os.Getenv(testPostgresEnv); dsn != "" {
+		testBackends[postgresBackend] = func(t *testing.T) (store, error) {
+			return openTestPostgresStore(t, dsn)
+		}
+	}
+	if os.Getenv(testMySQLEnv) != "" {
+		testBackends[mysqlBackend] = openTestMySQLStore
+	}
+}
+
+// Returns a name for a test's database or schema
+func testDatabaseName() string {
+	return fmt.Sprintf("movieserver_test_%d", time.Now().UnixNano())
+}
+
+// Opens a store in a new schema of the Postgres database
+func openTestPostgresStore(t *testing.T, dsn string) (store, error) {
+	db, err := connectPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	schema := testDatabaseName()
+	if _, err := db.Exec("CREATE SCHEMA " + schema); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() {
+		db, err := connectPostgres(dsn)
+		if err != nil {
+			t.Errorf("Dropping schema %s: %s", schema, err)
+			return
+		}
+		defer db.Close()
+		if _, err := db.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("Dropping schema %s: %s", schema, err)
+		}
+	})
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return nil, err
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	return openPostgresStore(dsn, true)
+}
+
+// Opens a store in a new MySQL database
+func openTestMySQLStore(t *testing.T) (store, error) {
+	name := testDatabaseName()
+	setFlag(t, "mysql-database", name)
+	t.Cleanup(func() {
+		db, err := connectMySQL("")
+		if err != nil {
+			t.Errorf("Dropping database %s: %s", name, err)
+			return
+		}
+		defer db.Close()
+		if _, err := db.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+			t.Errorf("Dropping database %s: %s", name, err)
+		}
+	})
+	return openMySQLStore(true)
+}
+
+// Runs the test against an empty store of each backend
+func forEachStore(t *testing.T, test func(t *testing.T, s store)) {
+	for backend, open := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			s, err := open(t)
+			if err != nil {
+				t.Fatalf("Opening %s store: %s", backend, err)
+			}
+			defer s.Close()
+			test(t, s)
+		})
+	}
+}
+
+// Fails the test if err isn't nil
+func check(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Fails the test if got and want aren't deeply equal
+func expect(t testing.TB, what string, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func movieNames(movies []movieRow) []string {
+	names := make([]string, len(movies))
+	for i, m := range movies {
+		names[i] = m.Name
+	}
+	return names
+}
+
+// Returns an indexed movie file of the given size, modified the given
+// number of minutes into 2014
+func testMovie(path, name string, size uint64, minutes int) indexedMovie {
+	mtime := time.Date(2014, 1, 1, 0, minutes, 0, 0, time.UTC)
+	return indexedMovie{movieKey{path, name}, movieMeta{size, mtime, false, "video/x-matroska"}, ""}
+}
+
+func TestStoreMovies(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		brazil := testMovie("/a", "Brazil", 300, 1)
+		check(t, s.UpdateMovies([]indexedMovie{
+			testMovie("/a", "Alien", 100, 3), testMovie("/a", "Aliens", 400, 2), brazil,
+			testMovie("/a", "100%", 200, 4), testMovie("/b", "Alien", 100, 0),
+		}, nil, nil, nil))
+		if err := s.UpdateMovies([]indexedMovie{testMovie("/a", "Alien", 100, 0)}, nil, nil, nil); err == nil {
+			t.Error("Indexing a movie twice succeeded")
+		}
+
+		indexed, err := s.IndexedMovies([]string{"/b"})
+		check(t, err)
+		expect(t, "indexed movies", indexed, []indexedMovie{testMovie("/b", "Alien", 100, 0)})
+
+		for i := 0; i < 2; i++ {
+			ok, err := s.AddDownload("/a", "Brazil", time.Now())
+			check(t, err)
+			expect(t, "download counted", ok, true)
+		}
+		ok, err := s.AddDownload("/a", "Missing", time.Now())
+		check(t, err)
+		expect(t, "missing movie download counted", ok, false)
+
+		total, movies, err := s.Movies(movieQuery{Path: "/a", SortBy: "name"})
+		check(t, err)
+		expect(t, "total", total, uint64(4))
+		expect(t, "sorted names", movieNames(movies), []string{"100%", "Alien", "Aliens", "Brazil"})
+
+		_, movies, err = s.Movies(movieQuery{Path: "/a", SortBy: "downloads", Descending: true, Limit: 1})
+		check(t, err)
+		expect(t, "most downloaded", movies, []movieRow{{"Brazil", 2, brazil.movieMeta}})
+
+		_, movies, err = s.Movies(movieQuery{Path: "/a", SortBy: "size", Descending: true})
+		check(t, err)
+		expect(t, "sorted by size", movieNames(movies), []string{"Aliens", "Brazil", "100%", "Alien"})
+
+		_, movies, err = s.Movies(movieQuery{Path: "/a", SortBy: "mtime"})
+		check(t, err)
+		expect(t, "sorted by mtime", movieNames(movies), []string{"Brazil", "Aliens", "Alien", "100%"})
+
+		total, movies, err = s.Movies(movieQuery{Path: "/a", Pattern: "ali%", SortBy: "name"})
+		check(t, err)
+		expect(t, "filtered total", total, uint64(2))
+		expect(t, "filtered names", movieNames(movies), []string{"Alien", "Aliens"})
+
+		_, movies, err = s.Movies(movieQuery{Path: "/a", Pattern: `100\%`})
+		check(t, err)
+		expect(t, "escaped filter", movieNames(movies), []string{"100%"})
+
+		_, movies, err = s.Movies(movieQuery{Path: "/a", SortBy: "name", Offset: 2, Limit: 2})
+		check(t, err)
+		expect(t, "second page", movieNames(movies), []string{"Aliens", "Brazil"})
+
+		// Pages past the end return the first page
+		_, movies, err = s.Movies(movieQuery{Path: "/a", SortBy: "name", Offset: 10, Limit: 2})
+		check(t, err)
+		expect(t, "page past the end", movieNames(movies), []string{"100%", "Alien"})
+
+		if _, _, err := s.Movies(movieQuery{Path: "/a", SortBy: "name; DROP TABLE movies"}); err == nil {
+			t.Error("Sorting by an unknown column succeeded")
+		}
+
+		// Changing the metadata keeps the downloads
+		brazil.movieMeta = movieMeta{Size: 1000, Mtime: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), IsDir: true, MIME: directoryMIME}
+		check(t, s.UpdateMovies(nil, []indexedMovie{brazil}, nil, nil))
+		_, movies, err = s.Movies(movieQuery{Path: "/a", Pattern: "brazil"})
+		check(t, err)
+		expect(t, "changed movie", movies, []movieRow{{"Brazil", 2, brazil.movieMeta}})
+
+		check(t, s.UpdateMovies(nil, nil, nil, []movieKey{{"/a", "Alien"}, {"/a", "100%"}}))
+		total, _, err = s.Movies(movieQuery{Path: "/a"})
+		check(t, err)
+		expect(t, "total after removal", total, uint64(2))
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		check(t, s.NewUser("bob", "hash1"))
+		if err := s.NewUser("bob", "hash2"); err == nil {
+			t.Error("Adding a duplicate user succeeded")
+		}
+		hash, ok, err := s.PasswordHash("bob")
+		check(t, err)
+		expect(t, "password hash", []interface{}{hash, ok}, []interface{}{"hash1", true})
+		_, ok, err = s.PasswordHash("alice")
+		check(t, err)
+		expect(t, "missing user found", ok, false)
+
+		ok, err = s.SetPasswordHash("bob", "hash3")
+		check(t, err)
+		expect(t, "password changed", ok, true)
+		hash, _, err = s.PasswordHash("bob")
+		check(t, err)
+		expect(t, "changed hash", hash, "hash3")
+
+		check(t, s.UpdateLastLogin("bob"))
+		check(t, s.LockAccount("bob"))
+		check(t, s.NewUser("alice", "hash"))
+		users, err := s.Users()
+		check(t, err)
+		if len(users) != 2 || users[0].Name != "alice" || users[1].Name != "bob" {
+			t.Fatalf("users: got %v, want alice and bob", users)
+		}
+		expect(t, "alice's last login", users[0].LastLogin.Valid, false)
+		expect(t, "bob's last login", users[1].LastLogin.Valid, true)
+		expect(t, "alice locked", users[0].LockedAt.Valid, false)
+		expect(t, "bob locked", users[1].LockedAt.Valid, true)
+
+		// Deleting a user deletes everything that belongs to them
+		check(t, s.AddGroupMember("friends", "bob"))
+		check(t, s.GrantLibrary(principalUser, "bob", "a"))
+		check(t, s.NewToken("bob", "tokenhash", "read"))
+		check(t, s.NewSession("sessionhash", "bob", time.Now().Add(time.Hour), "127.0.0.1", "test"))
+		_, err = s.NewShareLink(shareLink{Creator: "bob", Library: "a", Name: "Alien", Expires: time.Now().Add(time.Hour)})
+		check(t, err)
+		ok, err = s.DeleteUser("bob")
+		check(t, err)
+		expect(t, "user deleted", ok, true)
+		ok, err = s.DeleteUser("bob")
+		check(t, err)
+		expect(t, "user deleted twice", ok, false)
+
+		check(t, s.NewUser("bob", "hash"))
+		libraries, err := s.UserLibraries("bob")
+		check(t, err)
+		expect(t, "inherited libraries", len(libraries), 0)
+		ok, err = s.IsGroupMember("friends", "bob")
+		check(t, err)
+		expect(t, "inherited group", ok, false)
+		tokens, err := s.Tokens("bob")
+		check(t, err)
+		expect(t, "inherited tokens", len(tokens), 0)
+		ok, err = s.IsLocked("bob")
+		check(t, err)
+		expect(t, "inherited lock", ok, false)
+		sessions, err := s.Sessions("bob")
+		check(t, err)
+		expect(t, "inherited sessions", len(sessions), 0)
+		links, err := s.ShareLinks("bob")
+		check(t, err)
+		expect(t, "inherited share links", len(links), 0)
+	})
+}
+
+func TestStoreAccess(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		check(t, s.GrantLibrary(principalUser, "bob", "a"))
+		check(t, s.GrantLibrary(principalUser, "bob", "a"))
+		check(t, s.GrantLibrary(principalGroup, "friends", "a"))
+		check(t, s.GrantLibrary(principalGroup, "friends", "b"))
+		check(t, s.AddGroupMember("friends", "bob"))
+		check(t, s.AddGroupMember("friends", "bob"))
+		check(t, s.AddGroupMember("admin", "alice"))
+
+		libraries, err := s.UserLibraries("bob")
+		check(t, err)
+		granted := make(map[string]bool)
+		for _, library := range libraries {
+			granted[library] = true
+		}
+		expect(t, "bob's libraries", granted, map[string]bool{"a": true, "b": true})
+
+		ok, err := s.IsGroupMember("admin", "alice")
+		check(t, err)
+		expect(t, "alice is an admin", ok, true)
+		ok, err = s.IsGroupMember("admin", "bob")
+		check(t, err)
+		expect(t, "bob is an admin", ok, false)
+
+		grants, err := s.Grants()
+		check(t, err)
+		expect(t, "grants", grants, []libraryGrant{
+			{principalGroup, "friends", "a"},
+			{principalGroup, "friends", "b"},
+			{principalUser, "bob", "a"},
+		})
+		members, err := s.GroupMembers()
+		check(t, err)
+		expect(t, "group members", members, []groupMember{{"admin", "alice"}, {"friends", "bob"}})
+
+		ok, err = s.RevokeLibrary(principalGroup, "friends", "b")
+		check(t, err)
+		expect(t, "grant revoked", ok, true)
+		ok, err = s.RevokeLibrary(principalGroup, "friends", "b")
+		check(t, err)
+		expect(t, "grant revoked twice", ok, false)
+		ok, err = s.RemoveGroupMember("friends", "bob")
+		check(t, err)
+		expect(t, "member removed", ok, true)
+		libraries, err = s.UserLibraries("bob")
+		check(t, err)
+		expect(t, "bob's remaining libraries", libraries, []string{"a"})
+	})
+}
+
+func TestStoreTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		check(t, s.NewToken("bob", "hash1", "read"))
+		check(t, s.NewToken("bob", "hash2", "download"))
+		check(t, s.NewToken("alice", "hash3", "admin"))
+
+		user, scope, err := s.UseToken("hash2")
+		check(t, err)
+		expect(t, "token owner", []string{user, scope}, []string{"bob", "download"})
+		user, _, err = s.UseToken("nohash")
+		check(t, err)
+		expect(t, "unknown token owner", user, "")
+
+		tokens, err := s.Tokens("bob")
+		check(t, err)
+		if len(tokens) != 2 {
+			t.Fatalf("bob's tokens: got %v, want 2", tokens)
+		}
+		expect(t, "unused token's last use", tokens[0].LastUsed.Valid, false)
+		expect(t, "used token's last use", tokens[1].LastUsed.Valid, true)
+		all, err := s.Tokens("")
+		check(t, err)
+		expect(t, "every user's tokens", len(all), 3)
+
+		ok, err := s.DeleteToken(tokens[1].ID)
+		check(t, err)
+		expect(t, "token deleted", ok, true)
+		user, _, err = s.UseToken("hash2")
+		check(t, err)
+		expect(t, "deleted token owner", user, "")
+		ok, err = s.DeleteToken(tokens[1].ID)
+		check(t, err)
+		expect(t, "token deleted twice", ok, false)
+	})
+}
+
+func TestStoreLocks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		check(t, s.NewUser("bob", "hash"))
+		check(t, s.LockAccount("bob"))
+		check(t, s.LockAccount("bob"))
+		ok, err := s.IsLocked("bob")
+		check(t, err)
+		expect(t, "locked", ok, true)
+		ok, err = s.UnlockAccount("bob")
+		check(t, err)
+		expect(t, "unlocked", ok, true)
+		ok, err = s.UnlockAccount("bob")
+		check(t, err)
+		expect(t, "unlocked twice", ok, false)
+		ok, err = s.IsLocked("bob")
+		check(t, err)
+		expect(t, "locked after unlocking", ok, false)
+
+		// Only users that exist are locked, so that a username
+		// can't be locked before it's created
+		check(t, s.LockAccount("alice"))
+		check(t, s.NewUser("alice", "hash"))
+		ok, err = s.IsLocked("alice")
+		check(t, err)
+		expect(t, "locked before existing", ok, false)
+	})
+}
+
+func TestStoreSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		now := time.Now()
+		check(t, s.NewSession("s1", "bob", now.Add(time.Hour), "127.0.0.1", "curl"))
+		check(t, s.NewSession("s2", "bob", now.Add(time.Hour), "127.0.0.2", "firefox"))
+		check(t, s.NewSession("s3", "alice", now.Add(time.Hour), "127.0.0.3", "chrome"))
+		check(t, s.NewSession("old", "bob", now.Add(-time.Hour), "127.0.0.4", "lynx"))
+
+		ok, err := s.TouchSession("s1", "bob")
+		check(t, err)
+		expect(t, "session touched", ok, true)
+		ok, err = s.TouchSession("s1", "alice")
+		check(t, err)
+		expect(t, "other user's session touched", ok, false)
+		ok, err = s.TouchSession("old", "bob")
+		check(t, err)
+		expect(t, "expired session touched", ok, false)
+
+		sessions, err := s.Sessions("bob")
+		check(t, err)
+		if len(sessions) != 2 {
+			t.Fatalf("bob's sessions: got %v, want 2", sessions)
+		}
+		expect(t, "session fields", []string{sessions[1].ID, sessions[1].IP, sessions[1].UserAgent}, []string{"s2", "127.0.0.2", "firefox"})
+		all, err := s.Sessions("")
+		check(t, err)
+		expect(t, "every user's sessions", len(all), 3)
+
+		ok, err = s.DeleteSession("s3", "bob")
+		check(t, err)
+		expect(t, "other user's session deleted", ok, false)
+		ok, err = s.DeleteSession("s3", "alice")
+		check(t, err)
+		expect(t, "session deleted", ok, true)
+
+		count, err := s.DeleteExpiredSessions()
+		check(t, err)
+		expect(t, "expired sessions deleted", count, int64(1))
+		count, err = s.DeleteUserSessions("bob")
+		check(t, err)
+		expect(t, "user sessions deleted", count, int64(2))
+		all, err = s.Sessions("")
+		check(t, err)
+		expect(t, "sessions left", len(all), 0)
+	})
+}
+
+func TestStoreShareLinks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		link := shareLink{
+			Creator:      "bob",
+			Library:      "a",
+			Name:         "Alien",
+			Expires:      expires,
+			MaxDownloads: sql.NullInt64{Int64: 2, Valid: true},
+		}
+		id, err := s.NewShareLink(link)
+		check(t, err)
+		_, err = s.NewShareLink(shareLink{Creator: "alice", Library: "a", Expires: expires})
+		check(t, err)
+		_, err = s.NewShareLink(shareLink{Creator: "bob", Library: "a", Expires: time.Now().Add(-time.Hour)})
+		check(t, err)
+
+		got, ok, err := s.ShareLink(id)
+		check(t, err)
+		link.ID = id
+		got.Expires = got.Expires.UTC()
+		expect(t, "share link", []interface{}{got, ok}, []interface{}{link, true})
+		_, ok, err = s.ShareLink(id + 100)
+		check(t, err)
+		expect(t, "missing share link found", ok, false)
+
+		for i, want := range []bool{true, true, false} {
+			ok, err := s.AddShareDownload(id)
+			check(t, err)
+			if ok != want {
+				t.Errorf("share download %d: got %v, want %v", i+1, ok, want)
+			}
+		}
+		got, _, err = s.ShareLink(id)
+		check(t, err)
+		expect(t, "share downloads", got.Downloads, uint64(2))
+
+		links, err := s.ShareLinks("bob")
+		check(t, err)
+		expect(t, "bob's unexpired links", len(links), 1)
+		links, err = s.ShareLinks("")
+		check(t, err)
+		expect(t, "every user's unexpired links", len(links), 2)
+
+		ok, err = s.DeleteShareLink(id)
+		check(t, err)
+		expect(t, "share link deleted", ok, true)
+		ok, err = s.DeleteShareLink(id)
+		check(t, err)
+		expect(t, "share link deleted twice", ok, false)
+	})
+}
+
+func TestStoreDownloadEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		for i, e := range []downloadEvent{
+			{User: "bob", Library: "a", Name: "Alien", Status: 200, Bytes: 10},
+			{User: "bob", Library: "a", Name: "Brazil", Status: 206, Range: "bytes=0-9"},
+			{User: "alice", Library: "b", Name: "Alien", Status: 404},
+		} {
+			e.Started = start.Add(time.Duration(i) * time.Hour)
+			e.Finished = e.Started.Add(time.Minute)
+			e.IP = "127.0.0.1"
+			check(t, s.NewDownloadEvent(e))
+		}
+
+		names := func(events []downloadEvent) []string {
+			names := make([]string, len(events))
+			for i, e := range events {
+				names[i] = e.User + "/" + e.Name
+			}
+			return names
+		}
+		total, events, err := s.DownloadEvents(downloadEventQuery{})
+		check(t, err)
+		expect(t, "total", total, uint64(3))
+		expect(t, "newest first", names(events), []string{"alice/Alien", "bob/Brazil", "bob/Alien"})
+		expect(t, "range", events[1].Range, "bytes=0-9")
+
+		for _, c := range []struct {
+			q    downloadEventQuery
+			want []string
+		}{
+			{downloadEventQuery{User: "bob"}, []string{"bob/Brazil", "bob/Alien"}},
+			{downloadEventQuery{Library: "b"}, []string{"alice/Alien"}},
+			{downloadEventQuery{Name: "Alien"}, []string{"alice/Alien", "bob/Alien"}},
+			{downloadEventQuery{Pattern: "br%"}, []string{"bob/Brazil"}},
+			{downloadEventQuery{Status: 206}, []string{"bob/Brazil"}},
+			{downloadEventQuery{Since: start.Add(time.Hour)}, []string{"alice/Alien", "bob/Brazil"}},
+			{downloadEventQuery{Until: start.Add(time.Hour)}, []string{"bob/Alien"}},
+			{downloadEventQuery{Offset: 1, Limit: 1}, []string{"bob/Brazil"}},
+			{downloadEventQuery{Offset: 5, Limit: 1}, []string{}},
+		} {
+			total, events, err := s.DownloadEvents(c.q)
+			check(t, err)
+			expect(t, "filtered events", names(events), c.want)
+			if c.q.Limit == 0 {
+				expect(t, "filtered total", total, uint64(len(c.want)))
+			}
+		}
+	})
+}
+
+func TestStoreDownloadStats(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		check(t, s.UpdateMovies([]indexedMovie{
+			testMovie("/a", "Alien", 100, 0), testMovie("/a", "Brazil", 100, 0), testMovie("/b", "Casablanca", 100, 0),
+		}, nil, nil, nil))
+		day := func(month time.Month, day int) time.Time {
+			return time.Date(2014, month, day, 12, 0, 0, 0, time.UTC)
+		}
+		for _, d := range []struct {
+			name string
+			when time.Time
+		}{
+			{"Alien", day(1, 5)}, {"Alien", day(1, 5)}, {"Alien", day(1, 20)}, {"Alien", day(2, 1)},
+			{"Brazil", day(1, 31)}, {"Brazil", day(2, 2)}, {"Brazil", day(2, 3)}, {"Brazil", day(2, 3)},
+		} {
+			ok, err := s.AddDownload("/a", d.name, d.when)
+			check(t, err)
+			expect(t, "download counted", ok, true)
+		}
+		_, err := s.AddDownload("/b", "Casablanca", day(1, 10))
+		check(t, err)
+		if ok, err := s.AddDownload("/a", "Missing", day(1, 10)); err != nil || ok {
+			t.Errorf("Counting a download of a missing movie: got %v, %v", ok, err)
+		}
+
+		january := downloadStatsQuery{Paths: []string{"/a", "/b"}, Since: day(1, 1), Until: day(2, 1), Limit: 10}
+		february := downloadStatsQuery{Paths: []string{"/a", "/b"}, Since: day(2, 1), Until: day(3, 1), Limit: 10}
+		checkStats := func(when string) {
+			t.Helper()
+			top, err := s.TopMovies(january)
+			check(t, err)
+			expect(t, when+" January top movies", top, []movieDownloads{
+				{movieKey{"/a", "Alien"}, 3}, {movieKey{"/a", "Brazil"}, 1}, {movieKey{"/b", "Casablanca"}, 1},
+			})
+			top, err = s.TopMovies(february)
+			check(t, err)
+			expect(t, when+" February top movies", top, []movieDownloads{{movieKey{"/a", "Brazil"}, 3}, {movieKey{"/a", "Alien"}, 1}})
+			libraries, err := s.LibraryDownloads(january)
+			check(t, err)
+			expect(t, when+" January libraries", libraries, map[string]uint64{"/a": 4, "/b": 1})
+		}
+		checkStats("before compaction")
+
+		top, err := s.TopMovies(downloadStatsQuery{Paths: []string{"/a"}, Since: day(1, 5), Until: day(1, 6), Limit: 1})
+		check(t, err)
+		expect(t, "one day's top movie", top, []movieDownloads{{movieKey{"/a", "Alien"}, 2}})
+		top, err = s.TopMovies(downloadStatsQuery{Since: day(1, 1), Until: day(3, 1), Limit: 1})
+		check(t, err)
+		expect(t, "top movies of no libraries", top, []movieDownloads{})
+
+		// Compacting January keeps the monthly totals, but moves
+		// January's downloads to its first day
+		for i := 0; i < 2; i++ {
+			check(t, s.CompactDownloadStats(time.Date(2014, 2, 1, 0, 0, 0, 0, time.UTC)))
+			checkStats("after compaction")
+		}
+		top, err = s.TopMovies(downloadStatsQuery{Paths: []string{"/a"}, Since: day(1, 1), Until: day(1, 2), Limit: 10})
+		check(t, err)
+		expect(t, "compacted day", top, []movieDownloads{{movieKey{"/a", "Alien"}, 3}, {movieKey{"/a", "Brazil"}, 1}})
+		top, err = s.TopMovies(downloadStatsQuery{Paths: []string{"/a"}, Since: day(2, 3), Until: day(2, 4), Limit: 10})
+		check(t, err)
+		expect(t, "uncompacted day", top, []movieDownloads{{movieKey{"/a", "Brazil"}, 2}})
+	})
+}
+
+// Returns a catalog with a row in every table, with its times to the
+// second so that every backend keeps them exactly
+func testCatalog() *catalog {
+	at := func(day int) time.Time { return time.Date(2014, 1, day, 12, 30, 0, 0, time.UTC) }
+	lastLogin, maxDownloads := at(3), int64(5)
+	c := newCatalog()
+	c.Movies = []catalogMovie{
+		{"/a", "Alien", 3, movieMeta{100, at(1), false, "video/x-matroska"}, "alien"},
+		{"/a", "Brazil", 0, movieMeta{200, at(2), true, directoryMIME}, ""},
+		{"/b", "Casablanca", 1, movieMeta{300, at(1), false, "video/mp4"}, "casablanca"},
+	}
+	c.Users = []catalogUser{{"alice", "hash-a", at(1), &lastLogin}, {"bob", "hash-b", at(2), nil}}
+	c.Groups = []catalogGroupMember{{"kids", "bob"}}
+	c.Grants = []catalogGrant{{principalGroup, "kids", "b"}, {principalUser, "alice", "*"}}
+	c.Tokens = []catalogToken{{7, "alice", "token-hash", scopeList, at(1), nil}, {9, "bob", "other-hash", scopeDownload, at(2), &lastLogin}}
+	c.Locks = []catalogLock{{"bob", at(4)}}
+	c.ShareLinks = []catalogShareLink{
+		{4, "alice", "a", "Alien", at(20), &maxDownloads, 2},
+		{5, "bob", "b", "Casablanca", at(21), nil, 0},
+	}
+	c.MovieDownloadsDaily = []catalogDailyDownloads{
+		{"/a", "Alien", "2014-01-01", 2}, {"/a", "Alien", "2014-01-05", 1}, {"/b", "Casablanca", "2014-01-05", 1},
+	}
+	c.LibraryDownloadsDaily = []catalogDailyDownloads{{"/a", "", "2014-01-01", 2}, {"/a", "", "2014-01-05", 1}, {"/b", "", "2014-01-05", 1}}
+	c.DownloadEvents = []downloadEvent{
+		{3, "alice", "a", "Alien", at(5), at(5).Add(time.Second), 100, 200, "", "127.0.0.1"},
+		{8, "bob", "b", "Casablanca", at(5), at(6), 10, 206, "bytes=0-9", "::1"},
+	}
+	return c
+}
+
+// Fails the test if the catalogs differ in anything but when they were
+// exported
+func expectCatalog(t *testing.T, what string, got, want *catalog) {
+	t.Helper()
+	gotCopy, wantCopy := *got, *want
+	gotCopy.Exported, wantCopy.Exported = time.Time{}, time.Time{}
+	gotJSON, err := json.MarshalIndent(gotCopy, "", " ")
+	check(t, err)
+	wantJSON, err := json.MarshalIndent(wantCopy, "", " ")
+	check(t, err)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("%s: got %s, want %s", what, gotJSON, wantJSON)
+	}
+}
+
+func TestStoreCatalog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		exported, err := s.Export()
+		check(t, err)
+		expectCatalog(t, "empty catalog", exported, newCatalog())
+
+		// Importing replaces what was there, sessions included
+		check(t, s.NewUser("carol", "hash-c"))
+		check(t, s.UpdateMovies([]indexedMovie{testMovie("/a", "Alien", 1, 0)}, nil, nil, nil))
+		check(t, s.NewSession("session", "carol", time.Now().Add(time.Hour), "127.0.0.1", ""))
+		c := testCatalog()
+		check(t, s.Import(c))
+		exported, err = s.Export()
+		check(t, err)
+		expectCatalog(t, "imported catalog", exported, c)
+		sessions, err := s.Sessions("")
+		check(t, err)
+		expect(t, "sessions after import", len(sessions), 0)
+
+		// New rows get ids past the imported ones
+		check(t, s.NewToken("bob", "new-hash", scopeList))
+		tokens, err := s.Tokens("bob")
+		check(t, err)
+		expect(t, "new token id", tokens[len(tokens)-1].ID > 9, true)
+		id, err := s.NewShareLink(shareLink{Creator: "bob", Library: "a", Name: "Alien", Expires: time.Now().Add(time.Hour)})
+		check(t, err)
+		expect(t, "new share link id", id > 5, true)
+
+		// Catalogs move between backends
+		for backend, open := range testBackends {
+			other, err := open(t)
+			check(t, err)
+			check(t, other.Import(exported))
+			moved, err := other.Export()
+			check(t, err)
+			other.Close()
+			expectCatalog(t, "catalog moved to "+backend, moved, c)
+		}
+	})
+}
+
+func TestReadCatalog(t *testing.T) {
+	contents, err := json.Marshal(testCatalog())
+	check(t, err)
+	c, err := readCatalog(bytes.NewReader(contents))
+	check(t, err)
+	expectCatalog(t, "read catalog", c, testCatalog())
+
+	for what, contents := range map[string]string{
+		"a newer version": `{"version": 2}`,
+		"no version":      `{"movies": []}`,
+		"an invalid day":  `{"version": 1, "library_downloads_daily": [{"path": "/a", "day": "January 1st", "downloads": 1}]}`,
+		"invalid JSON":    `{"version": 1, "movies": {}}`,
+	} {
+		if _, err := readCatalog(strings.NewReader(contents)); err == nil {
+			t.Errorf("A catalog with %s was read", what)
+		}
+	}
+}
+
+func TestStoreMoveMovies(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		alien, brazil := testMovie("/a", "Alien", 100, 0), testMovie("/a", "Brazil", 200, 0)
+		alien.Fingerprint, brazil.Fingerprint = "alien", "brazil"
+		check(t, s.UpdateMovies([]indexedMovie{alien, brazil, testMovie("/b", "Casablanca", 300, 0)}, nil, nil, nil))
+		days := []time.Time{time.Date(2014, 1, 5, 0, 0, 0, 0, time.UTC), time.Date(2014, 1, 6, 0, 0, 0, 0, time.UTC)}
+		for _, when := range []time.Time{days[0], days[0], days[1]} {
+			_, err := s.AddDownload("/a", "Alien", when)
+			check(t, err)
+		}
+		_, err := s.AddDownload("/b", "Casablanca", days[1])
+		check(t, err)
+
+		orphans, err := s.OrphanedMovies([]string{"/b"})
+		check(t, err)
+		sortMovies(orphans)
+		expect(t, "orphaned movies", orphans, []indexedMovie{alien, brazil})
+		orphans, err = s.OrphanedMovies(nil)
+		check(t, err)
+		expect(t, "movies with fingerprints", len(orphans), 2)
+
+		// Alien moves to /b and Brazil is renamed
+		movedAlien := testMovie("/b", "Alien (1979)", 101, 1)
+		movedAlien.Fingerprint = "alien 2"
+		renamedBrazil := testMovie("/a", "Brazil (1985)", 200, 0)
+		renamedBrazil.Fingerprint = "brazil"
+		check(t, s.UpdateMovies(nil, nil, []movedMovie{{alien.movieKey, movedAlien}, {brazil.movieKey, renamedBrazil}}, nil))
+		indexed, err := s.IndexedMovies([]string{"/a", "/b"})
+		check(t, err)
+		sortMovies(indexed)
+		expect(t, "moved movies", indexed, []indexedMovie{renamedBrazil, movedAlien, testMovie("/b", "Casablanca", 300, 0)})
+		_, movies, err := s.Movies(movieQuery{Path: "/b", SortBy: "name"})
+		check(t, err)
+		expect(t, "downloads kept", []uint64{movies[0].Downloads, movies[1].Downloads}, []uint64{3, 1})
+
+		january := downloadStatsQuery{Paths: []string{"/a", "/b"}, Since: days[0], Until: days[1].AddDate(0, 0, 1), Limit: 10}
+		top, err := s.TopMovies(january)
+		check(t, err)
+		expect(t, "moved statistics", top, []movieDownloads{{movieKey{"/b", "Alien (1979)"}, 3}, {movieKey{"/b", "Casablanca"}, 1}})
+		top, err = s.TopMovies(downloadStatsQuery{Paths: []string{"/b"}, Since: days[0], Until: days[1], Limit: 10})
+		check(t, err)
+		expect(t, "moved day", top, []movieDownloads{{movieKey{"/b", "Alien (1979)"}, 2}})
+
+		// Library statistics are added to the new path's
+		check(t, s.MoveLibraryDownloads("/a", "/b"))
+		check(t, s.MoveLibraryDownloads("/a", "/b"))
+		libraries, err := s.LibraryDownloads(january)
+		check(t, err)
+		expect(t, "moved library statistics", libraries, map[string]uint64{"/b": 4})
+
+		// A movie whose old row was deleted meanwhile is added
+		dune := testMovie("/b", "Dune", 400, 0)
+		dune.Fingerprint = "dune"
+		check(t, s.UpdateMovies(nil, nil, []movedMovie{{movieKey{"/a", "Dune"}, dune}}, nil))
+		indexed, err = s.IndexedMovies([]string{"/b"})
+		check(t, err)
+		sortMovies(indexed)
+		expect(t, "movie moved from a missing row", indexed, []indexedMovie{movedAlien, testMovie("/b", "Casablanca", 300, 0), dune})
+		ok, err := s.AddDownload("/b", "Dune", days[1])
+		check(t, err)
+		expect(t, "download of a movie moved from a missing row", ok, true)
+	})
+}
+
+func TestLikeMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"alien%", "Aliens", true},
+		{"alien%", "Brazil", false},
+		{"a_ien", "Alien", true},
+		{"a_ien", "Aien", false},
+		{"%zi%", "Brazil", true},
+		{`100\%`, "100%", true},
+		{`100\%`, "1000", false},
+		{`a\_b%`, "a_b.mkv", true},
+		{`a\_b%`, "axb.mkv", false},
+		{"", "", true},
+		{"%", "", true},
+	} {
+		if got := likeMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("likeMatch(%q, %q): got %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	s, err := openMemoryStore(snapshotFile)
+	check(t, err)
+	alien := testMovie("/a", "Alien", 100, 0)
+	check(t, s.UpdateMovies([]indexedMovie{alien}, nil, nil, nil))
+	_, err = s.AddDownload("/a", "Alien", time.Now())
+	check(t, err)
+	check(t, s.NewUser("bob", "hash"))
+	check(t, s.NewToken("bob", "tokenhash", "read"))
+	check(t, s.Close())
+
+	s, err = openMemoryStore(snapshotFile)
+	check(t, err)
+	_, movies, err := s.Movies(movieQuery{Path: "/a"})
+	check(t, err)
+	expect(t, "movies", movies, []movieRow{{"Alien", 1, alien.movieMeta}})
+	hash, _, err := s.PasswordHash("bob")
+	check(t, err)
+	expect(t, "password hash", hash, "hash")
+	// Ids keep counting up from where they were
+	check(t, s.NewToken("bob", "tokenhash2", "read"))
+	tokens, err := s.Tokens("bob")
+	check(t, err)
+	if len(tokens) != 2 || tokens[0].ID == tokens[1].ID {
+		t.Errorf("tokens: got %v, want 2 with different ids", tokens)
+	}
+
+	if err := ioutil.WriteFile(snapshotFile, []byte(`{"version": 99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openMemoryStore(snapshotFile); err == nil {
+		t.Error("Loading a snapshot with an unknown version succeeded")
+	}
+
+	// Version 1 snapshots have downloads but no metadata
+	v1 := `{"version": 1, "movies": {"/a": {"Alien": 3}}, "users": {"bob": {"password_hash": "hash"}}}`
+	check(t, ioutil.WriteFile(snapshotFile, []byte(v1), 0600))
+	s, err = openMemoryStore(snapshotFile)
+	check(t, err)
+	_, movies, err = s.Movies(movieQuery{Path: "/a"})
+	check(t, err)
+	expect(t, "upgraded movies", movies, []movieRow{{Name: "Alien", Downloads: 3}})
+	hash, _, err = s.PasswordHash("bob")
+	check(t, err)
+	expect(t, "upgraded password hash", hash, "hash")
+}
+
+func TestStoreUpdateMoviesBatches(t *testing.T) {
+	oldBatch, oldCommit := *indexBatchSize, *indexCommitSize
+	*indexBatchSize, *indexCommitSize = 2, 3
+	defer func() { *indexBatchSize, *indexCommitSize = oldBatch, oldCommit }()
+	forEachStore(t, func(t *testing.T, s store) {
+		var added []indexedMovie
+		for i, name := range []string{"Alien", "Brazil", "Casablanca", "Dune", "Eraserhead", "Fargo", "Gattaca"} {
+			added = append(added, testMovie([]string{"/a", "/b"}[i%2], name, 100, i))
+		}
+		check(t, s.UpdateMovies(added, nil, nil, nil))
+		movies, err := s.IndexedMovies([]string{"/a", "/b"})
+		check(t, err)
+		expect(t, "added movies", len(movies), len(added))
+
+		changed := testMovie("/a", "Alien", 200, 10)
+		removed := []movieKey{{"/b", "Brazil"}, {"/a", "Casablanca"}, {"/b", "Fargo"}, {"/a", "Eraserhead"}, {"/a", "Gattaca"}}
+		check(t, s.UpdateMovies(nil, []indexedMovie{changed}, nil, removed))
+		movies, err = s.IndexedMovies([]string{"/a", "/b"})
+		check(t, err)
+		sortMovies(movies)
+		expect(t, "remaining movies", movies, []indexedMovie{changed, added[3]})
+	})
+}
@@ -5,6 +5,8 @@ import subprocess
 import time
 import signal
 import torndb
+import requests
+import bcrypt
 
 # Sets up the server on port 10000 and also a database connection
 @pytest.fixture(scope="session")
@@ -38,8 +40,11 @@ def conf(request):
         'port': port,
         'serveraddress': 'http://localhost:' + str(port),
         'db': db,
-        'handlers': torndb.Row({'main': '/main/', 'login': '/', 'checkAccess': '/checkAccess/', 'table': {},
-                                'movie': {}})
+        'handlers': torndb.Row({'main': '/main/', 'login': '/', 'checkAccess': '/checkAccess/',
+                                'tableKeys': '/main/tableKeys/', 'logout': '/logout/',
+                                'sessions': '/main/sessions/', 'revokeSession': '/main/sessions/revoke/',
+                                'share': '/main/share/', 'adminDownloads': '/main/admin/downloads/',
+                                'table': {}, 'movie': {}})
     })
     for tableKey in paths.iterkeys():
         conf['handlers']['table'][tableKey] = '/main/table/%s/' % tableKey
@@ -52,11 +57,28 @@ def conf(request):
                              '-src-path', conf['srcpath'],
                              '-path', 'movies=' + conf.paths['movies'],
                              '-path', 'another=' + conf.paths['another'],
-                             '-port', str(port)])
+                             '-port', str(port),
+                             # Turns off the login backoff, so failed
+                             # logins in one test don't throttle the
+                             # logins of the next
+                             '-login-backoff', '0s',
+                             '-login-max-failures', '3',
+                             '-basic-auth'])
     conf.proc = proc
     time.sleep(5)
 
+    # Creates a test user and a requests session that is logged in
+    # as that user, since all the main handlers require a session
+    conf.user, conf.password = ('tester', 'tester')
+    db.execute("REPLACE INTO users(username, password_hash) VALUES (%s, %s)",
+               conf.user, bcrypt.hashpw(conf.password, bcrypt.gensalt()))
+    conf.session = requests.Session()
+    login = conf.session.post(conf.serveraddress + conf.handlers.checkAccess,
+                              data={'username': conf.user, 'password': conf.password})
+    assert login.status_code == 200
+
     def teardown():
+        db.execute("DELETE FROM users WHERE username=%s", conf.user)
         db.close()
         proc.send_signal(signal.SIGINT)
         proc.wait()
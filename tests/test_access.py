@@ -0,0 +1,47 @@
+# Tests the library access control on the tableKeys, table and movie
+# handlers
+
+import requests
+import bcrypt
+import pytest
+
+@pytest.fixture
+def kid(request, conf):
+    """Creates a user that is only granted the movies library, through
+    a group, and returns a session logged in as that user"""
+    user, password = ('kid', 'kid')
+    conf.db.execute("REPLACE INTO users(username, password_hash) VALUES (%s, %s)",
+                    user, bcrypt.hashpw(password, bcrypt.gensalt()))
+    conf.db.execute("REPLACE INTO user_groups(group_name, username) VALUES ('family', %s)", user)
+    conf.db.execute("REPLACE INTO library_acl(principal_type, principal, library) VALUES ('group', 'family', 'movies')")
+    session = requests.Session()
+    login = session.post(conf.serveraddress + conf.handlers.checkAccess,
+                         data={'username': user, 'password': password})
+    assert login.status_code == 200
+
+    def teardown():
+        conf.db.execute("DELETE FROM library_acl WHERE principal_type='group' AND principal='family'")
+        conf.db.execute("DELETE FROM user_groups WHERE username=%s", user)
+        conf.db.execute("DELETE FROM users WHERE username=%s", user)
+    request.addfinalizer(teardown)
+    return session
+
+def test_ungranted_user_sees_everything(conf):
+    req = conf.session.get(conf.serveraddress + conf.handlers.tableKeys)
+    assert set(req.json()) == set(conf.paths.keys())
+
+def test_table_keys_filtered(conf, kid):
+    req = kid.get(conf.serveraddress + conf.handlers.tableKeys)
+    assert req.json() == ['movies']
+
+def test_granted_library(conf, kid):
+    req = kid.get(conf.serveraddress + conf.handlers.table['movies'])
+    assert req.status_code == 200
+    req = kid.get(conf.serveraddress + conf.handlers.movie['movies'] + 'a.txt')
+    assert req.status_code == 200
+
+def test_ungranted_library(conf, kid):
+    req = kid.get(conf.serveraddress + conf.handlers.table['another'])
+    assert req.status_code == 403
+    req = kid.get(conf.serveraddress + conf.handlers.movie['another'] + 'a.txt')
+    assert req.status_code == 403
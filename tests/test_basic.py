@@ -0,0 +1,36 @@
+# Tests HTTP Basic authentication on the table and movie handlers
+
+import requests
+
+def test_basic_table(conf):
+    for tableKey in conf.paths.iterkeys():
+        req = requests.get(conf.serveraddress + conf.handlers.table[tableKey], auth=(conf.user, conf.password))
+        assert req.status_code == 200
+
+def test_basic_movie(conf):
+    for tableKey, path in conf.paths.iteritems():
+        req = requests.get(conf.serveraddress + conf.handlers.movie[tableKey] + 'a.txt',
+                           auth=(conf.user, conf.password))
+        assert req.status_code == 200
+        assert req.content == open(path + '/a.txt').read()
+
+def test_basic_wrong_password(conf):
+    req = requests.get(conf.serveraddress + conf.handlers.movie['movies'] + 'a.txt',
+                       auth=(conf.user, conf.password + 'wrong'))
+    assert req.status_code == 401
+    assert req.headers['www-authenticate'].startswith('Basic')
+
+def test_basic_challenge(conf):
+    req = requests.get(conf.serveraddress + conf.handlers.movie['movies'] + 'a.txt')
+    assert req.status_code == 401
+    assert req.headers['www-authenticate'].startswith('Basic')
+    # The frontend's ajax requests aren't challenged
+    req = requests.get(conf.serveraddress + conf.handlers.table['movies'],
+                       headers={'X-Requested-With': 'XMLHttpRequest'})
+    assert req.status_code == 401
+    assert 'www-authenticate' not in req.headers
+
+def test_basic_not_accepted_on_main(conf):
+    req = requests.get(conf.serveraddress + conf.handlers.main, auth=(conf.user, conf.password),
+                       allow_redirects=False)
+    assert req.status_code == 302
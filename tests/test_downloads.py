@@ -0,0 +1,80 @@
+# Tests the download audit log and the admin handler that queries it
+
+import requests
+import pytest
+
+@pytest.fixture(autouse=True)
+def admin(request, conf):
+    conf.db.execute("DELETE FROM download_events")
+    conf.db.execute("INSERT IGNORE INTO user_groups(group_name, username) VALUES ('admin', %s)", conf.user)
+
+    def teardown():
+        conf.db.execute("DELETE FROM user_groups WHERE group_name='admin' AND username=%s", conf.user)
+    request.addfinalizer(teardown)
+
+def events(conf, **params):
+    req = conf.session.get(conf.serveraddress + conf.handlers.adminDownloads, params=params)
+    assert req.status_code == 200
+    return req.json()
+
+def test_download_recorded(conf):
+    contents = open(conf.paths['movies'] + '/a.txt').read()
+    conf.session.get(conf.serveraddress + conf.handlers.movie['movies'] + 'a.txt')
+    row = conf.db.get("SELECT * FROM download_events")
+    assert row.username == conf.user
+    assert row.library == 'movies'
+    assert row.name == 'a.txt'
+    assert row.status == 200
+    assert row.bytes == len(contents)
+    assert row.range_header is None
+    assert row.ip == '127.0.0.1'
+    assert row.finished >= row.started
+
+def test_range_recorded(conf):
+    req = conf.session.get(conf.serveraddress + conf.handlers.movie['movies'] + 'a.txt',
+                           headers={'Range': 'bytes=0-1'})
+    assert req.status_code == 206
+    row = conf.db.get("SELECT * FROM download_events")
+    assert row.status == 206
+    assert row.bytes == 2
+    assert row.range_header == 'bytes=0-1'
+
+def test_failed_download_recorded(conf):
+    conf.session.get(conf.serveraddress + conf.handlers.movie['movies'] + 'nosuchfile')
+    row = conf.db.get("SELECT * FROM download_events")
+    assert row.status == 404
+
+def test_query_filters(conf):
+    for tableKey in conf.paths.iterkeys():
+        conf.session.get(conf.serveraddress + conf.handlers.movie[tableKey] + 'a.txt')
+    conf.session.get(conf.serveraddress + conf.handlers.movie['movies'] + 'thing.cpp')
+    assert events(conf)['total_entries'] == 3
+    assert events(conf, library='movies')['total_entries'] == 2
+    assert events(conf, name='thing.cpp')['events'][0]['library'] == 'movies'
+    assert events(conf, q='thing')['total_entries'] == 1
+    assert events(conf, user='nobody')['total_entries'] == 0
+    assert events(conf, status='200')['total_entries'] == 3
+    assert events(conf, since='2100-01-01T00:00:00Z')['total_entries'] == 0
+    assert events(conf, until='2100-01-01T00:00:00Z')['total_entries'] == 3
+
+def test_query_pagination(conf):
+    for i in range(3):
+        conf.session.get(conf.serveraddress + conf.handlers.movie['movies'] + 'a.txt')
+    first, second = events(conf, page=1, per_page=2), events(conf, page=2, per_page=2)
+    assert first['total_entries'] == 3
+    assert len(first['events']) == 2
+    assert len(second['events']) == 1
+    # Newest first
+    assert first['events'][0]['id'] > second['events'][0]['id']
+
+def test_invalid_query(conf):
+    for params in [{'since': 'yesterday'}, {'status': 'ok'}, {'page': '0'}, {'per_page': '100000'}]:
+        req = conf.session.get(conf.serveraddress + conf.handlers.adminDownloads, params=params)
+        assert req.status_code == 400
+
+def test_admin_only(conf):
+    conf.db.execute("DELETE FROM user_groups WHERE group_name='admin' AND username=%s", conf.user)
+    req = conf.session.get(conf.serveraddress + conf.handlers.adminDownloads)
+    assert req.status_code == 403
+    req = requests.get(conf.serveraddress + conf.handlers.adminDownloads)
+    assert req.status_code == 401
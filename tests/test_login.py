@@ -1,21 +1,83 @@
-# Tests the checkAccess handler
+# Tests the checkAccess handler and the session checks on the other
+# handlers
 
 import requests
+import bcrypt
 
 def test_good_login(conf):
     user, password = ('success', 'success')
-    conf.db.execute("REPLACE INTO login VALUES (%s, %s)", user, password)
+    conf.db.execute("REPLACE INTO users(username, password_hash) VALUES (%s, %s)",
+                    user, bcrypt.hashpw(password, bcrypt.gensalt()))
 
-    goodLogin = requests.post(conf.serveraddress + conf.handlers.checkAccess,
-                              data={'username': user, 'password': password})
+    session = requests.Session()
+    goodLogin = session.post(conf.serveraddress + conf.handlers.checkAccess,
+                             data={'username': user, 'password': password})
     assert goodLogin.status_code == 200
 
-    indexPage = requests.get(conf.serveraddress + conf.handlers.main)
+    indexPage = session.get(conf.serveraddress + conf.handlers.main)
     assert indexPage.text == goodLogin.text
 
-    conf.db.execute("DELETE FROM login WHERE user=%s and password=%s", user, password)
+    lastLogin = conf.db.get("SELECT last_login FROM users WHERE username=%s", user)
+    assert lastLogin.last_login is not None
+
+    conf.db.execute("DELETE FROM users WHERE username=%s", user)
 
 def test_bad_login(conf):
+    badLogin = requests.post(conf.serveraddress + conf.handlers.checkAccess,
+                             data={'username': 'failure', 'password': 'failure'})
+    assert badLogin.status_code == 403
+    assert 'movieserver-session' not in badLogin.cookies
+
+def test_wrong_password(conf):
+    badLogin = requests.post(conf.serveraddress + conf.handlers.checkAccess,
+                             data={'username': conf.user, 'password': conf.password + 'wrong'})
+    assert badLogin.status_code == 403
+
+def test_password_is_hashed(conf):
+    row = conf.db.get("SELECT password_hash FROM users WHERE username=%s", conf.user)
+    assert row.password_hash != conf.password
+    assert bcrypt.checkpw(conf.password, row.password_hash)
+
+def test_lockout(conf):
+    user, password = ('lockme', 'lockme')
+    conf.db.execute("REPLACE INTO users(username, password_hash) VALUES (%s, %s)",
+                    user, bcrypt.hashpw(password, bcrypt.gensalt()))
+    for i in range(3):
         badLogin = requests.post(conf.serveraddress + conf.handlers.checkAccess,
-                                 data={'username': 'failure', 'password': 'failure'})
+                                 data={'username': user, 'password': 'wrong'})
         assert badLogin.status_code == 403
+    assert conf.db.get("SELECT username FROM account_locks WHERE username=%s", user) is not None
+
+    # Even the right password is rejected once the account is locked
+    lockedLogin = requests.post(conf.serveraddress + conf.handlers.checkAccess,
+                                data={'username': user, 'password': password})
+    assert lockedLogin.status_code == 403
+    assert 'movieserver-session' not in lockedLogin.cookies
+
+    # Unlocking the account lets the user in again
+    conf.db.execute("DELETE FROM account_locks WHERE username=%s", user)
+    goodLogin = requests.post(conf.serveraddress + conf.handlers.checkAccess,
+                              data={'username': user, 'password': password})
+    assert goodLogin.status_code == 200
+
+    conf.db.execute("DELETE FROM users WHERE username=%s", user)
+
+def test_main_redirects_without_session(conf):
+    req = requests.get(conf.serveraddress + conf.handlers.main, allow_redirects=False)
+    assert req.status_code == 302
+    assert req.headers['location'].endswith(conf.handlers.login)
+
+def test_handlers_reject_without_session(conf):
+    for tableKey in conf.paths.iterkeys():
+        for url in [conf.handlers.table[tableKey], conf.handlers.movie[tableKey]]:
+            req = requests.get(conf.serveraddress + url, allow_redirects=False)
+            assert req.status_code == 401
+
+def test_handlers_reject_forged_session(conf):
+    cookie = conf.session.cookies['movieserver-session']
+    payload, signature = cookie.split('.')
+    forged = payload + '.' + signature[::-1]
+    for tableKey in conf.paths.iterkeys():
+        req = requests.get(conf.serveraddress + conf.handlers.table[tableKey],
+                           cookies={'movieserver-session': forged})
+        assert req.status_code == 401
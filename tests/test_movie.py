@@ -1,5 +1,4 @@
 # Tests the movie handler
-import requests
 import random
 import pytest
 import time
@@ -23,7 +22,7 @@ def test_files(conf):
         for i in range(len(confmoviefiles)):
             movie = confmoviefiles[i]
             for dnum in range(downloads[i]):
-                req = requests.get(conf.serveraddress + conf.handlers.movie[tableKey] + movie.name)
+                req = conf.session.get(conf.serveraddress + conf.handlers.movie[tableKey] + movie.name)
                 filetext = open(os.path.join(path, movie.name)).read()
                 assert req.status_code == 200
                 # It is encoded as a binary-stream, so req.content
@@ -38,7 +37,7 @@ def test_files(conf):
 
 def test_bogus_file(conf):
     for tableKey in conf.paths.iterkeys():
-        req = requests.get(conf.serveraddress + conf.handlers.movie[tableKey] + 'nonexistentfile.goober')
+        req = conf.session.get(conf.serveraddress + conf.handlers.movie[tableKey] + 'nonexistentfile.goober')
         assert req.status_code == 404
 
 def test_directories(conf):
@@ -48,7 +47,7 @@ def test_directories(conf):
         confmoviedirs = [movie for movie in conf.movies[tableKey]
                          if os.path.isdir(os.path.join(path, movie.name))]
         for moviedir in confmoviedirs:
-            req = requests.get(conf.serveraddress + conf.handlers.movie[tableKey] + moviedir.name)
+            req = conf.session.get(conf.serveraddress + conf.handlers.movie[tableKey] + moviedir.name)
             assert req.status_code == 200
             tfile = tarfile.open(mode='r', fileobj=StringIO.StringIO(req.content))
             for tname in tfile.getnames():
@@ -1,8 +1,10 @@
 # Tests the movietable handler
 
-import requests
+import calendar
 import fnmatch
+import os.path
 import random
+import time
 
 def setup_module():
     random.seed()
@@ -46,7 +48,7 @@ def param_query(params, conf, setPageOutOfBounds=False):
 
         if setPageOutOfBounds:
             assert 'page' in params and 'per_page' in params
-            req = requests.get(conf.serveraddress + conf.handlers.table[tableKey], params=strparams)
+            req = conf.session.get(conf.serveraddress + conf.handlers.table[tableKey], params=strparams)
             resp = req.json()
             results = resp[1]
 
@@ -63,7 +65,7 @@ def param_query(params, conf, setPageOutOfBounds=False):
                 allnames = []
                 for i in range(params['page']):
                     strparams['page'] = str(i + 1)
-                    req = requests.get(conf.serveraddress + conf.handlers.table[tableKey], params=strparams)
+                    req = conf.session.get(conf.serveraddress + conf.handlers.table[tableKey], params=strparams)
                     resp = req.json()
                     results.extend(resp[1])
 
@@ -77,7 +79,7 @@ def param_query(params, conf, setPageOutOfBounds=False):
                 assert set(allnames).issubset(confmovienames)
             else:
                 assert 'per_page' not in params
-                req = requests.get(conf.serveraddress + conf.handlers.table[tableKey], params=strparams)
+                req = conf.session.get(conf.serveraddress + conf.handlers.table[tableKey], params=strparams)
                 resp = req.json()
                 results = resp[1]
 
@@ -153,3 +155,19 @@ def test_orderby_downloads(conf):
     for tableKey in conf.paths.iterkeys():
         for i in range(len(conf.movies[tableKey])):
             conf.movies[tableKey][i]['downloads'] = 0
+
+# Makes sure the table reports the size, type and modification time of
+# every movie
+def test_metadata(conf):
+    for tableKey, path in conf.paths.iteritems():
+        req = conf.session.get(conf.serveraddress + conf.handlers.table[tableKey])
+        for movie in req.json()[1]:
+            abspath = os.path.join(path, movie['name'])
+            assert movie['is_dir'] == os.path.isdir(abspath)
+            if movie['is_dir']:
+                assert movie['mime'] == 'inode/directory'
+            else:
+                assert movie['size'] == os.path.getsize(abspath)
+                assert movie['mime'] != ''
+            mtime = calendar.timegm(time.strptime(movie['mtime'], '%Y-%m-%dT%H:%M:%SZ'))
+            assert mtime == int(os.path.getmtime(abspath))
@@ -0,0 +1,87 @@
+# Tests the sessions table, logging out and revoking sessions
+
+import requests
+import bcrypt
+import hashlib
+import base64
+import json
+import subprocess
+import pytest
+
+USER, PASSWORD = ('sessionuser', 'sessionuser')
+
+def login(conf):
+    session = requests.Session()
+    req = session.post(conf.serveraddress + conf.handlers.checkAccess,
+                       data={'username': USER, 'password': PASSWORD},
+                       headers={'User-Agent': 'movieserver-tests'})
+    assert req.status_code == 200
+    return session
+
+def session_hash(session):
+    """Returns the hashed id of a requests session's movieserver
+    session, which is the key of its row in the sessions table"""
+    payload = session.cookies['movieserver-session'].split('.')[0]
+    payload += '=' * (-len(payload) % 4)
+    return hashlib.sha256(json.loads(base64.urlsafe_b64decode(str(payload)))['id']).hexdigest()
+
+def logged_in(conf, session):
+    req = session.get(conf.serveraddress + conf.handlers.table['movies'], allow_redirects=False)
+    return req.status_code == 200
+
+@pytest.fixture(autouse=True)
+def user(request, conf):
+    conf.db.execute("REPLACE INTO users(username, password_hash) VALUES (%s, %s)",
+                    USER, bcrypt.hashpw(PASSWORD, bcrypt.gensalt()))
+
+    def teardown():
+        conf.db.execute("DELETE FROM sessions WHERE username=%s", USER)
+        conf.db.execute("DELETE FROM users WHERE username=%s", USER)
+    request.addfinalizer(teardown)
+
+def test_login_records_session(conf):
+    session = login(conf)
+    row = conf.db.get("SELECT * FROM sessions WHERE id=%s", session_hash(session))
+    assert row.username == USER
+    assert row.user_agent == 'movieserver-tests'
+    assert row.ip == '127.0.0.1'
+
+def test_logout(conf):
+    session = login(conf)
+    cookie = session.cookies['movieserver-session']
+    req = session.get(conf.serveraddress + conf.handlers.logout, allow_redirects=False)
+    assert req.status_code == 302
+    assert conf.db.get("SELECT id FROM sessions WHERE id=%s", session_hash(session)) is None
+    # Even if the client kept the cookie, it no longer works
+    req = requests.get(conf.serveraddress + conf.handlers.table['movies'],
+                       cookies={'movieserver-session': cookie})
+    assert req.status_code == 401
+
+def test_sessions_page(conf):
+    first, second = login(conf), login(conf)
+    page = first.get(conf.serveraddress + conf.handlers.sessions)
+    assert page.status_code == 200
+    assert session_hash(second) in page.text
+    # The current session can't be revoked from the page, so its id
+    # isn't in a form
+    assert session_hash(first) not in page.text
+
+def test_revoke_session(conf):
+    first, second = login(conf), login(conf)
+    req = first.post(conf.serveraddress + conf.handlers.revokeSession, data={'id': session_hash(second)})
+    assert req.status_code == 200
+    assert logged_in(conf, first)
+    assert not logged_in(conf, second)
+
+def test_cannot_revoke_other_users_session(conf):
+    mine = login(conf)
+    req = mine.post(conf.serveraddress + conf.handlers.revokeSession, data={'id': session_hash(conf.session)})
+    assert req.status_code == 404
+    assert logged_in(conf, conf.session)
+
+def test_revoke_all_sessions(conf):
+    sessions = [login(conf) for i in range(3)]
+    subprocess.check_call(['movieserver', '-src-path', conf.srcpath, 'session', 'revoke', USER])
+    for session in sessions:
+        assert not logged_in(conf, session)
+    assert logged_in(conf, conf.session)
@@ -0,0 +1,107 @@
+# Tests creating share links and downloading through them without an
+# account
+
+import requests
+import urlparse
+import urllib
+import pytest
+
+def share(conf, tableKey, name, **kwargs):
+    data = {'library': tableKey, 'name': name}
+    data.update(kwargs)
+    return conf.session.post(conf.serveraddress + conf.handlers.share, data=data)
+
+def url_with(path, **params):
+    """Returns the path with some of its query parameters replaced"""
+    parts = urlparse.urlsplit(path)
+    query = dict(urlparse.parse_qsl(parts.query))
+    query.update(params)
+    return urlparse.urlunsplit(parts._replace(query=urllib.urlencode(query)))
+
+@pytest.fixture(autouse=True)
+def cleanup(request, conf):
+    def teardown():
+        conf.db.execute("DELETE FROM share_links WHERE creator=%s", conf.user)
+    request.addfinalizer(teardown)
+
+def test_share_file(conf):
+    req = share(conf, 'movies', 'a.txt')
+    assert req.status_code == 200
+    link = req.json()
+    assert link['url'].endswith(link['path'])
+    req = requests.get(conf.serveraddress + link['path'])
+    assert req.status_code == 200
+    assert req.content == open(conf.paths['movies'] + '/a.txt').read()
+    row = conf.db.get("SELECT * FROM share_links WHERE id=%s", link['id'])
+    assert row.creator == conf.user
+    assert row.downloads == 1
+
+def test_share_directory(conf):
+    link = share(conf, 'movies', 'anotherdir').json()
+    path = urlparse.urlsplit(link['path'])
+    for name in ['', '/a.txt', '/stuff.txt']:
+        req = requests.get(conf.serveraddress + path.path + name + '?' + path.query)
+        assert req.status_code == 200
+
+def test_share_does_not_cover_other_files(conf):
+    link = share(conf, 'movies', 'anotherdir').json()
+    path = urlparse.urlsplit(link['path'])
+    for other in ['a.txt', 'anotherdir2', 'nesteddir/xfile', '../another/a.txt']:
+        req = requests.get(conf.serveraddress + conf.handlers.movie['movies'] + other + '?' + path.query)
+        assert req.status_code in (403, 404)
+
+def test_tampered_link(conf):
+    link = share(conf, 'movies', 'a.txt').json()
+    req = requests.get(conf.serveraddress + url_with(link['path'], sig='AAAA'))
+    assert req.status_code == 403
+    # Extending the expiry invalidates the signature
+    req = requests.get(conf.serveraddress + url_with(link['path'], expires=str(link['expires'] + 3600)))
+    assert req.status_code == 403
+
+def test_max_downloads(conf):
+    link = share(conf, 'movies', 'a.txt', max_downloads='2').json()
+    assert link['max_downloads'] == 2
+    for i in range(2):
+        req = requests.get(conf.serveraddress + link['path'])
+        assert req.status_code == 200
+    req = requests.get(conf.serveraddress + link['path'])
+    assert req.status_code == 410
+
+def test_range_requests_count(conf):
+    # Every range request that fetches the beginning of the file, or
+    # that the server answers with the whole file, counts
+    headers = [{'Range': 'bytes=00-'}, {'Range': 'bytes=1-,0-0'}, {'Range': 'bytes=-100'},
+               {'Range': 'bytes=1-', 'If-Range': '"stale"'}, {'Range': 'bytes=,'}]
+    link = share(conf, 'movies', 'a.txt', max_downloads=str(len(headers))).json()
+    for h in headers:
+        req = requests.get(conf.serveraddress + link['path'], headers=h)
+        assert req.status_code in (200, 206)
+    row = conf.db.get("SELECT * FROM share_links WHERE id=%s", link['id'])
+    assert row.downloads == len(headers)
+    req = requests.get(conf.serveraddress + link['path'], headers={'Range': 'bytes=0-0'})
+    assert req.status_code == 410
+
+def test_expired_link(conf):
+    link = share(conf, 'movies', 'a.txt').json()
+    conf.db.execute("UPDATE share_links SET expires=CURRENT_TIMESTAMP - INTERVAL 1 MINUTE WHERE id=%s", link['id'])
+    req = requests.get(conf.serveraddress + link['path'])
+    assert req.status_code in (403, 410)
+
+def test_revoked_link(conf):
+    link = share(conf, 'movies', 'a.txt').json()
+    conf.db.execute("DELETE FROM share_links WHERE id=%s", link['id'])
+    req = requests.get(conf.serveraddress + link['path'])
+    assert req.status_code == 404
+
+def test_invalid_share_requests(conf):
+    assert share(conf, 'nosuchlibrary', 'a.txt').status_code == 400
+    assert share(conf, 'movies', 'nosuchfile').status_code == 404
+    assert share(conf, 'movies', '../another').status_code == 400
+    assert share(conf, 'movies', 'a.txt', expires='100000h').status_code == 400
+    assert share(conf, 'movies', 'a.txt', max_downloads='0').status_code == 400
+    req = conf.session.get(conf.serveraddress + conf.handlers.share)
+    assert req.status_code == 405
+
+def test_share_requires_login(conf):
+    req = requests.post(conf.serveraddress + conf.handlers.share, data={'library': 'movies', 'name': 'a.txt'})
+    assert req.status_code == 401
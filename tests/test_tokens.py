@@ -0,0 +1,58 @@
+# Tests API token authentication on the table and movie handlers
+
+import requests
+import hashlib
+import pytest
+
+@pytest.fixture
+def tokens(request, conf):
+    """Creates a list token and a download token for the test user and
+    returns them in a dict keyed by scope"""
+    tokens = {'list': 'ms_testlisttoken', 'download': 'ms_testdownloadtoken'}
+    for scope, token in tokens.iteritems():
+        conf.db.execute("INSERT INTO api_tokens(username, token_hash, scope) VALUES (%s, %s, %s)",
+                        conf.user, hashlib.sha256(token).hexdigest(), scope)
+
+    def teardown():
+        conf.db.execute("DELETE FROM api_tokens WHERE username=%s", conf.user)
+    request.addfinalizer(teardown)
+    return tokens
+
+def bearer(token):
+    return {'Authorization': 'Bearer ' + token}
+
+def test_list_token(conf, tokens):
+    for tableKey in conf.paths.iterkeys():
+        req = requests.get(conf.serveraddress + conf.handlers.table[tableKey], headers=bearer(tokens['list']))
+        assert req.status_code == 200
+        req = requests.get(conf.serveraddress + conf.handlers.movie[tableKey] + 'a.txt', headers=bearer(tokens['list']))
+        assert req.status_code == 403
+
+def test_download_token(conf, tokens):
+    for tableKey, path in conf.paths.iteritems():
+        req = requests.get(conf.serveraddress + conf.handlers.table[tableKey], headers=bearer(tokens['download']))
+        assert req.status_code == 200
+        req = requests.get(conf.serveraddress + conf.handlers.movie[tableKey] + 'a.txt', headers=bearer(tokens['download']))
+        assert req.status_code == 200
+        assert req.content == open(path + '/a.txt').read()
+
+def test_token_last_used(conf, tokens):
+    requests.get(conf.serveraddress + conf.handlers.tableKeys, headers=bearer(tokens['list']))
+    row = conf.db.get("SELECT last_used FROM api_tokens WHERE token_hash=%s",
+                      hashlib.sha256(tokens['list']).hexdigest())
+    assert row.last_used is not None
+
+def test_invalid_token(conf):
+    req = requests.get(conf.serveraddress + conf.handlers.table['movies'], headers=bearer('ms_bogus'))
+    assert req.status_code == 401
+    assert 'invalid_token' in req.headers['www-authenticate']
+
+def test_revoked_token(conf, tokens):
+    conf.db.execute("DELETE FROM api_tokens WHERE token_hash=%s", hashlib.sha256(tokens['download']).hexdigest())
+    req = requests.get(conf.serveraddress + conf.handlers.table['movies'], headers=bearer(tokens['download']))
+    assert req.status_code == 401
+
+def test_token_not_accepted_on_main(conf, tokens):
+    req = requests.get(conf.serveraddress + conf.handlers.main, headers=bearer(tokens['download']),
+                       allow_redirects=False)
+    assert req.status_code == 302
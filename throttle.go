@@ -0,0 +1,253 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Login throttling and account lockout. Failed logins are tracked
+// per remote IP and per username. After each failure, the IP and the
+// username have to wait exponentially longer before trying again,
+// and a username that fails too many times within a window is locked
+// until an admin unlocks it.
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The failed logins of one IP or username
+type attemptRecord struct {
+	// The times of the failures within the failure window
+	failures []time.Time
+	// The time before which no more attempts are accepted
+	nextAllowed time.Time
+	// Whether an attempt is being checked, which holds off the
+	// others until it's done
+	pending bool
+}
+
+// How long an attempt waits while another attempt of the same IP or
+// username is being checked, after it has failed before
+const pendingLoginWait = time.Second
+
+// Tracks failed logins. It is safe for concurrent use.
+type loginThrottle struct {
+	sync.Mutex
+	byIP   map[string]*attemptRecord
+	byUser map[string]*attemptRecord
+}
+
+var throttle = loginThrottle{
+	byIP:   make(map[string]*attemptRecord),
+	byUser: make(map[string]*attemptRecord),
+}
+
+// Returns the record of a key, creating it if there isn't one
+func record(m map[string]*attemptRecord, key string) *attemptRecord {
+	rec, ok := m[key]
+	if !ok {
+		rec = &attemptRecord{}
+		m[key] = rec
+	}
+	return rec
+}
+
+// Returns how long the client has to wait before its next attempt is
+// accepted. If it doesn't have to wait, the attempt is reserved, so
+// that once the IP or the user has failed, parallel attempts wait
+// until it's recorded with fail or succeed, or given up with release.
+// Until then, attempts aren't held off, so that clients opening
+// several connections with the right password aren't throttled.
+func (t *loginThrottle) reserve(ip, user string, now time.Time) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	recs := []*attemptRecord{record(t.byIP, ip), record(t.byUser, user)}
+	var wait time.Duration
+	for _, rec := range recs {
+		if rec.nextAllowed.Sub(now) > wait {
+			wait = rec.nextAllowed.Sub(now)
+		}
+		if rec.pending && len(rec.failures) > 0 && wait < pendingLoginWait {
+			wait = pendingLoginWait
+		}
+	}
+	if wait == 0 {
+		for _, rec := range recs {
+			rec.pending = true
+		}
+	}
+	return wait
+}
+
+// Gives up an attempt reserved with reserve without recording it
+func (t *loginThrottle) release(ip, user string) {
+	t.Lock()
+	defer t.Unlock()
+	for _, rec := range []*attemptRecord{t.byIP[ip], t.byUser[user]} {
+		if rec != nil {
+			rec.pending = false
+		}
+	}
+}
+
+// Records a failure in the record, dropping failures that have
+// fallen out of the window, and sets the backoff according to the
+// number of failures left. It ends the attempt the record reserved.
+func (rec *attemptRecord) addFailure(now time.Time) {
+	kept := rec.failures[:0]
+	for _, f := range rec.failures {
+		if now.Sub(f) < *loginFailureWindow {
+			kept = append(kept, f)
+		}
+	}
+	rec.failures = append(kept, now)
+	backoff := *loginBackoff
+	for i := 1; i < len(rec.failures) && backoff < *loginMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > *loginMaxBackoff {
+		backoff = *loginMaxBackoff
+	}
+	rec.nextAllowed = now.Add(backoff)
+	rec.pending = false
+}
+
+// Records a failed login, returning the number of failures for the
+// user within the failure window
+func (t *loginThrottle) fail(ip, user string, now time.Time) int {
+	t.Lock()
+	defer t.Unlock()
+	record(t.byIP, ip).addFailure(now)
+	userRec := record(t.byUser, user)
+	userRec.addFailure(now)
+	return len(userRec.failures)
+}
+
+// Forgets the failures of the IP and the user, after a successful
+// login
+func (t *loginThrottle) succeed(ip, user string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.byIP, ip)
+	delete(t.byUser, user)
+}
+
+// Forgets the failures of the user, so that the user starts over once
+// an admin unlocks the account
+func (t *loginThrottle) forgetUser(user string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.byUser, user)
+}
+
+// Deletes the records whose failures have all fallen out of the
+// window and whose backoff has expired, so the maps don't grow
+// forever. Records of attempts being checked are kept.
+func (t *loginThrottle) prune(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	for _, m := range []map[string]*attemptRecord{t.byIP, t.byUser} {
+		for key, rec := range m {
+			if rec.pending {
+				continue
+			}
+			if len(rec.failures) == 0 || now.Sub(rec.failures[len(rec.failures)-1]) >= *loginFailureWindow && now.After(rec.nextAllowed) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+// A heartbeat task that prunes the throttle records
+func pruneLoginThrottle(name string) error {
+	throttle.prune(time.Now())
+	return nil
+}
+
+// Returns the IP part of the request's remote address
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Responds to a throttled login, telling the client how long it has
+// to wait
+func throttledError(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+}
+
+type loginResult int
+
+const (
+	loginOK loginResult = iota
+	// The username or password was wrong
+	loginFailed
+	// The client has to wait before trying again
+	loginThrottled
+	// The account is locked
+	loginLocked
+)
+
+// Checks a username and password submitted by the client, subject to
+// throttling and lockout. If the result is loginThrottled, it also
+// returns how long the client has to wait. Only one attempt of an IP
+// or a username is checked at a time, so that guesses made in
+// parallel are throttled like ones made one after another.
+func attemptLogin(r *http.Request, user, password string) (loginResult, time.Duration, error) {
+	ip, now := remoteIP(r), time.Now()
+	if wait := throttle.reserve(ip, user, now); wait > 0 {
+		glog.Warningf("Throttled login for %s from %s: must wait %s", user, r.RemoteAddr, wait)
+		return loginThrottled, wait, nil
+	}
+
+	if locked, err := dbStore.IsLocked(user); err != nil {
+		throttle.release(ip, user)
+		return loginFailed, 0, err
+	} else if locked {
+		throttle.release(ip, user)
+		glog.Warningf("Rejected login for locked account %s from %s", user, r.RemoteAddr)
+		return loginLocked, 0, nil
+	}
+
+	ok, err := checkPassword(user, password)
+	if err != nil {
+		throttle.release(ip, user)
+		return loginFailed, 0, err
+	}
+	if ok {
+		throttle.succeed(ip, user)
+		return loginOK, 0, nil
+	}
+
+	failures := throttle.fail(ip, user, now)
+	glog.Warningf("Failed login for %s from %s (%d failures within %s)", user, r.RemoteAddr, failures, *loginFailureWindow)
+	if *loginMaxFailures > 0 && failures >= *loginMaxFailures {
+		if err := dbStore.LockAccount(user); err != nil {
+			return loginFailed, 0, err
+		}
+		throttle.forgetUser(user)
+		basicCache.forget(user)
+		glog.Warningf("Locked account %s after %d failed logins, the last from %s", user, failures, r.RemoteAddr)
+	}
+	return loginFailed, 0, nil
+}
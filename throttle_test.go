@@ -0,0 +1,188 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of login throttling and lockout, and of Basic credentials
+
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentLogins(t *testing.T) {
+	s, err := openMemoryStore("")
+	check(t, err)
+	oldStore := dbStore
+	dbStore = s
+	defer func() { dbStore = oldStore }()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	check(t, err)
+	check(t, s.NewUser("bob", string(hash)))
+	check(t, s.NewUser("alice", string(hash)))
+	setFlag(t, "login-backoff", "1m")
+	setFlag(t, "login-max-failures", "0")
+
+	// Once a guess has failed, only one of the guesses made at once
+	// is checked, and the others wait for its backoff
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	defer throttle.succeed("192.0.2.1", "bob")
+	result, _, err := attemptLogin(r, "bob", "guess")
+	check(t, err)
+	expect(t, "first guess", result, loginFailed)
+	throttle.Lock()
+	for _, rec := range []*attemptRecord{throttle.byIP["192.0.2.1"], throttle.byUser["bob"]} {
+		rec.nextAllowed = time.Time{}
+	}
+	throttle.Unlock()
+	results := make(chan loginResult, 20)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			result, _, err := attemptLogin(r, "bob", "guess")
+			if err != nil {
+				t.Error(err)
+			}
+			results <- result
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+	counts := make(map[loginResult]int)
+	for result := range results {
+		counts[result]++
+	}
+	expect(t, "concurrent login results", counts, map[loginResult]int{loginFailed: 1, loginThrottled: cap(results) - 1})
+	if result, wait, _ := attemptLogin(r, "bob", "secret"); result != loginThrottled || wait <= pendingLoginWait {
+		t.Errorf("Login after the failure was %v, waiting %s", result, wait)
+	}
+
+	// Attempts that end without a failure give up their reservation
+	r.RemoteAddr = "192.0.2.2:1234"
+	defer throttle.succeed("192.0.2.2", "alice")
+	check(t, s.LockAccount("alice"))
+	for i := 0; i < 2; i++ {
+		result, _, err := attemptLogin(r, "alice", "secret")
+		check(t, err)
+		expect(t, "locked login result", result, loginLocked)
+	}
+	_, err = s.UnlockAccount("alice")
+	check(t, err)
+	result, _, err = attemptLogin(r, "alice", "secret")
+	check(t, err)
+	expect(t, "login result", result, loginOK)
+}
+
+func TestConcurrentBasicLogins(t *testing.T) {
+	s, err := openMemoryStore("")
+	check(t, err)
+	oldStore := dbStore
+	dbStore = s
+	defer func() { dbStore = oldStore }()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	check(t, err)
+	check(t, s.NewUser("bob", string(hash)))
+	setFlag(t, "basic-auth", "true")
+	defer throttle.succeed("192.0.2.3", "bob")
+
+	// A player opening several connections at once with the right
+	// password gets every one of them
+	handler := authHandler(authOptions{anonymous: rejectAnonymous, basic: true}, func(w http.ResponseWriter, r *http.Request) {})
+	codes := make(chan int, 10)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", movieURL+"a/Alien.mkv", nil)
+			r.RemoteAddr = "192.0.2.3:1234"
+			r.SetBasicAuth("bob", "secret")
+			w := httptest.NewRecorder()
+			<-start
+			handler(w, r)
+			codes <- w.Code
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		expect(t, "status", code, http.StatusOK)
+	}
+}
+
+func TestBasicCredentialCache(t *testing.T) {
+	s, err := openMemoryStore("")
+	check(t, err)
+	oldStore := dbStore
+	dbStore = s
+	defer func() { dbStore = oldStore }()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	check(t, err)
+	check(t, s.NewUser("bob", string(hash)))
+	setFlag(t, "basic-auth", "true")
+	setFlag(t, "login-backoff", "0s")
+	defer throttle.succeed("192.0.2.4", "bob")
+	defer basicCache.forget("bob")
+
+	handler := authHandler(authOptions{anonymous: rejectAnonymous, basic: true}, func(w http.ResponseWriter, r *http.Request) {})
+	status := func(password string) int {
+		r := httptest.NewRequest("GET", movieURL+"a/Alien.mkv", nil)
+		r.RemoteAddr = "192.0.2.4:1234"
+		r.SetBasicAuth("bob", password)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+	lastLogin := func() time.Time {
+		users, err := s.Users()
+		check(t, err)
+		return users[0].LastLogin.Time
+	}
+
+	expect(t, "first status", status("secret"), http.StatusOK)
+	first := lastLogin()
+	expect(t, "cached status", status("secret"), http.StatusOK)
+	expect(t, "last login after a cached request", lastLogin(), first)
+	expect(t, "wrong password status", status("guess"), http.StatusUnauthorized)
+
+	// Changing the password, locking the account and removing the
+	// user each stop the cached credentials from working
+	newHash, err := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+	check(t, err)
+	_, err = s.SetPasswordHash("bob", string(newHash))
+	check(t, err)
+	expect(t, "status after changing the password", status("secret"), http.StatusUnauthorized)
+	expect(t, "status with the new password", status("other"), http.StatusOK)
+	check(t, s.LockAccount("bob"))
+	expect(t, "status after locking", status("other"), http.StatusForbidden)
+	_, err = s.UnlockAccount("bob")
+	check(t, err)
+	expect(t, "status after unlocking", status("other"), http.StatusOK)
+	_, err = s.DeleteUser("bob")
+	check(t, err)
+	expect(t, "status after removing the user", status("other"), http.StatusUnauthorized)
+}
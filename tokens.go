@@ -0,0 +1,106 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// API tokens, which let scripts authenticate with an
+// "Authorization: Bearer" header instead of a session cookie. Only
+// the SHA-256 hash of a token is stored, so a token can't be
+// recovered from the database.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Tokens with this scope can list libraries and tables
+	scopeList = "list"
+	// Tokens with this scope can also download movies
+	scopeDownload = "download"
+
+	tokenPrefix = "ms_"
+	// The number of random bytes in a token
+	tokenLen = 32
+)
+
+// Ranks the scopes, so that a token can access anything requiring
+// its scope or a lower one
+var scopeRanks = map[string]int{
+	scopeList:     1,
+	scopeDownload: 2,
+}
+
+// Returns true if a token with the given scope can access a handler
+// requiring the required scope
+func scopeAllows(scope, required string) bool {
+	return scopeRanks[scope] >= scopeRanks[required]
+}
+
+// Returns the hex SHA-256 hash of a token, which is what gets stored
+// in the database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a new token for the user with the given scope, returning
+// the token itself. This is the only time the token is available.
+func createToken(user, scope string) (string, error) {
+	if _, ok := scopeRanks[scope]; !ok {
+		return "", fmt.Errorf("Invalid scope %q: must be %q or %q", scope, scopeList, scopeDownload)
+	}
+	randbuf := make([]byte, tokenLen)
+	if _, err := rand.Read(randbuf); err != nil {
+		return "", err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(randbuf)
+	if err := dbStore.NewToken(user, hashToken(token), scope); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// A row of the api_tokens table, without the token hash
+type apiToken struct {
+	ID       uint64
+	User     string
+	Scope    string
+	Created  time.Time
+	LastUsed sql.NullTime
+}
+
+// Returns the token in the request's Authorization header, and
+// whether there was a bearer token at all
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[len("Bearer "):]), true
+}
+
+// Looks up the user and scope of a token, recording that the token
+// was used. If the token doesn't exist, it returns an empty user.
+func checkToken(token string) (string, string, error) {
+	return dbStore.UseToken(hashToken(token))
+}
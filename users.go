@@ -0,0 +1,166 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// User accounts and password hashing
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/golang/glog"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A row of the users table, without the password hash
+type userInfo struct {
+	Name      string
+	Created   time.Time
+	LastLogin sql.NullTime
+	LockedAt  sql.NullTime
+}
+
+var (
+	// A hash that checkPassword compares against when the user
+	// doesn't exist, so that a login attempt for a nonexistent
+	// user takes as long as one for an existing user
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// Returns the bcrypt hash of the password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Returns true if the password matches the user's stored hash. If it
+// does, it also records the login time.
+func checkPassword(user, password string) (bool, error) {
+	hash, ok, err := dbStore.PasswordHash(user)
+	if err != nil {
+		return false, err
+	} else if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("movieserver"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false, nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := dbStore.UpdateLastLogin(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the users of the old login table in the order they were
+// found, with their passwords. The login table allowed several
+// passwords per user, and there's no telling which of them is the
+// current one, so users with more than one are an error, naming every
+// such user.
+func (s *sqlStore) loginPasswords() ([]string, map[string]string, error) {
+	rows, err := s.db.Query(s.stmt("getLogins"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	passwords := make(map[string]string)
+	users := make([]string, 0)
+	several := make(map[string]bool)
+	for rows.Next() {
+		var user, password string
+		if err := rows.Scan(&user, &password); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := passwords[user]; !ok {
+			passwords[user] = password
+			users = append(users, user)
+		} else {
+			several[user] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(several) > 0 {
+		ambiguous := make([]string, 0, len(several))
+		for user := range several {
+			ambiguous = append(ambiguous, user)
+		}
+		sort.Strings(ambiguous)
+		return nil, nil, fmt.Errorf("Users %s have several passwords in the login table: delete all but one of each and restart",
+			strings.Join(ambiguous, ", "))
+	}
+	return users, passwords, nil
+}
+
+// Converts the rows of the old plaintext login table into users with
+// hashed passwords, and then drops the login table. If a user has
+// several passwords, nothing is migrated and the login table is kept.
+// Users that already exist are left alone. If there is no login table,
+// it doesn't do anything. Only the MySQL store ever had a login table.
+func (s *sqlStore) migrateLoginTable() error {
+	var tableCount int
+	row := s.db.QueryRow(s.stmt("countLoginTable"), *mysqlDatabase)
+	if err := row.Scan(&tableCount); err != nil {
+		return err
+	}
+	if tableCount == 0 {
+		return nil
+	}
+	glog.V(vLevel).Info("Migrating the login table to the users table")
+
+	users, passwords, err := s.loginPasswords()
+	if err != nil {
+		return err
+	}
+
+	trans, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		hash, err := hashPassword(passwords[user])
+		if err != nil {
+			trans.Rollback()
+			return err
+		}
+		if _, err := trans.Exec(s.stmt("migrateUser"), user, hash); err != nil {
+			trans.Rollback()
+			return err
+		}
+	}
+	if err := trans.Commit(); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(s.stmt("dropLoginTable")); err != nil {
+		return err
+	}
+	glog.V(vLevel).Infof("Migrated %d users from the login table", len(users))
+	return nil
+}
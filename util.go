@@ -19,75 +19,160 @@ package main
 
 import (
 	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
+	"mime"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
-type filePair struct {
-	path string
-	fi   os.FileInfo
+// The MIME type of directories, as in the freedesktop.org
+// shared-mime-info database
+const directoryMIME = "inode/directory"
+
+// The MIME types of video, subtitle and disc image files, which most
+// systems' mime.types don't all know about
+var movieMIMETypes = map[string]string{
+	".3gp":  "video/3gpp",
+	".ass":  "text/x-ssa",
+	".avi":  "video/x-msvideo",
+	".flv":  "video/x-flv",
+	".iso":  "application/x-iso9660-image",
+	".m2ts": "video/mp2t",
+	".m4v":  "video/x-m4v",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp4":  "video/mp4",
+	".mpeg": "video/mpeg",
+	".mpg":  "video/mpeg",
+	".ogv":  "video/ogg",
+	".srt":  "application/x-subrip",
+	".ssa":  "text/x-ssa",
+	".ts":   "video/mp2t",
+	".vob":  "video/mpeg",
+	".vtt":  "text/vtt",
+	".webm": "video/webm",
+	".wmv":  "video/x-ms-wmv",
 }
 
-type filterFunc func(filePair) bool
+// Returns the MIME type of a file from its extension, without any
+// parameters, or application/octet-stream if it isn't known
+func mimeType(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if t, ok := movieMIMETypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return strings.TrimSpace(strings.Split(t, ";")[0])
+	}
+	return "application/octet-stream"
+}
 
-func doWalkDir(path string, fileChan chan filePair, filter filterFunc) error {
-	info, err := os.Lstat(path)
+// Returns the metadata of a file or directory. The size of a directory
+// is left for the caller to add up.
+func fileMeta(fi os.FileInfo) movieMeta {
+	meta := movieMeta{Mtime: fi.ModTime().UTC().Truncate(time.Second), IsDir: fi.IsDir()}
+	if meta.IsDir {
+		meta.MIME = directoryMIME
+	} else {
+		meta.Size = uint64(fi.Size())
+		meta.MIME = mimeType(fi.Name())
+	}
+	return meta
+}
+
+// The number of bytes at each end of a file that its fingerprint
+// covers
+const fingerprintBytes = 64 << 10
+
+// Returns a fingerprint of a file's contents, a hash of its size and
+// of the fingerprintBytes at its start and end. Empty files have no
+// fingerprint.
+func fileFingerprint(path string, size uint64) (string, error) {
+	if size == 0 {
+		return "", nil
+	}
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	fp := filePair{path, info}
-	if !filter(fp) {
-		return nil
+	defer f.Close()
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00", size)
+	if _, err := io.CopyN(h, f, fingerprintBytes); err != nil && err != io.EOF {
+		return "", err
 	}
-	fileChan <- fp
-	if info.IsDir() {
-		dir, err := os.Open(path)
-		if err != nil {
-			return err
+	if size > fingerprintBytes {
+		end := int64(size) - fingerprintBytes
+		if end < fingerprintBytes {
+			end = fingerprintBytes
 		}
-		// Recurse into the subdirectories
-		subfiles, err := dir.Readdirnames(0)
-		if err != nil {
-			return err
+		if _, err := f.Seek(end, io.SeekStart); err != nil {
+			return "", err
 		}
-		dir.Close()
-		for _, subfile := range subfiles {
-			if err := doWalkDir(filepath.Join(path, subfile), fileChan, filter); err != nil {
-				return err
-			}
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
 		}
 	}
-	return nil
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-// Traverses the files at a location, recursing into subdirectories,
-// and adding every file and directory that passes a given filter as
-// an absolute path onto a channel. If a directory fails the filter,
-// it skips the entire directory. The only reason I want to use this
-// rather than filepath.Walk is that filepath.Walk sorts the
-// directories, which is unnecessary for this and thus causes a
-// slowdown
-func walkDir(path string, fileChan chan filePair, filter filterFunc) error {
-	if err := doWalkDir(filepath.Clean(path), fileChan, filter); err != nil {
-		return err
+// Returns the fingerprints of the directories in a map of relative
+// paths to fingerprints of files: a hash of the path (relative to the
+// directory) and fingerprint of every file in it. Directories without
+// any fingerprinted files have no fingerprint.
+func dirFingerprints(files map[string]string) map[string]string {
+	names := make([]string, 0, len(files))
+	for name, fingerprint := range files {
+		if fingerprint != "" {
+			names = append(names, name)
+		}
 	}
-	close(fileChan)
-	return nil
+	// Sorting the full paths sorts the paths relative to each
+	// directory too
+	sort.Strings(names)
+	hashes := make(map[string]hash.Hash)
+	fingerprints := make(map[string]string)
+	for _, name := range names {
+		for dir := name; dir != "."; {
+			dir = filepath.Dir(dir)
+			h, ok := hashes[dir]
+			if !ok {
+				h = sha256.New()
+				hashes[dir] = h
+			}
+			relpath := name
+			if dir != "." {
+				relpath = name[len(dir)+1:]
+			}
+			fmt.Fprintf(h, "%s\x00%s\n", relpath, files[name])
+		}
+	}
+	for dir, h := range hashes {
+		fingerprints[dir] = hex.EncodeToString(h.Sum(nil))
+	}
+	return fingerprints
 }
 
 // tars all the files in a directory, recursing into subdirectories as
-// well. It skips dotfiles and symlinks. dir is the absolute path of
-// the directory needing to be compressed
-func tarDir(dirPath string, tw *tar.Writer) error {
+// well. It skips what the rules and ignore files of the library at
+// moviePath skip, and follows the symlinks its rules follow.
+// dirPath is the absolute path of the directory needing to be
+// compressed
+func tarDir(moviePath, dirPath string, tw *tar.Writer) error {
 	fileChan := make(chan filePair)
-	go walkDir(dirPath, fileChan, func(fp filePair) bool {
-		if filepath.Base(fp.path)[0] == '.' || uint32(fp.fi.Mode()&os.ModeSymlink) > 0 {
-			return false
+	go walkLibrary(moviePath, dirPath, fileChan, libraryFilter(moviePath))
+	// Drains the walk if the tar fails partway
+	defer func() {
+		for range fileChan {
 		}
-		return true
-	})
+	}()
 	// The tar needs to write headers that include the name of the
 	// directory we are compressiong, so it can decompress into
 	// that directory again
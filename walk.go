@@ -0,0 +1,270 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Walking directory trees with a pool of workers, which list
+// directories in parallel. On network mounts, where every listing
+// waits on the server, that's much faster than walking serially.
+// Walks can follow symlinks, watching for cycles.
+
+package main
+
+import (
+	"github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type filePair struct {
+	path string
+	fi   os.FileInfo
+}
+
+type filterFunc func(filePair) bool
+
+// How a walk treats symlinks
+type symlinkPolicy int
+
+const (
+	// Symlinks are sent as they are, without following them
+	symlinksDeny symlinkPolicy = iota
+	// Symlinks are followed if they point inside the walk's root
+	symlinksWithin
+	// Symlinks are followed wherever they point
+	symlinksAllow
+)
+
+// A directory waiting to be listed
+type queuedDir struct {
+	path string
+	// The directories it's in, up to the root of the walk, when
+	// following symlinks
+	ancestors []os.FileInfo
+}
+
+// Lists the files in a directory, with their lstat info. Files
+// deleted since the directory was read are left out. It's a variable
+// so that benchmarks can simulate slow mounts.
+var listDir = func(path string) ([]os.FileInfo, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdir(0)
+}
+
+// The state of a walk shared by its workers
+type walker struct {
+	fileChan chan filePair
+	filter   filterFunc
+	links    symlinkPolicy
+	// The root symlinks are kept in with symlinksWithin, with every
+	// symlink in it resolved
+	realRoot string
+	sync.Mutex
+	// Signaled when directories are queued or finished
+	cond *sync.Cond
+	// The directories waiting to be listed, as a stack, so that the
+	// walk goes mostly depth first and the stack stays small
+	queue []queuedDir
+	// The number of directories queued or being listed
+	pending int
+	// The first error, which stops the walk
+	err error
+}
+
+// Lists directories off the queue until there are none left, or a
+// worker fails
+func (w *walker) work() {
+	w.Lock()
+	defer w.Unlock()
+	for {
+		for len(w.queue) == 0 && w.pending > 0 && w.err == nil {
+			w.cond.Wait()
+		}
+		if w.pending == 0 || w.err != nil {
+			return
+		}
+		dir := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		w.Unlock()
+		subdirs, err := w.list(dir)
+		w.Lock()
+		// Directories deleted since they were queued are skipped
+		if err != nil && !os.IsNotExist(err) && w.err == nil {
+			w.err = err
+		}
+		w.queue = append(w.queue, subdirs...)
+		w.pending += len(subdirs) - 1
+		w.cond.Broadcast()
+	}
+}
+
+// Sends the files in a directory that pass the filter, returning its
+// subdirectories that did
+func (w *walker) list(dir queuedDir) ([]queuedDir, error) {
+	infos, err := listDir(dir.path)
+	if err != nil {
+		return nil, err
+	}
+	var subdirs []queuedDir
+	for _, info := range infos {
+		fp := filePair{filepath.Join(dir.path, info.Name()), info}
+		if info.Mode()&os.ModeSymlink > 0 && w.links != symlinksDeny {
+			var ok bool
+			if fp, ok = w.follow(fp.path); !ok {
+				continue
+			}
+		}
+		if !w.filter(fp) {
+			continue
+		}
+		if fp.fi.IsDir() {
+			subdir, ok := w.enter(dir, fp)
+			if !ok {
+				continue
+			}
+			subdirs = append(subdirs, subdir)
+		}
+		w.fileChan <- fp
+	}
+	return subdirs, nil
+}
+
+// Returns a symlink with the info of what it points to, if the policy
+// lets the walk follow it. Broken links aren't followed.
+func (w *walker) follow(path string) (filePair, bool) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		glog.V(vvLevel).Infof("Not following %s: %s", path, err)
+		return filePair{}, false
+	}
+	if w.links == symlinksWithin && target != w.realRoot &&
+		!strings.HasPrefix(target, w.realRoot+string(filepath.Separator)) {
+		glog.V(vvLevel).Infof("Not following %s, which points outside %s", path, w.realRoot)
+		return filePair{}, false
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		glog.V(vvLevel).Infof("Not following %s: %s", path, err)
+		return filePair{}, false
+	}
+	return filePair{path, info}, true
+}
+
+// Returns a subdirectory to queue, unless following symlinks led back
+// to a directory it's in, by device and inode
+func (w *walker) enter(parent queuedDir, fp filePair) (queuedDir, bool) {
+	if w.links == symlinksDeny {
+		return queuedDir{path: fp.path}, true
+	}
+	for _, ancestor := range parent.ancestors {
+		if os.SameFile(ancestor, fp.fi) {
+			glog.V(vvLevel).Infof("Not following %s, which loops back to a directory it's in", fp.path)
+			return queuedDir{}, false
+		}
+	}
+	ancestors := make([]os.FileInfo, len(parent.ancestors)+1)
+	copy(ancestors, parent.ancestors)
+	ancestors[len(parent.ancestors)] = fp.fi
+	return queuedDir{fp.path, ancestors}, true
+}
+
+// Traverses the files at a location, recursing into subdirectories,
+// and adding every file and directory that passes a given filter as
+// an absolute path onto a channel. If a directory fails the filter,
+// it skips the entire directory. Up to walk-workers directories are
+// listed at once, so files from different directories come
+// interleaved, but every directory comes before the files in it.
+// Unlike filepath.Walk, nothing is sorted, which is unnecessary for
+// this and thus causes a slowdown. The channel is closed when the walk
+// is done, even if it fails. Symlinks are sent without being followed.
+func walkDir(path string, fileChan chan filePair, filter filterFunc) error {
+	return walkDirLinks(path, "", symlinksDeny, fileChan, filter)
+}
+
+// Walks a path in the library at moviePath like walkDir, following
+// symlinks as the library's rules say
+func walkLibrary(moviePath, path string, fileChan chan filePair, filter filterFunc) error {
+	return walkDirLinks(path, moviePath, rulesForPath(moviePath).Symlinks, fileChan, filter)
+}
+
+// Like walkDir, but follows symlinks as the policy says, sending them
+// with the info of what they point to. Links that aren't followed are
+// left out, except with symlinksDeny, which sends them as they are.
+// root is the directory symlinksWithin keeps links in. Directories
+// that a link leads back into, which would make the walk loop forever,
+// are skipped.
+func walkDirLinks(path, root string, links symlinkPolicy, fileChan chan filePair, filter filterFunc) error {
+	defer close(fileChan)
+	path = filepath.Clean(path)
+	w := &walker{fileChan: fileChan, filter: filter, links: links}
+	if links == symlinksWithin {
+		var err error
+		if w.realRoot, err = filepath.EvalSymlinks(root); err != nil {
+			return err
+		}
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	fp := filePair{path, info}
+	if info.Mode()&os.ModeSymlink > 0 && links != symlinksDeny {
+		var ok bool
+		if fp, ok = w.follow(path); !ok {
+			return nil
+		}
+	}
+	if !filter(fp) {
+		return nil
+	}
+	fileChan <- fp
+	if !fp.fi.IsDir() {
+		return nil
+	}
+
+	w.queue, w.pending = []queuedDir{{path: path}}, 1
+	if links != symlinksDeny {
+		// A walk of a directory inside root watches for loops back
+		// to the directories above it too, like a walk of root would
+		var ancestors []os.FileInfo
+		if relpath, err := filepath.Rel(root, path); root != "" && err == nil && !strings.HasPrefix(relpath, "..") {
+			for dir := filepath.Dir(path); relpath != "."; dir, relpath = filepath.Dir(dir), filepath.Dir(relpath) {
+				if info, err := os.Stat(dir); err == nil {
+					ancestors = append([]os.FileInfo{info}, ancestors...)
+				}
+			}
+		}
+		w.queue[0].ancestors = append(ancestors, fp.fi)
+	}
+	w.cond = sync.NewCond(w)
+	workers := *walkWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+	return w.err
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests and benchmarks of the directory walker
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Makes a tree of the given depth under dir, where every directory has
+// dirs subdirectories and files files
+func makeTestTree(t testing.TB, dir string, depth, dirs, files int) {
+	for i := 0; i < files; i++ {
+		check(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("movie%d.mkv", i)), []byte("movie"), 0644))
+	}
+	if depth == 0 {
+		return
+	}
+	for i := 0; i < dirs; i++ {
+		subdir := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+		check(t, os.Mkdir(subdir, 0755))
+		makeTestTree(t, subdir, depth-1, dirs, files)
+	}
+}
+
+// Sets walk-workers for a test or benchmark
+func setWalkWorkers(t testing.TB, workers int) {
+	old := *walkWorkers
+	*walkWorkers = workers
+	t.Cleanup(func() { *walkWorkers = old })
+}
+
+// Walks a directory with walkDir, skipping dotfiles, and returns the
+// paths it sent, checking that every directory came before the files
+// in it
+func walkTestTree(t testing.TB, dir string) []string {
+	fileChan := make(chan filePair)
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- walkDir(dir, fileChan, func(fp filePair) bool {
+			return fp.path == dir || filepath.Base(fp.path)[0] != '.'
+		})
+	}()
+	seen := make(map[string]bool)
+	var paths []string
+	for fp := range fileChan {
+		if fp.path != dir && !seen[filepath.Dir(fp.path)] {
+			t.Errorf("%s came before its directory", fp.path)
+		}
+		seen[fp.path] = true
+		paths = append(paths, fp.path)
+	}
+	check(t, <-walkErr)
+	sort.Strings(paths)
+	return paths
+}
+
+func TestWalkDir(t *testing.T) {
+	dir := t.TempDir()
+	makeTestTree(t, dir, 3, 3, 2)
+	check(t, os.Mkdir(filepath.Join(dir, "dir0", ".hidden"), 0755))
+	check(t, ioutil.WriteFile(filepath.Join(dir, "dir0", ".hidden", "movie.mkv"), []byte("movie"), 0644))
+	var want []string
+	check(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if filepath.Base(path) == ".hidden" {
+			return filepath.SkipDir
+		}
+		want = append(want, path)
+		return err
+	}))
+	for _, workers := range []int{1, 4, 0} {
+		setWalkWorkers(t, workers)
+		expect(t, fmt.Sprintf("walk with %d workers", workers), walkTestTree(t, dir), want)
+	}
+
+	// Walking a file sends just the file
+	file := filepath.Join(dir, "movie0.mkv")
+	expect(t, "walk of a file", walkTestTree(t, file), []string{file})
+
+	// Directories that can't be listed fail the walk, after which
+	// the channel is still closed
+	if os.Getuid() != 0 {
+		check(t, os.Chmod(filepath.Join(dir, "dir1"), 0))
+		defer os.Chmod(filepath.Join(dir, "dir1"), 0755)
+		fileChan := make(chan filePair)
+		walkErr := make(chan error, 1)
+		go func() { walkErr <- walkDir(dir, fileChan, func(filePair) bool { return true }) }()
+		for range fileChan {
+		}
+		if err := <-walkErr; !os.IsPermission(err) {
+			t.Errorf("Expected a permission error, got %v", err)
+		}
+	}
+}
+
+// Benchmarks walks of a tree of 781 directories and 4,686 files with
+// different numbers of workers, on the local disk and on a simulated
+// network mount, where every listing takes an extra 200µs
+func BenchmarkWalkDir(b *testing.B) {
+	dir := b.TempDir()
+	makeTestTree(b, dir, 4, 5, 6)
+	for _, mount := range []string{"local", "network"} {
+		for _, workers := range []int{1, 2, 4, 8, 16, 32} {
+			b.Run(fmt.Sprintf("%s/workers=%d", mount, workers), func(b *testing.B) {
+				setWalkWorkers(b, workers)
+				if mount == "network" {
+					oldListDir := listDir
+					listDir = func(path string) ([]os.FileInfo, error) {
+						time.Sleep(200 * time.Microsecond)
+						return oldListDir(path)
+					}
+					defer func() { listDir = oldListDir }()
+				}
+				for i := 0; i < b.N; i++ {
+					fileChan := make(chan filePair)
+					go walkDir(dir, fileChan, func(filePair) bool { return true })
+					for range fileChan {
+					}
+				}
+			})
+		}
+	}
+}
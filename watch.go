@@ -0,0 +1,87 @@
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Watching the libraries for changes, so that the indexer only has to
+// look at what changed instead of walking every library. Watching is
+// only supported on Linux, with inotify. Elsewhere, or once the
+// watcher fails, the indexer polls.
+
+package main
+
+import (
+	"sync"
+)
+
+// Watches the libraries for files and directories that are created,
+// deleted, renamed or modified
+type libraryWatcher interface {
+	// Returns and forgets the changes seen since the last call, as a
+	// map from library paths to the paths that changed in them,
+	// relative to the library. A changed directory means everything
+	// in it changed, and "." means the whole library did. If events
+	// were lost, rescan is true and the libraries need a full walk.
+	// If the watcher has stopped working, err is set and the
+	// libraries have to be polled instead.
+	Changes() (changes map[string]map[string]bool, rescan bool, err error)
+	// Stops watching
+	Close() error
+}
+
+// The changes a watcher has seen but the indexer hasn't taken yet.
+// Watchers embed it to implement Changes.
+type libraryChanges struct {
+	sync.Mutex
+	paths  map[string]map[string]bool
+	rescan bool
+	err    error
+}
+
+// Records that a path in a library changed
+func (c *libraryChanges) add(library, relpath string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.paths == nil {
+		c.paths = make(map[string]map[string]bool)
+	}
+	if c.paths[library] == nil {
+		c.paths[library] = make(map[string]bool)
+	}
+	c.paths[library][relpath] = true
+}
+
+// Records that events were lost
+func (c *libraryChanges) lost() {
+	c.Lock()
+	defer c.Unlock()
+	c.rescan = true
+}
+
+// Records that the watcher stopped working. Only the first error is
+// kept.
+func (c *libraryChanges) fail(err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+func (c *libraryChanges) Changes() (map[string]map[string]bool, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+	paths, rescan := c.paths, c.rescan
+	c.paths, c.rescan = nil, false
+	return paths, rescan, c.err
+}
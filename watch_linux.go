@@ -0,0 +1,238 @@
+//go:build linux
+
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// The inotify library watcher. inotify watches aren't recursive, so
+// every directory in a library gets its own watch, and directories
+// that are created or moved into a library are watched as they show
+// up.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The events watched on every directory. Directories the library's
+// rules or ignore files skip aren't watched. A directory reached
+// through more than one followed symlink only reports changes under
+// one of its paths, which the periodic full walk makes up for.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR |
+	syscall.IN_DONT_FOLLOW | syscall.IN_EXCL_UNLINK
+
+// A watched directory
+type watchedDir struct {
+	library string
+	// Relative to the library
+	relpath string
+}
+
+type inotifyWatcher struct {
+	libraryChanges
+	fd   int
+	file *os.File
+	// Maps watch descriptors to their directories. Only the reading
+	// goroutine touches it once it has started.
+	dirs   map[int32]watchedDir
+	closed chan bool
+	done   sync.WaitGroup
+}
+
+// Starts watching every directory in the given libraries. Fails if
+// inotify isn't available or there aren't enough watches for every
+// directory, in which case the libraries have to be polled.
+func newLibraryWatcher(libraries []string) (libraryWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("Could not start inotify: %s", err)
+	}
+	w := &inotifyWatcher{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		dirs:   make(map[int32]watchedDir),
+		closed: make(chan bool),
+	}
+	for _, library := range libraries {
+		if err := w.watchTree(library, "."); err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+	w.done.Add(1)
+	go w.read()
+	return w, nil
+}
+
+// Watches a directory in a library and every directory under it.
+// Each directory is watched from the walk's filter, before the walk
+// lists it, so a subdirectory created meanwhile is either listed or
+// reported. Directories that disappear before they are watched are
+// skipped, and so are the ones that can't be read, which the indexer
+// can't walk either. Running out of watches is an error.
+func (w *inotifyWatcher) watchTree(library, relpath string) error {
+	root := filepath.Join(library, relpath)
+	filter := libraryFilter(library)
+	// Symlinks to directories that the walk follows are watched
+	// through
+	mask := uint32(inotifyMask)
+	if rulesForPath(library).Symlinks != symlinksDeny {
+		mask &^= syscall.IN_DONT_FOLLOW
+	}
+	// The walk's workers call the filter in parallel
+	var lock sync.Mutex
+	var watchErr error
+	fileChan := make(chan filePair)
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- walkLibrary(library, root, fileChan, func(fp filePair) bool {
+			if !fp.fi.IsDir() || !filter(fp) {
+				return false
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if watchErr != nil {
+				return false
+			}
+			wd, err := syscall.InotifyAddWatch(w.fd, fp.path, mask)
+			switch {
+			case err == syscall.ENOSPC:
+				watchErr = errors.New("Ran out of inotify watches. Raise fs.inotify.max_user_watches to watch every directory in the libraries")
+				return false
+			case err == syscall.ENOENT || err == syscall.ENOTDIR:
+				return false
+			case err != nil:
+				glog.Warningf("Could not watch %s: %s", fp.path, err)
+				return false
+			}
+			dirRel, _ := filepath.Rel(library, fp.path)
+			w.dirs[int32(wd)] = watchedDir{library, dirRel}
+			return true
+		})
+	}()
+	for range fileChan {
+	}
+	if err := <-walkErr; err != nil && !os.IsNotExist(err) && watchErr == nil {
+		glog.Warningf("Could not watch everything in %s: %s", root, err)
+	}
+	return watchErr
+}
+
+// Stops watching a directory in a library and every directory under
+// it, after it was moved away
+func (w *inotifyWatcher) unwatchTree(library, relpath string) {
+	prefix := relpath + string(filepath.Separator)
+	for wd, dir := range w.dirs {
+		if dir.library == library && (dir.relpath == relpath || strings.HasPrefix(dir.relpath, prefix)) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// Reads events until the watcher is closed or fails
+func (w *inotifyWatcher) read() {
+	defer w.done.Done()
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.closed:
+			default:
+				w.fail(fmt.Errorf("Could not read inotify events: %s", err))
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+			name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+			if err := w.handle(event.Wd, event.Mask, name); err != nil {
+				w.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// Records the change an event is about
+func (w *inotifyWatcher) handle(wd int32, mask uint32, name string) error {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.lost()
+		return nil
+	}
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return nil
+	}
+	switch {
+	case mask&syscall.IN_IGNORED != 0:
+		delete(w.dirs, wd)
+		return nil
+	case mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0:
+		// Subdirectories show up as deleted or moved in their
+		// parents, but a library itself has no watched parent, and
+		// nothing would watch it if it came back
+		if dir.relpath == "." {
+			return fmt.Errorf("%s was deleted or moved", dir.library)
+		}
+		return nil
+	case name == ignoreFileName:
+		// Everything in the directory may be ignored or included
+		// now, including directories that need watching
+		if mask&syscall.IN_ISDIR == 0 {
+			if err := w.watchTree(dir.library, dir.relpath); err != nil {
+				return err
+			}
+			w.add(dir.library, dir.relpath)
+		}
+		return nil
+	case name == "" || (name[0] == '.' && !rulesForPath(dir.library).Hidden):
+		return nil
+	}
+	relpath := filepath.Join(dir.relpath, name)
+	if mask&syscall.IN_ISDIR != 0 {
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			// Files created in the directory before it was
+			// watched are picked up when the indexer walks it
+			if err := w.watchTree(dir.library, relpath); err != nil {
+				return err
+			}
+		} else if mask&syscall.IN_MOVED_FROM != 0 {
+			w.unwatchTree(dir.library, relpath)
+		}
+	}
+	w.add(dir.library, relpath)
+	return nil
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.closed)
+	err := w.file.Close()
+	w.done.Wait()
+	return err
+}
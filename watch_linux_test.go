@@ -0,0 +1,103 @@
+//go:build linux
+
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Tests of the inotify library watcher
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Collects a watcher's changes until it has seen every expected path
+// or a few seconds have passed. A change to a directory covers
+// everything under it, since the indexer walks the whole directory
+// again, and files created in a new directory before it's watched are
+// only reported that way.
+func waitForChanges(t *testing.T, w libraryWatcher, library string, expected ...string) map[string]bool {
+	seen := make(map[string]bool)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		changes, rescan, err := w.Changes()
+		check(t, err)
+		expect(t, "rescan", rescan, false)
+		for relpath := range changes[library] {
+			seen[relpath] = true
+		}
+		missing := false
+		for _, relpath := range expected {
+			covered := false
+			for dir := relpath; dir != "." && !covered; dir = filepath.Dir(dir) {
+				covered = seen[dir]
+			}
+			missing = missing || !covered
+		}
+		if !missing {
+			return seen
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected changes to %v, saw %v", expected, seen)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInotifyWatcher(t *testing.T) {
+	library := t.TempDir()
+	check(t, os.MkdirAll(filepath.Join(library, "Brazil"), 0755))
+	w, err := newLibraryWatcher([]string{library})
+	check(t, err)
+	defer w.Close()
+
+	check(t, ioutil.WriteFile(filepath.Join(library, "Brazil/disc1"), []byte("brazil"), 0644))
+	check(t, ioutil.WriteFile(filepath.Join(library, ".hidden"), []byte("hidden"), 0644))
+	seen := waitForChanges(t, w, library, "Brazil/disc1")
+	if seen[".hidden"] {
+		t.Error("Dotfiles were reported")
+	}
+
+	// New directories are watched too, and so are the ones moved in
+	check(t, os.MkdirAll(filepath.Join(library, "Dune/extras"), 0755))
+	waitForChanges(t, w, library, "Dune")
+	check(t, ioutil.WriteFile(filepath.Join(library, "Dune/extras/trailer"), []byte("dune"), 0644))
+	waitForChanges(t, w, library, "Dune/extras/trailer")
+	check(t, os.Rename(filepath.Join(library, "Brazil"), filepath.Join(library, "Brazil (1985)")))
+	waitForChanges(t, w, library, "Brazil", "Brazil (1985)")
+	check(t, os.Remove(filepath.Join(library, "Brazil (1985)/disc1")))
+	waitForChanges(t, w, library, "Brazil (1985)/disc1")
+
+	// Editing an ignore file changes its whole directory
+	check(t, ioutil.WriteFile(filepath.Join(library, "Dune", ignoreFileName), []byte("extras/\n"), 0644))
+	waitForChanges(t, w, library, "Dune")
+
+	// Losing the library itself stops the watcher
+	check(t, os.RemoveAll(library))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err := w.Changes(); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The watcher didn't fail when the library was deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+/*
+Copyright 2013 Manu Goyal
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+// Watching libraries isn't supported outside Linux, so the indexer
+// polls
+
+package main
+
+import (
+	"errors"
+)
+
+func newLibraryWatcher(libraries []string) (libraryWatcher, error) {
+	return nil, errors.New("Watching libraries is only supported on Linux")
+}